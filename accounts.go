@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+type AccountsResponseBody struct {
+	Accounts []AccountProperties `json:"accounts"`
+}
+
+type AccountProperties struct {
+	Id   string   `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+func accountsAction(c *cli.Context) error {
+	configPath := c.String("config")
+	// Listing the accounts needs a token only, so that --select can fill in
+	// the account id on first use.
+	session, err := newSession(configPath, defaultProfile, false)
+	if err != nil {
+		return err
+	}
+
+	if !c.Bool("select") {
+		return watch(session, c.Duration("watch"), func() error {
+			accounts, err := getAccounts(session)
+			if err != nil {
+				return err
+			}
+			for _, account := range accounts {
+				bytes, err := json.Marshal(account)
+				if err != nil {
+					return err
+				}
+				if err := session.Output.Emit(string(bytes)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	accounts, err := getAccounts(session)
+	if err != nil {
+		return err
+	}
+
+	account, err := selectAccount(accounts, os.Stdin, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	err = SetDefaultAccountId(configPath, account.Id)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote account_id %s to %s\n", account.Id, configPath)
+
+	return nil
+}
+
+func getAccounts(session *Session) ([]AccountProperties, error) {
+	baseUrl := session.Credentials.Default.ApiUrl()
+	url := fmt.Sprintf("%s/v3/accounts", baseUrl)
+
+	bytes, _, err := session.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var body AccountsResponseBody
+	if err := json.Unmarshal(bytes, &body); err != nil {
+		return nil, err
+	}
+
+	return body.Accounts, nil
+}
+
+// selectAccount asks on the terminal, reading the answer from in and writing
+// the question to out, which of the accounts to use.
+func selectAccount(accounts []AccountProperties, in io.Reader, out io.Writer) (*AccountProperties, error) {
+	if len(accounts) == 0 {
+		return nil, errors.New("no accounts are available for this token")
+	}
+	if len(accounts) == 1 {
+		return &accounts[0], nil
+	}
+
+	for i, account := range accounts {
+		fmt.Fprintf(out, "%d) %s %s\n", i+1, account.Id, strings.Join(account.Tags, ","))
+	}
+	fmt.Fprintf(out, "select account [1-%d]: ", len(accounts))
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || index < 1 || index > len(accounts) {
+		return nil, fmt.Errorf("invalid selection: %s", strings.TrimSpace(line))
+	}
+
+	return &accounts[index-1], nil
+}
+
+// SetDefaultAccountId rewrites default.account_id in the credentials file,
+// keeping every other key as it is.
+func SetDefaultAccountId(path string, accountId string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	document := yaml.MapSlice{}
+	if err := yaml.Unmarshal(bytes, &document); err != nil {
+		return err
+	}
+
+	document = setMapSliceValue(document, "default", func(value interface{}) interface{} {
+		profile, _ := value.(yaml.MapSlice)
+		return setMapSliceValue(profile, "account_id", func(interface{}) interface{} {
+			return accountId
+		})
+	})
+
+	bytes, err = yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, bytes, 0600)
+}
+
+// setMapSliceValue replaces the value of key, appending the key if missing.
+func setMapSliceValue(slice yaml.MapSlice, key string, update func(interface{}) interface{}) yaml.MapSlice {
+	for i, item := range slice {
+		if item.Key == key {
+			slice[i].Value = update(item.Value)
+			return slice
+		}
+	}
+	return append(slice, yaml.MapItem{Key: key, Value: update(nil)})
+}
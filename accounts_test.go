@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestGetAccounts(t *testing.T) {
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/accounts" {
+			t.Errorf("requested %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"accounts":[{"id":"101-001-1-001","tags":[]},{"id":"101-001-1-002","tags":["hedging"]}]}`))
+	}))
+	accounts, err := getAccounts(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AccountProperties{{Id: "101-001-1-001", Tags: []string{}}, {Id: "101-001-1-002", Tags: []string{"hedging"}}}
+	if !reflect.DeepEqual(accounts, want) {
+		t.Errorf("got %v, want %v", accounts, want)
+	}
+}
+
+func TestSelectAccount(t *testing.T) {
+	accounts := []AccountProperties{{Id: "101-001-1-001"}, {Id: "101-001-1-002", Tags: []string{"hedging"}}}
+	tests := []struct {
+		name     string
+		accounts []AccountProperties
+		input    string
+		want     string
+		asked    bool
+	}{
+		{"only one", accounts[:1], "", "101-001-1-001", false},
+		{"first", accounts, "1\n", "101-001-1-001", true},
+		{"second", accounts, " 2 \n", "101-001-1-002", true},
+		{"out of range", accounts, "3\n", "", true},
+		{"not a number", accounts, "b\n", "", true},
+		{"no answer", accounts, "", "", true},
+		{"none", nil, "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var prompt bytes.Buffer
+			account, err := selectAccount(test.accounts, strings.NewReader(test.input), &prompt)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("selected %s, want an error", account.Id)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if account.Id != test.want {
+				t.Errorf("selected %s, want %s", account.Id, test.want)
+			}
+			if asked := prompt.Len() != 0; asked != test.asked {
+				t.Errorf("prompted %q", prompt.String())
+			}
+			if test.asked && !strings.Contains(prompt.String(), "2) 101-001-1-002 hedging\n") {
+				t.Errorf("the prompt %q does not list the accounts", prompt.String())
+			}
+		})
+	}
+}
+
+func TestSetDefaultAccountId(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials string
+	}{
+		{"replaces", "default:\n  environment: practice\n  token: secret\n  account_id: old\nlive:\n  token: other\n"},
+		{"adds", "default:\n  environment: practice\n  token: secret\nlive:\n  token: other\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.credentials), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := SetDefaultAccountId(path, "101-001-1-002"); err != nil {
+				t.Fatal(err)
+			}
+
+			bytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]map[string]string
+			if err := yaml.Unmarshal(bytes, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]map[string]string{
+				"default": {"environment": "practice", "token": "secret", "account_id": "101-001-1-002"},
+				"live":    {"token": "other"},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
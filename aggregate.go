@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// TransactionAggregator counts transactions by type per time window
+// (--aggregate-transactions), windows being aligned to the clock like
+// candles. A window is emitted once a transaction or heartbeat of a later
+// window arrives, and the current one by Flush.
+type TransactionAggregator struct {
+	Window time.Duration
+	Output *Output
+	start  time.Time
+	counts map[string]int
+	total  int
+}
+
+// TransactionCounts is the summary of one window.
+type TransactionCounts struct {
+	Type        string         `json:"type"`
+	WindowStart time.Time      `json:"window_start"`
+	WindowEnd   time.Time      `json:"window_end"`
+	Total       int            `json:"total"`
+	ByType      map[string]int `json:"by_type"`
+}
+
+// Add counts a transaction of the given type at the given time.
+func (self *TransactionAggregator) Add(transactionType string, at time.Time) error {
+	if err := self.Advance(at); err != nil {
+		return err
+	}
+	if self.counts == nil {
+		self.start = at.Truncate(self.Window)
+		self.counts = map[string]int{}
+	}
+	self.counts[transactionType]++
+	self.total++
+	return nil
+}
+
+// Advance emits the current window if at lies beyond it, e.g. on a heartbeat.
+func (self *TransactionAggregator) Advance(at time.Time) error {
+	if self.counts == nil || at.Before(self.start.Add(self.Window)) {
+		return nil
+	}
+	return self.Flush()
+}
+
+// Flush emits the current window, if it counted anything.
+func (self *TransactionAggregator) Flush() error {
+	if self.counts == nil {
+		return nil
+	}
+
+	summary := TransactionCounts{
+		Type:        "TRANSACTION_COUNTS",
+		WindowStart: self.start,
+		WindowEnd:   self.start.Add(self.Window),
+		Total:       self.total,
+		ByType:      self.counts,
+	}
+	self.counts = nil
+	self.total = 0
+
+	bytes, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return self.Output.Emit(string(bytes))
+}
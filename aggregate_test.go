@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTransactionAggregator(t *testing.T) {
+	fill := func(id string, at string) string {
+		return `{"id":"` + id + `","type":"ORDER_FILL","time":"2021-03-01T00:` + at + `Z"}`
+	}
+	order := func(id string, at string) string {
+		return `{"id":"` + id + `","type":"MARKET_ORDER","time":"2021-03-01T00:` + at + `Z"}`
+	}
+	heartbeat := func(at string) string {
+		return `{"type":"HEARTBEAT","time":"2021-03-01T00:` + at + `Z"}`
+	}
+	counts := func(from string, to string, total int, byType string) string {
+		return `{"type":"TRANSACTION_COUNTS","window_start":"2021-03-01T00:` + from + `Z","window_end":"2021-03-01T00:` + to + `Z","total":` + strconv.Itoa(total) + `,"by_type":` + byType + `}`
+	}
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			"one window",
+			[]string{order("1", "00:10"), fill("2", "00:11"), fill("3", "00:59")},
+			[]string{counts("00:00", "01:00", 3, `{"MARKET_ORDER":1,"ORDER_FILL":2}`)},
+		},
+		{
+			"windows closed by later transactions",
+			[]string{fill("1", "00:10"), fill("2", "01:00"), order("3", "03:30")},
+			[]string{
+				counts("00:00", "01:00", 1, `{"ORDER_FILL":1}`),
+				counts("01:00", "02:00", 1, `{"ORDER_FILL":1}`),
+				counts("03:00", "04:00", 1, `{"MARKET_ORDER":1}`),
+			},
+		},
+		{
+			"window closed by a heartbeat",
+			[]string{fill("1", "00:10"), heartbeat("00:30"), heartbeat("01:05"), heartbeat("02:05")},
+			[]string{counts("00:00", "01:00", 1, `{"ORDER_FILL":1}`)},
+		},
+		{
+			"heartbeats only",
+			[]string{heartbeat("00:05"), heartbeat("01:05")},
+			[]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := transactionLines(t, TransactionsOptions{Aggregate: time.Minute}, test.lines...)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got  %v\nwant %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransactionAggregatorAdvance(t *testing.T) {
+	output := &bytes.Buffer{}
+	aggregator := &TransactionAggregator{Window: time.Minute, Output: &Output{Writer: output}}
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name  string
+		step  func() error
+		lines int
+	}{
+		{"nothing counted", func() error { return aggregator.Advance(start.Add(5 * time.Minute)) }, 0},
+		{"counted", func() error { return aggregator.Add("ORDER_FILL", start.Add(10*time.Second)) }, 0},
+		{"within the window", func() error { return aggregator.Advance(start.Add(59 * time.Second)) }, 0},
+		{"at its end", func() error { return aggregator.Advance(start.Add(time.Minute)) }, 1},
+		{"flushed empty", aggregator.Flush, 1},
+		{"counted again", func() error { return aggregator.Add("ORDER_FILL", start.Add(2*time.Minute)) }, 1},
+		{"flushed", aggregator.Flush, 2},
+	}
+	for _, step := range steps {
+		if err := step.step(); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(outputLines(output)); got != step.lines {
+			t.Errorf("%s: %d lines, want %d", step.name, got, step.lines)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Banner is the line written to stderr before a stream starts, to confirm
+// what is being run. The account id of config is redacted already, and the
+// one in the endpoint is redacted likewise.
+func Banner(config ResolvedConfig, account string, instruments []string, granularity string, endpoint string) string {
+	fields := []string{
+		"env=" + config.Environment,
+		"profile=" + config.Profile,
+		"account=" + config.AccountId,
+	}
+	if len(instruments) != 0 {
+		fields = append(fields, "instruments="+strings.Join(instruments, ","))
+	}
+	if granularity != "" {
+		fields = append(fields, "granularity="+granularity)
+	}
+	if account != "" {
+		endpoint = strings.Replace(endpoint, account, config.AccountId, -1)
+	}
+	fields = append(fields, "endpoint="+endpoint)
+
+	return "streaming " + strings.Join(fields, " ")
+}
+
+// PrintBanner writes the Banner of the session's account to stderr.
+func (self *Session) PrintBanner(instruments []string, granularity string, endpoint string) {
+	config := NewResolvedConfig(self.ConfigPath, self.Profile, &self.Credentials.Default)
+	fmt.Fprintln(os.Stderr, Banner(config, self.Credentials.Default.AccountId, instruments, granularity, endpoint))
+}
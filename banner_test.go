@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBanner(t *testing.T) {
+	account := &Account{AccountId: "101-001-1234567-001", Token: "secret-token"}
+	config := NewResolvedConfig("oanda.yml", "default", account)
+	endpoint := account.StreamUrl() + "/v3/accounts/" + account.AccountId + "/pricing/stream?instruments=EUR_USD"
+
+	tests := []struct {
+		name        string
+		instruments []string
+		granularity string
+		want        []string
+	}{
+		{"pricing", []string{"EUR_USD", "USD_JPY"}, "", []string{"env=practice", "profile=default", "account=********-001", "instruments=EUR_USD,USD_JPY"}},
+		{"candles", []string{"EUR_USD"}, "M1", []string{"instruments=EUR_USD", "granularity=M1"}},
+		{"transactions", nil, "", []string{"account=********-001", "endpoint="}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			banner := Banner(config, account.AccountId, test.instruments, test.granularity, endpoint)
+			for _, want := range test.want {
+				if !strings.Contains(banner, want) {
+					t.Errorf("%q does not contain %q", banner, want)
+				}
+			}
+			if strings.Contains(banner, account.AccountId) || strings.Contains(banner, account.Token) {
+				t.Errorf("%q shows the credentials in clear", banner)
+			}
+			if test.instruments == nil && strings.Contains(banner, " instruments=") {
+				t.Errorf("%q lists instruments", banner)
+			}
+		})
+	}
+}
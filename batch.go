@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// BatchSpec describes several commands to run concurrently. Since YAML is a
+// superset of JSON, the spec may be written in either.
+//
+//	jobs:
+//	  - name: eurusd
+//	    pricing:
+//	      instruments: EUR_USD
+//	  - name: usdjpy-m1
+//	    candles:
+//	      instrument: USD_JPY
+//	      granularity: M1
+type BatchSpec struct {
+	Jobs []BatchJob `yaml:"jobs"`
+}
+
+// BatchJob is one command of a batch. Exactly one of Pricing, Candles and
+// Transactions must be set.
+type BatchJob struct {
+	Name         string               `yaml:"name"`
+	Pricing      *PricingOptions      `yaml:"pricing"`
+	Candles      *CandlesOptions      `yaml:"candles"`
+	Transactions *TransactionsOptions `yaml:"transactions"`
+}
+
+func GetBatchSpec(path string) (*BatchSpec, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := BatchSpec{}
+	err = unmarshalConfig(bytes, &spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(spec.Jobs) == 0 {
+		return nil, errors.New("batch spec has no jobs")
+	}
+	for i := range spec.Jobs {
+		job := &spec.Jobs[i]
+		if job.Name == "" {
+			job.Name = fmt.Sprintf("job%d", i)
+		}
+		if job.commandCount() != 1 {
+			return nil, fmt.Errorf("job %s: exactly one of pricing, candles or transactions is required", job.Name)
+		}
+		if job.Candles != nil {
+			if err := job.Candles.Validate(); err != nil {
+				return nil, fmt.Errorf("job %s: %w", job.Name, err)
+			}
+		}
+	}
+
+	return &spec, nil
+}
+
+func (self *BatchJob) commandCount() int {
+	count := 0
+	if self.Pricing != nil {
+		count++
+	}
+	if self.Candles != nil {
+		count++
+	}
+	if self.Transactions != nil {
+		count++
+	}
+	return count
+}
+
+func (self *BatchJob) Run(session *Session) error {
+	if self.Pricing != nil {
+		return getStream(session, self.Pricing)
+	} else if self.Candles != nil {
+		return getCandlesStream(session, self.Candles)
+	} else {
+		return getTransactionStream(session, self.Transactions)
+	}
+}
+
+func batchAction(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return errors.New("batch requires exactly one job spec file")
+	}
+
+	spec, err := GetBatchSpec(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	session, err := NewSession(c.String("config"))
+	if err != nil {
+		return err
+	}
+	cancel := session.SetDeadline(c.Timestamp("deadline"))
+	defer cancel()
+	defer session.CancelOnSignal()()
+	if err := session.OpenOutput(c); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	err = runBatch(session, spec)
+
+	return err
+}
+
+// runBatch starts every job concurrently and stops all of them as soon as one
+// of them fails.
+func runBatch(session *Session, spec *BatchSpec) error {
+	tasks := []func(context.Context) error{}
+	for _, job := range spec.Jobs {
+		job := job
+		tasks = append(tasks, func(ctx context.Context) error {
+			err := job.Run(session.Tagged(job.Name).WithContext(ctx))
+			if err != nil {
+				err = fmt.Errorf("job %s: %w", job.Name, err)
+			}
+			return err
+		})
+	}
+
+	return runConcurrently(session.Context, tasks)
+}
+
+// runConcurrently runs every task in its own goroutine with a context derived
+// from ctx. The first error cancels the context of the other tasks, so that
+// they stop too. It returns once all tasks have returned, so that the caller
+// may close the outputs they share, with the first error, if any.
+func runConcurrently(ctx context.Context, tasks []func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task func(context.Context) error) {
+			defer wg.Done()
+			if err := task(ctx); err != nil {
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(task)
+	}
+	wg.Wait()
+
+	return first
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunConcurrentlyCancelsAndWaits(t *testing.T) {
+	failure := errors.New("job failed")
+	var stopped int32
+	blocking := func(ctx context.Context) error {
+		<-ctx.Done()
+		// Finishing late shows that runConcurrently waits for the task.
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&stopped, 1)
+		return ctx.Err()
+	}
+	failing := func(ctx context.Context) error {
+		return failure
+	}
+
+	err := runConcurrently(context.Background(), []func(context.Context) error{blocking, failing, blocking})
+	if err != failure {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+	if n := atomic.LoadInt32(&stopped); n != 2 {
+		t.Errorf("%d of 2 tasks stopped before return", n)
+	}
+}
+
+func TestRunConcurrentlySucceeds(t *testing.T) {
+	var ran int32
+	task := func(ctx context.Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}
+	if err := runConcurrently(context.Background(), []func(context.Context) error{task, task, task}); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 3 {
+		t.Errorf("ran %d of 3 tasks", ran)
+	}
+}
+
+func TestRunConcurrentlyParentCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	task := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := runConcurrently(ctx, []func(context.Context) error{task, task}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestGetBatchSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{"valid", "jobs:\n  - candles:\n      instrument: EUR_USD\n      price: BA\n      volume_type: float\n", ""},
+		{"no jobs", "jobs: []\n", "batch spec has no jobs"},
+		{"two commands", "jobs:\n  - name: both\n    pricing: {instruments: EUR_USD}\n    candles: {instrument: EUR_USD}\n", "job both: exactly one of"},
+		{"invalid price", "jobs:\n  - candles:\n      instrument: EUR_USD\n      price: X\n", "job job0: "},
+		{"invalid volume type", "jobs:\n  - candles:\n      instrument: EUR_USD\n      volume_type: double\n", `job job0: unknown volume type "double"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "batch.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.spec), 0600); err != nil {
+				t.Fatal(err)
+			}
+			spec, err := GetBatchSpec(path)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if candles := spec.Jobs[0].Candles; candles.Price != "BA" || candles.Granularity != defaultGranularity {
+					t.Errorf("got candles options %+v", candles)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// BenchmarkResult is the throughput of the output path measured by benchmark.
+type BenchmarkResult struct {
+	Kind        string  `json:"kind"`
+	Messages    int     `json:"messages"`
+	Lines       int64   `json:"lines"`
+	Bytes       int64   `json:"bytes"`
+	Seconds     float64 `json:"seconds"`
+	LinesPerSec float64 `json:"lines_per_sec"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+// CountingWriter counts the lines and bytes written through it.
+type CountingWriter struct {
+	Writer io.Writer
+	Lines  int64
+	Bytes  int64
+}
+
+func (self *CountingWriter) Write(p []byte) (int, error) {
+	n, err := self.Writer.Write(p)
+	self.Lines++
+	self.Bytes += int64(n)
+	return n, err
+}
+
+// benchmarkAction writes synthetic messages as fast as possible through the
+// same output path as the streaming commands, and reports the throughput on
+// stderr. It needs no credentials.
+func benchmarkAction(c *cli.Context) (err error) {
+	kind := c.String("kind")
+	if kind != "price" && kind != "candle" {
+		return fmt.Errorf("unknown kind %q, expected price or candle", kind)
+	}
+
+	session := &Session{
+		Context: context.Background(),
+		Client:  new(http.Client),
+		Output:  &Output{Writer: &LockedWriter{Writer: os.Stdout}},
+	}
+	defer session.CancelOnSignal()()
+	ctx, cancel := context.WithTimeout(session.Context, c.Duration("duration"))
+	defer cancel()
+	session.Context = ctx
+	if err := session.OpenOutput(c); err != nil {
+		return err
+	}
+
+	counter := &CountingWriter{Writer: session.Output.Writer}
+	session.Output.Writer = counter
+
+	start := time.Now()
+	messages, err := runBenchmark(session, kind, c.Int("batch-size"))
+
+	// Close through the real writer so that its Flush and Close are called,
+	// and count the time they take.
+	session.Output.Writer = counter.Writer
+	if closeErr := session.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Seconds()
+
+	result := BenchmarkResult{
+		Kind:        kind,
+		Messages:    messages,
+		Lines:       counter.Lines,
+		Bytes:       counter.Bytes,
+		Seconds:     elapsed,
+		LinesPerSec: float64(counter.Lines) / elapsed,
+		BytesPerSec: float64(counter.Bytes) / elapsed,
+	}
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, string(bytes))
+
+	return nil
+}
+
+// runBenchmark emits synthetic messages until the session context is done,
+// and returns how many it emitted.
+func runBenchmark(session *Session, kind string, batchSize int) (messages int, err error) {
+	writer := CandleWriter{Output: session.Output, BatchSize: batchSize}
+	defer func() {
+		if flushErr := writer.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
+
+	now := time.Now().UTC()
+	for ; session.Context.Err() == nil; messages++ {
+		t := now.Add(time.Duration(messages) * 5 * time.Second)
+		price := fmt.Sprintf("1.%05d", 10000+messages%1000)
+
+		if kind == "price" {
+			line := fmt.Sprintf(`{"type":"PRICE","time":"%s","bids":[{"price":"%s","liquidity":1000000}],"asks":[{"price":"%s","liquidity":1000000}],"closeoutBid":"%s","closeoutAsk":"%s","status":"tradeable","tradeable":true,"instrument":"EUR_USD"}`, t.Format(time.RFC3339Nano), price, price, price, price)
+			err = session.Output.Emit(line)
+		} else {
+			data := &CandlestickData{O: price, H: price, L: price, C: price}
+			err = writer.Write(Candlestick{Complete: true, Volume: messages % 100, Time: t, Mid: data, Bid: data, Ask: data})
+		}
+		if err != nil {
+			return messages, err
+		}
+	}
+
+	return messages, nil
+}
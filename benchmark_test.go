@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRunBenchmark(t *testing.T) {
+	tests := []struct {
+		kind      string
+		batchSize int
+	}{
+		{"price", 0},
+		{"candle", 0},
+		{"candle", 10},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s batch %d", test.kind, test.batchSize), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			output := &bytes.Buffer{}
+			counter := &CountingWriter{Writer: output}
+			session := &Session{Context: ctx, Output: &Output{Writer: counter}}
+
+			messages, err := runBenchmark(session, test.kind, test.batchSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messages == 0 {
+				t.Fatal("no messages were written")
+			}
+
+			lines := outputLines(output)
+			want := messages
+			if test.batchSize > 1 {
+				want = (messages + test.batchSize - 1) / test.batchSize
+			}
+			if len(lines) != want || counter.Lines != int64(want) || counter.Bytes != int64(output.Len()) {
+				t.Errorf("%d messages written as %d lines, counted %d lines and %d bytes", messages, len(lines), counter.Lines, counter.Bytes)
+			}
+			for _, line := range lines {
+				if !json.Valid([]byte(line)) {
+					t.Fatalf("invalid line %s", line)
+				}
+			}
+		})
+	}
+}
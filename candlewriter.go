@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+// floatVolumePattern matches an integer volume, which encoding/json writes
+// without a decimal point even for a float.
+var floatVolumePattern = regexp.MustCompile(`"volume":(-?[0-9]+)\b`)
+
+// CandleWriter emits candles one per line, or, when BatchSize is above 1, as
+// JSON arrays of BatchSize candles per line. When Instrument is set, it is
+// added to every candle so that several series can share one output.
+type CandleWriter struct {
+	Output     *Output
+	BatchSize  int
+	Instrument string
+	// Granularity, when set, is added to every candle like Instrument.
+	Granularity string
+	// Delta writes an update of the previously written candle as its time and
+	// the fields which changed only.
+	Delta       bool
+	WithTypical bool
+	// FloatVolume writes the volume as a float, e.g. 12.0 rather than 12.
+	FloatVolume bool
+	SMA         *MovingAverage
+	VWAP        *VWAP
+	TradingDate *TradingDate
+	previous    *Candlestick
+	last        *Candlestick
+	batch       []json.RawMessage
+}
+
+func (self *CandleWriter) Write(candle Candlestick) error {
+	var message interface{} = candle
+	if self.Delta && self.previous != nil && self.previous.Time.Equal(candle.Time) {
+		message = candleDelta(&candle, self.previous)
+	}
+
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	line := string(bytes)
+	if self.FloatVolume {
+		line = floatVolumePattern.ReplaceAllString(line, `"volume":$1.0`)
+	}
+	if self.WithTypical {
+		if typical, ok := candle.Typical(); ok {
+			line = injectField(line, "typical", typical)
+		}
+	}
+	if self.SMA != nil {
+		line = injectField(line, "sma", self.SMA.Next(&candle))
+	}
+	if self.VWAP != nil {
+		line = injectField(line, "vwap", self.VWAP.Next(&candle))
+	}
+	if self.TradingDate != nil {
+		line = injectField(line, "trading_date", self.TradingDate.Label(candle.Time))
+	}
+	if self.Granularity != "" {
+		line = injectField(line, "granularity", self.Granularity)
+	}
+	if self.Instrument != "" {
+		line = injectField(line, "instrument", self.Instrument)
+	}
+
+	// Every candle is filtered, validated and counted by --max-lines on its
+	// own, only the writing is batched.
+	line, ok, err := self.Output.Prepare(line)
+	if err != nil || !ok {
+		return err
+	}
+	// A delta, and --drop-incomplete-on-exit, refer to the last candle
+	// actually written, not to one which was filtered out.
+	self.last = &candle
+	if self.Delta {
+		self.previous = &candle
+	}
+
+	if self.BatchSize <= 1 || self.Output.Counts != nil {
+		return self.Output.Deliver(line)
+	}
+
+	self.batch = append(self.batch, json.RawMessage(line))
+	if len(self.batch) >= self.BatchSize {
+		return self.Flush()
+	}
+	return nil
+}
+
+// Flush emits the pending partial batch, if any.
+func (self *CandleWriter) Flush() error {
+	if len(self.batch) == 0 {
+		return nil
+	}
+
+	bytes, err := json.Marshal(self.batch)
+	if err != nil {
+		return err
+	}
+	self.batch = nil
+	return self.Output.Println(string(bytes))
+}
+
+// candleDelta holds the time of candle and the fields which differ from
+// previous, an earlier update of the same candle.
+func candleDelta(candle *Candlestick, previous *Candlestick) map[string]interface{} {
+	delta := map[string]interface{}{"time": candle.Time}
+	if candle.Complete != previous.Complete {
+		delta["complete"] = candle.Complete
+	}
+	if candle.Volume != previous.Volume {
+		delta["volume"] = candle.Volume
+	}
+	for key, data := range map[string][2]*CandlestickData{
+		"mid": {candle.Mid, previous.Mid},
+		"bid": {candle.Bid, previous.Bid},
+		"ask": {candle.Ask, previous.Ask},
+	} {
+		if changed := data[0].changedFrom(data[1]); len(changed) != 0 {
+			delta[key] = changed
+		}
+	}
+	return delta
+}
+
+// changedFrom lists the prices which differ from previous.
+func (self *CandlestickData) changedFrom(previous *CandlestickData) map[string]string {
+	changed := map[string]string{}
+	if self == nil {
+		return changed
+	}
+	if previous == nil {
+		previous = &CandlestickData{}
+	}
+	for key, prices := range map[string][2]string{
+		"o": {self.O, previous.O},
+		"h": {self.H, previous.H},
+		"l": {self.L, previous.L},
+		"c": {self.C, previous.C},
+	} {
+		if prices[0] != prices[1] {
+			changed[key] = prices[0]
+		}
+	}
+	return changed
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCandleWriterBatchPerCandle(t *testing.T) {
+	filter, err := ParseFilterExpr("volume > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := CandleWriter{
+		Output:    &Output{Writer: output, Filter: filter, Validate: true, Limit: &LineLimit{Max: 3, cancel: cancel}},
+		BatchSize: 2,
+	}
+
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		// The second candle, without volume, is filtered out, and of the
+		// other five --max-lines lets three through.
+		candle := Candlestick{Complete: true, Volume: i + 1, Time: start.Add(time.Duration(i) * time.Minute)}
+		if i == 1 {
+			candle.Volume = 0
+		}
+		if err := writer.Write(candle); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []int{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var batch []Candlestick
+		if err := json.Unmarshal([]byte(line), &batch); err != nil {
+			t.Fatal(err)
+		}
+		for _, candle := range batch {
+			if candle.Volume == 0 {
+				t.Errorf("candle %s was not filtered", candle.Time)
+			}
+		}
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Errorf("got batches of %v candles, want [2 1]", sizes)
+	}
+}
+
+func TestCandleDelta(t *testing.T) {
+	previous := minuteCandle(0, 5, false)
+	tests := []struct {
+		name   string
+		update func(candle *Candlestick)
+		want   string
+	}{
+		{"unchanged", func(candle *Candlestick) {}, `{"time":"2021-03-01T00:00:00Z"}`},
+		{"volume", func(candle *Candlestick) { candle.Volume = 6 }, `{"time":"2021-03-01T00:00:00Z","volume":6}`},
+		{"close and high", func(candle *Candlestick) {
+			candle.Mid = &CandlestickData{O: "1.1", H: "1.3", L: "1.0", C: "1.3"}
+		}, `{"mid":{"c":"1.3","h":"1.3"},"time":"2021-03-01T00:00:00Z"}`},
+		{"completed", func(candle *Candlestick) { candle.Complete = true }, `{"complete":true,"time":"2021-03-01T00:00:00Z"}`},
+		{"new component", func(candle *Candlestick) {
+			candle.Bid = &CandlestickData{O: "1.0", H: "1.0", L: "1.0", C: "1.0"}
+		}, `{"bid":{"c":"1.0","h":"1.0","l":"1.0","o":"1.0"},"time":"2021-03-01T00:00:00Z"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candle := minuteCandle(0, 5, false)
+			test.update(&candle)
+			bytes, err := json.Marshal(candleDelta(&candle, &previous))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bytes) != test.want {
+				t.Errorf("got %s, want %s", bytes, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+)
+
+// coalesceIgnoredFields are the fields which differ between otherwise
+// identical transactions.
+var coalesceIgnoredFields = []string{"id", "time", "batchID", "requestID"}
+
+// TransactionCoalescer recognizes a transaction identical to the one before it
+// except for its identifiers, by hashing all other fields.
+type TransactionCoalescer struct {
+	last []byte
+}
+
+func (self *TransactionCoalescer) Duplicate(line []byte) (bool, error) {
+	var transaction map[string]interface{}
+	if err := json.Unmarshal(line, &transaction); err != nil {
+		return false, err
+	}
+	for _, field := range coalesceIgnoredFields {
+		delete(transaction, field)
+	}
+
+	// Marshalling a map sorts its keys, so equal transactions hash equally.
+	bytes, err := json.Marshal(transaction)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(bytes)
+
+	duplicate := self.last != nil && string(self.last) == string(sum[:])
+	self.last = sum[:]
+	return duplicate, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTransactionCoalescer(t *testing.T) {
+	coalescer := TransactionCoalescer{}
+	tests := []struct {
+		line      string
+		duplicate bool
+	}{
+		{`{"id":"1","time":"t1","batchID":"1","type":"ORDER_FILL","units":"100"}`, false},
+		// Only the identifiers differ.
+		{`{"id":"2","time":"t2","batchID":"2","requestID":"9","type":"ORDER_FILL","units":"100"}`, true},
+		// The field order does not matter.
+		{`{"units":"100","type":"ORDER_FILL","id":"3"}`, true},
+		{`{"id":"4","type":"ORDER_FILL","units":"200"}`, false},
+		// Only the previous transaction counts.
+		{`{"id":"5","type":"ORDER_FILL","units":"100"}`, false},
+	}
+	for i, test := range tests {
+		duplicate, err := coalescer.Duplicate([]byte(test.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duplicate != test.duplicate {
+			t.Errorf("transaction %d: got duplicate %v, want %v", i, duplicate, test.duplicate)
+		}
+	}
+
+	got := transactionLines(t, TransactionsOptions{Coalesce: true}, tests[0].line, tests[1].line, tests[3].line)
+	if want := []string{tests[0].line, tests[3].line}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
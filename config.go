@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ResolvedConfig is the configuration a command would run with, after the
+// credentials file, the profile and the environment have been applied.
+type ResolvedConfig struct {
+	ConfigPath   string            `json:"config_path"`
+	Profile      string            `json:"profile"`
+	AccountId    string            `json:"account_id"`
+	Token        string            `json:"token"`
+	Environment  string            `json:"environment"`
+	ApiUrl       string            `json:"api_url"`
+	StreamUrl    string            `json:"stream_url"`
+	DefaultPrice string            `json:"default_price"`
+	Overrides    []string          `json:"env_overrides"`
+	Headers      []string          `json:"headers"`
+	Defaults     map[string]string `json:"defaults"`
+}
+
+// configShowAction prints the resolved configuration without any request to OANDA.
+func configShowAction(c *cli.Context) error {
+	configPath := c.String("config")
+	profile := c.String("profile")
+
+	credentials, err := GetCredentials(configPath, profile)
+	if err != nil {
+		return err
+	}
+	if accountIdOverride != "" {
+		credentials.Default.AccountId = accountIdOverride
+	}
+
+	bytes, err := json.Marshal(NewResolvedConfig(configPath, profile, &credentials.Default))
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+
+	return nil
+}
+
+// NewResolvedConfig describes the configuration of account, read from the
+// profile of the credentials file at configPath. The token and the account
+// id are redacted.
+func NewResolvedConfig(configPath string, profile string, account *Account) ResolvedConfig {
+	config := ResolvedConfig{
+		ConfigPath:   configPath,
+		Profile:      profile,
+		AccountId:    redact(account.AccountId),
+		Token:        redact(account.Token),
+		Environment:  account.Environment,
+		ApiUrl:       account.ApiUrl(),
+		StreamUrl:    account.StreamUrl(),
+		DefaultPrice: ResolvePrice("", account),
+		Overrides:    []string{},
+		Headers:      []string{},
+		Defaults: map[string]string{
+			"granularity":                    defaultGranularity,
+			"polling_interval":               defaultPollingInterval.String(),
+			"pricing_heartbeat_timeout":      defaultPricingHeartbeatTimeout.String(),
+			"transactions_heartbeat_timeout": defaultTransactionsHeartbeatTimeout.String(),
+			"max_retries":                    fmt.Sprint(defaultMaxRetries),
+			"max_line_bytes":                 fmt.Sprint(defaultMaxLineBytes),
+		},
+	}
+	if config.Environment == "" {
+		config.Environment = "practice"
+	}
+	for _, name := range []string{"OANDA_TOKEN", "OANDA_ACCOUNT_ID", "OANDA_ENV", "OANDA_CREDENTIALS_PATH"} {
+		if os.Getenv(name) != "" {
+			config.Overrides = append(config.Overrides, name)
+		}
+	}
+	// Header values may be secrets as well, so only their names are shown.
+	for key := range requestHeaders {
+		config.Headers = append(config.Headers, key)
+	}
+	sort.Strings(config.Headers)
+
+	return config
+}
+
+// redact keeps only the last four characters of a secret. An empty secret
+// stays empty, so that a missing value shows.
+func redact(secret string) string {
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return strings.Repeat("*", 8) + secret[len(secret)-4:]
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewResolvedConfigRedacts(t *testing.T) {
+	account := Account{AccountId: "101-001-1234567-001", Token: "0123456789abcdef-0123456789abcdef"}
+	config := NewResolvedConfig("credentials.yaml", defaultProfile, &account)
+
+	if config.AccountId != "********-001" {
+		t.Errorf("account id %q, want ********-001", config.AccountId)
+	}
+	if config.Token != "********cdef" {
+		t.Errorf("token %q, want ********cdef", config.Token)
+	}
+	if config.Environment != "practice" {
+		t.Errorf("environment %q, want practice", config.Environment)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		secret string
+		want   string
+	}{
+		{"", ""},
+		{"short", "*****"},
+		{"12345678", "********"},
+		{"123456789", "********6789"},
+	}
+	for _, test := range tests {
+		if got := redact(test.secret); got != test.want {
+			t.Errorf("redact(%q) = %q, want %q", test.secret, got, test.want)
+		}
+		if strings.Contains(test.secret, "1234") && strings.Contains(redact(test.secret), "1234") {
+			t.Errorf("redact(%q) shows the start of the secret", test.secret)
+		}
+	}
+}
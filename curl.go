@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	curlRedacted = "redacted"
+	curlUnsafe   = "unsafe"
+)
+
+// errPrintedCurl ends a command whose request was printed instead of sent.
+var errPrintedCurl = errors.New("request printed as curl command")
+
+// printCurl is --print-curl.
+var printCurl = &CurlMode{}
+
+// CurlMode is the value of --print-curl. It is a switch, which also takes
+// --print-curl=unsafe to print the token as is.
+type CurlMode struct {
+	Mode string
+}
+
+func (self *CurlMode) Set(value string) error {
+	switch value {
+	case "true", curlRedacted:
+		self.Mode = curlRedacted
+	case "false":
+		self.Mode = ""
+	case curlUnsafe:
+		self.Mode = curlUnsafe
+	default:
+		return fmt.Errorf("invalid --print-curl %q, expected unsafe or no value", value)
+	}
+	return nil
+}
+
+func (self *CurlMode) String() string {
+	return self.Mode
+}
+
+// IsBoolFlag lets --print-curl be given without a value.
+func (self *CurlMode) IsBoolFlag() bool {
+	return true
+}
+
+// printingCurl reports whether requests are printed instead of sent. Requests
+// made only to prepare the one a command is about, such as lookups and
+// checks, are then skipped, so that the printed request is that one.
+func printingCurl() bool {
+	return printCurl.Mode != ""
+}
+
+// CurlCommand renders req as a curl command line, with the bearer token
+// replaced by $OANDA_TOKEN unless unsafe.
+func CurlCommand(req *http.Request, unsafe bool) string {
+	args := []string{"curl"}
+	if strings.HasSuffix(req.URL.Path, "/stream") {
+		args = append(args, "--no-buffer")
+	}
+	if req.Method != "GET" {
+		args = append(args, "-X", req.Method)
+	}
+
+	keys := []string{}
+	for key := range req.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range req.Header[key] {
+			if key == "Authorization" && !unsafe {
+				// Double quoted, so that the shell fills in the token.
+				args = append(args, "-H", `"Authorization: Bearer $OANDA_TOKEN"`)
+				continue
+			}
+			args = append(args, "-H", shellQuote(key+": "+value))
+		}
+	}
+
+	args = append(args, shellQuote(req.URL.String()))
+	return strings.Join(args, " ")
+}
+
+// shellQuote single quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Do sends req, or prints it and fails with errPrintedCurl under --print-curl.
+func (self *Session) Do(req *http.Request) (*http.Response, error) {
+	if printingCurl() {
+		fmt.Println(CurlCommand(req, printCurl.Mode == curlUnsafe))
+		return nil, errPrintedCurl
+	}
+	return self.Client.Do(req)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestCurlCommand(t *testing.T) {
+	session := &Session{
+		Credentials: &Credentials{Default: Account{AccountId: "101-001-0000000-001", Token: "secret-token"}},
+		Headers:     http.Header{"X-Note": []string{"it's me"}},
+	}
+	tests := []struct {
+		name   string
+		url    string
+		method string
+		unsafe bool
+		want   string
+	}{
+		{
+			"redacted",
+			"https://api-fxpractice.oanda.com/v3/accounts/101-001-0000000-001/summary",
+			"GET", false,
+			`curl -H "Authorization: Bearer $OANDA_TOKEN" -H 'Content-Type: application/json' -H 'X-Note: it'\''s me' 'https://api-fxpractice.oanda.com/v3/accounts/101-001-0000000-001/summary'`,
+		},
+		{
+			"unsafe",
+			"https://api-fxpractice.oanda.com/v3/accounts",
+			"GET", true,
+			`curl -H 'Authorization: Bearer secret-token' -H 'Content-Type: application/json' -H 'X-Note: it'\''s me' 'https://api-fxpractice.oanda.com/v3/accounts'`,
+		},
+		{
+			"stream",
+			"https://stream-fxpractice.oanda.com/v3/accounts/101-001-0000000-001/pricing/stream?instruments=EUR_USD,USD_JPY",
+			"GET", false,
+			`curl --no-buffer -H "Authorization: Bearer $OANDA_TOKEN" -H 'Content-Type: application/json' -H 'X-Note: it'\''s me' 'https://stream-fxpractice.oanda.com/v3/accounts/101-001-0000000-001/pricing/stream?instruments=EUR_USD,USD_JPY'`,
+		},
+		{
+			"method",
+			"https://api-fxpractice.oanda.com/v3/accounts/101-001-0000000-001/configuration",
+			"PATCH", false,
+			`curl -X PATCH -H "Authorization: Bearer $OANDA_TOKEN" -H 'Content-Type: application/json' -H 'X-Note: it'\''s me' 'https://api-fxpractice.oanda.com/v3/accounts/101-001-0000000-001/configuration'`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := session.NewRequest(context.Background(), test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Method = test.method
+			if got := CurlCommand(req, test.unsafe); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCurlModeSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"true", curlRedacted, false},
+		{"redacted", curlRedacted, false},
+		{"unsafe", curlUnsafe, false},
+		{"false", "", false},
+		{"plain", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			mode := &CurlMode{}
+			if err := mode.Set(test.value); (err != nil) != test.err {
+				t.Fatalf("got error %v, want an error: %v", err, test.err)
+			}
+			if mode.Mode != test.want {
+				t.Errorf("got %q, want %q", mode.Mode, test.want)
+			}
+		})
+	}
+}
+
+func TestSessionDoPrintsCurl(t *testing.T) {
+	defer func(previous string) { printCurl.Mode = previous }(printCurl.Mode)
+	printCurl.Mode = curlRedacted
+
+	sent := false
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = true
+	}))
+	if _, _, err := session.Get("https://api-fxpractice.oanda.com/v3/accounts"); err != errPrintedCurl {
+		t.Errorf("got %v, want %v", err, errPrintedCurl)
+	}
+	if sent {
+		t.Error("the request was sent")
+	}
+}
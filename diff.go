@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+)
+
+// diffPageSize is how many transaction ids are requested at once.
+const diffPageSize = 1000
+
+type TransactionsIdRangeResponseBody struct {
+	Transactions []json.RawMessage `json:"transactions"`
+}
+
+// DiffTransaction holds the fields of a transaction which change the account.
+type DiffTransaction struct {
+	Id             string `json:"id"`
+	Type           string `json:"type"`
+	Instrument     string `json:"instrument"`
+	Units          string `json:"units"`
+	PL             string `json:"pl"`
+	Financing      string `json:"financing"`
+	AccountBalance string `json:"accountBalance"`
+	TradeOpened    *struct {
+		TradeId string `json:"tradeID"`
+	} `json:"tradeOpened"`
+	TradesClosed []struct {
+		TradeId string `json:"tradeID"`
+	} `json:"tradesClosed"`
+	TradeReduced *struct {
+		TradeId string `json:"tradeID"`
+	} `json:"tradeReduced"`
+}
+
+// AccountDiff is what changed on the account between two transactions.
+// Balances are those after the transactions, null when the transaction does
+// not state one.
+type AccountDiff struct {
+	FromId        string             `json:"from_id"`
+	ToId          string             `json:"to_id"`
+	Transactions  int                `json:"transactions"`
+	BalanceFrom   *string            `json:"balance_from"`
+	BalanceTo     *string            `json:"balance_to"`
+	RealizedPL    float64            `json:"realized_pl"`
+	Financing     float64            `json:"financing"`
+	TradesOpened  []string           `json:"trades_opened"`
+	TradesClosed  []string           `json:"trades_closed"`
+	TradesReduced []string           `json:"trades_reduced"`
+	Positions     map[string]float64 `json:"position_units"`
+}
+
+func accountDiffAction(c *cli.Context) error {
+	fromId := c.Int("from-id")
+	toId := c.Int("to-id")
+	if fromId <= 0 || toId <= fromId {
+		return errors.New("--to-id must be greater than --from-id")
+	}
+
+	session, err := NewProfileSession(c.String("config"), c.String("profile"))
+	if err != nil {
+		return err
+	}
+
+	transactions, err := getTransactionsByIdRange(session, fromId, toId)
+	if err != nil {
+		return err
+	}
+
+	diff, err := diffTransactions(strconv.Itoa(fromId), strconv.Itoa(toId), transactions)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	err = session.Output.Println(string(bytes))
+
+	return err
+}
+
+// getTransactionsByIdRange fetches the transactions from fromId to toId, both included.
+func getTransactionsByIdRange(session *Session, fromId int, toId int) ([]DiffTransaction, error) {
+	account := session.Credentials.Default
+	baseUrl := account.ApiUrl()
+
+	transactions := []DiffTransaction{}
+	for from := fromId; from <= toId; from += diffPageSize {
+		to := minInt(from+diffPageSize-1, toId)
+		url := fmt.Sprintf("%s/v3/accounts/%s/transactions/idrange?from=%d&to=%d", baseUrl, account.AccountId, from, to)
+
+		bytes, _, err := session.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		var body TransactionsIdRangeResponseBody
+		if err := json.Unmarshal(bytes, &body); err != nil {
+			return nil, err
+		}
+
+		for _, raw := range body.Transactions {
+			var transaction DiffTransaction
+			if err := json.Unmarshal(raw, &transaction); err != nil {
+				return nil, err
+			}
+			transactions = append(transactions, transaction)
+		}
+	}
+	return transactions, nil
+}
+
+// diffTransactions sums up the transactions after fromId up to toId. The
+// transaction fromId itself only provides the starting balance.
+func diffTransactions(fromId string, toId string, transactions []DiffTransaction) (*AccountDiff, error) {
+	diff := AccountDiff{
+		FromId:        fromId,
+		ToId:          toId,
+		TradesOpened:  []string{},
+		TradesClosed:  []string{},
+		TradesReduced: []string{},
+		Positions:     map[string]float64{},
+	}
+
+	for i := range transactions {
+		transaction := &transactions[i]
+		if transaction.Id == fromId {
+			if transaction.AccountBalance != "" {
+				diff.BalanceFrom = &transaction.AccountBalance
+			}
+			continue
+		}
+		diff.Transactions++
+
+		if transaction.AccountBalance != "" {
+			diff.BalanceTo = &transaction.AccountBalance
+		}
+		for _, field := range []struct {
+			value string
+			sum   *float64
+		}{
+			{transaction.PL, &diff.RealizedPL},
+			{transaction.Financing, &diff.Financing},
+		} {
+			if field.value == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(field.value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("transaction %s: invalid amount %q", transaction.Id, field.value)
+			}
+			*field.sum += value
+		}
+
+		if transaction.Type != "ORDER_FILL" {
+			continue
+		}
+		if transaction.TradeOpened != nil {
+			diff.TradesOpened = append(diff.TradesOpened, transaction.TradeOpened.TradeId)
+		}
+		for _, closed := range transaction.TradesClosed {
+			diff.TradesClosed = append(diff.TradesClosed, closed.TradeId)
+		}
+		if transaction.TradeReduced != nil {
+			diff.TradesReduced = append(diff.TradesReduced, transaction.TradeReduced.TradeId)
+		}
+		units, err := strconv.ParseFloat(transaction.Units, 64)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %s: invalid units %q", transaction.Id, transaction.Units)
+		}
+		diff.Positions[transaction.Instrument] += units
+	}
+
+	for instrument, units := range diff.Positions {
+		if units == 0 {
+			delete(diff.Positions, instrument)
+		}
+	}
+
+	return &diff, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAccountDiff(t *testing.T) {
+	tests := []struct {
+		name         string
+		transactions []string
+		want         string
+		err          string
+	}{
+		{
+			"fills",
+			[]string{
+				`{"id":"10","type":"ORDER_FILL","instrument":"EUR_USD","units":"100","accountBalance":"1000.0","tradeOpened":{"tradeID":"10"}}`,
+				`{"id":"11","type":"ORDER_FILL","instrument":"USD_JPY","units":"-50","pl":"0","financing":"0","accountBalance":"1000.0","tradeOpened":{"tradeID":"11"}}`,
+				`{"id":"12","type":"DAILY_FINANCING","financing":"-0.25","accountBalance":"999.75"}`,
+				`{"id":"13","type":"ORDER_FILL","instrument":"EUR_USD","units":"-100","pl":"1.5","financing":"-0.1","accountBalance":"1001.15","tradesClosed":[{"tradeID":"10"}]}`,
+				`{"id":"14","type":"ORDER_FILL","instrument":"USD_JPY","units":"20","pl":"-0.5","accountBalance":"1000.65","tradeReduced":{"tradeID":"11"}}`,
+			},
+			`{"from_id":"10","to_id":"14","transactions":4,"balance_from":"1000.0","balance_to":"1000.65","realized_pl":1,"financing":-0.35,"trades_opened":["11"],"trades_closed":["10"],"trades_reduced":["11"],"position_units":{"EUR_USD":-100,"USD_JPY":-30}}`,
+			"",
+		},
+		{
+			"no balances",
+			[]string{`{"id":"11","type":"CLIENT_CONFIGURE"}`},
+			`{"from_id":"10","to_id":"14","transactions":1,"balance_from":null,"balance_to":null,"realized_pl":0,"financing":0,"trades_opened":[],"trades_closed":[],"trades_reduced":[],"position_units":{}}`,
+			"",
+		},
+		{
+			"invalid amount",
+			[]string{`{"id":"11","type":"ORDER_FILL","units":"1","pl":"n/a"}`},
+			"",
+			`transaction 11: invalid amount "n/a"`,
+		},
+		{
+			"invalid units",
+			[]string{`{"id":"11","type":"ORDER_FILL","units":""}`},
+			"",
+			`transaction 11: invalid units ""`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"transactions":[%s]}`, strings.Join(test.transactions, ","))
+			}))
+			transactions, err := getTransactionsByIdRange(session, 10, 14)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			diff, err := diffTransactions("10", "14", transactions)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			bytes, err := json.Marshal(diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want map[string]interface{}
+			json.Unmarshal(bytes, &got)
+			json.Unmarshal([]byte(test.want), &want)
+			// The sums are floats, compared to the cent.
+			for _, field := range []string{"realized_pl", "financing"} {
+				if !approx(got[field].(float64), want[field].(float64)) {
+					t.Errorf("%s is %v, want %v", field, got[field], want[field])
+				}
+				delete(got, field)
+				delete(want, field)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s, want %s", bytes, test.want)
+			}
+		})
+	}
+}
+
+func TestGetTransactionsByIdRangePages(t *testing.T) {
+	ranges := []string{}
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.URL.Query().Get("from")+"-"+r.URL.Query().Get("to"))
+		fmt.Fprintf(w, `{"transactions":[{"id":%q}]}`, r.URL.Query().Get("from"))
+	}))
+	transactions, err := getTransactionsByIdRange(session, 1, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1-1000", "1001-2000", "2001-2500"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("requested %v, want %v", ranges, want)
+	}
+	if len(transactions) != 3 || transactions[2].Id != "2001" {
+		t.Errorf("got %+v", transactions)
+	}
+}
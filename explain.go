@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// ExplainField maps a (dotted) path in a transaction to a flat output key.
+type ExplainField struct {
+	Path string
+	Key  string
+}
+
+// explainFields lists the relevant fields of the transaction types --explain knows about.
+var explainFields = map[string][]ExplainField{
+	"ORDER_FILL": {
+		{"id", "id"},
+		{"time", "time"},
+		{"type", "type"},
+		{"orderID", "orderID"},
+		{"instrument", "instrument"},
+		{"units", "units"},
+		{"price", "price"},
+		{"pl", "pl"},
+		{"financing", "financing"},
+		{"commission", "commission"},
+		{"accountBalance", "accountBalance"},
+		{"reason", "reason"},
+		{"tradeOpened.tradeID", "tradeOpenedID"},
+	},
+	"MARKET_ORDER": {
+		{"id", "id"},
+		{"time", "time"},
+		{"type", "type"},
+		{"instrument", "instrument"},
+		{"units", "units"},
+		{"timeInForce", "timeInForce"},
+		{"positionFill", "positionFill"},
+		{"reason", "reason"},
+		{"stopLossOnFill.price", "stopLossPrice"},
+		{"takeProfitOnFill.price", "takeProfitPrice"},
+	},
+	"STOP_LOSS_ORDER": {
+		{"id", "id"},
+		{"time", "time"},
+		{"type", "type"},
+		{"tradeID", "tradeID"},
+		{"price", "price"},
+		{"distance", "distance"},
+		{"timeInForce", "timeInForce"},
+		{"gtdTime", "gtdTime"},
+		{"triggerCondition", "triggerCondition"},
+		{"reason", "reason"},
+	},
+}
+
+// explainTransaction flattens a known transaction type to its relevant fields.
+// Unknown types are returned unchanged.
+func explainTransaction(line []byte) ([]byte, error) {
+	var transaction map[string]interface{}
+	if err := json.Unmarshal(line, &transaction); err != nil {
+		return nil, err
+	}
+
+	transactionType, _ := transaction["type"].(string)
+	fields, ok := explainFields[transactionType]
+	if !ok {
+		return line, nil
+	}
+
+	explained := map[string]interface{}{}
+	for _, field := range fields {
+		if value, ok := lookupPath(transaction, field.Path); ok {
+			explained[field.Key] = value
+		}
+	}
+
+	return json.Marshal(explained)
+}
+
+// lookupPath resolves a dotted path such as "tradeOpened.tradeID" in decoded JSON.
+// Numeric segments index into arrays.
+func lookupPath(value interface{}, path string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			value = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExplainTransaction(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			"order fill",
+			`{"id":"7","time":"2021-03-01T00:00:00Z","type":"ORDER_FILL","orderID":"6","instrument":"EUR_USD","units":"100","price":"1.1","pl":"0.0","accountBalance":"1000","reason":"MARKET_ORDER","tradeOpened":{"tradeID":"7","units":"100"},"fullPrice":{"bids":[]}}`,
+			`{"accountBalance":"1000","id":"7","instrument":"EUR_USD","orderID":"6","pl":"0.0","price":"1.1","reason":"MARKET_ORDER","time":"2021-03-01T00:00:00Z","tradeOpenedID":"7","type":"ORDER_FILL","units":"100"}`,
+		},
+		{
+			"market order",
+			`{"id":"6","time":"2021-03-01T00:00:00Z","type":"MARKET_ORDER","instrument":"EUR_USD","units":"100","timeInForce":"FOK","positionFill":"DEFAULT","reason":"CLIENT_ORDER","stopLossOnFill":{"price":"1.0"},"accountID":"1"}`,
+			`{"id":"6","instrument":"EUR_USD","positionFill":"DEFAULT","reason":"CLIENT_ORDER","stopLossPrice":"1.0","time":"2021-03-01T00:00:00Z","timeInForce":"FOK","type":"MARKET_ORDER","units":"100"}`,
+		},
+		{
+			"stop loss order",
+			`{"id":"8","time":"2021-03-01T00:00:00Z","type":"STOP_LOSS_ORDER","tradeID":"7","price":"1.0","timeInForce":"GTC","triggerCondition":"DEFAULT","reason":"ON_FILL","batchID":"6"}`,
+			`{"id":"8","price":"1.0","reason":"ON_FILL","time":"2021-03-01T00:00:00Z","timeInForce":"GTC","tradeID":"7","triggerCondition":"DEFAULT","type":"STOP_LOSS_ORDER"}`,
+		},
+		{
+			"unknown type",
+			`{"id":"9","type":"DAILY_FINANCING","financing":"-0.01"}`,
+			`{"id":"9","type":"DAILY_FINANCING","financing":"-0.01"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := explainTransaction([]byte(test.line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	if _, err := explainTransaction([]byte("not json")); err == nil {
+		t.Error("a line which is not JSON was explained")
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(`{"a":{"b":[{"c":1},{"c":2}]},"d":"x"}`), &value); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"d", "x", true},
+		{"a.b.1.c", 2.0, true},
+		{"a.b.2.c", nil, false},
+		{"a.b.x", nil, false},
+		{"d.e", nil, false},
+		{"e", nil, false},
+	}
+	for _, test := range tests {
+		got, ok := lookupPath(value, test.path)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v %v, want %v %v", test.path, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// exportPageSize is the maximum number of candles OANDA returns per request.
+const exportPageSize = 5000
+
+type ExportOptions struct {
+	Instrument  string
+	Granularity string
+	From        time.Time
+	To          time.Time
+	// Descending writes the newest candle first. The pages arrive oldest
+	// first, so they are spooled until the last page.
+	Descending bool
+	// NoHeader leaves out the CSV header, for appending to a file which
+	// already has one.
+	NoHeader bool
+}
+
+// ParseOrderBy parses --order-by: time or time:asc for ascending, the order
+// the candles are fetched in, or time:desc.
+func ParseOrderBy(orderBy string) (descending bool, err error) {
+	switch orderBy {
+	case "time", "time:asc":
+		return false, nil
+	case "time:desc":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid order %q, expected time, time:asc or time:desc", orderBy)
+	}
+}
+
+func exportAction(c *cli.Context) error {
+	options := ExportOptions{
+		Instrument:  c.String("instrument"),
+		Granularity: c.String("granularity"),
+		From:        *c.Timestamp("from"),
+		To:          time.Now(),
+	}
+	if to := c.Timestamp("to"); to != nil {
+		options.To = *to
+	}
+	descending, err := ParseOrderBy(c.String("order-by"))
+	if err != nil {
+		return err
+	}
+	options.Descending = descending
+	if !options.From.Before(options.To) {
+		return fmt.Errorf("--from must be before --to")
+	}
+	if _, err := GranularityDuration(options.Granularity); err != nil {
+		return err
+	}
+
+	session, err := NewProfileSession(c.String("config"), c.String("profile"))
+	if err != nil {
+		return err
+	}
+	defer session.CancelOnSignal()()
+
+	out := c.String("out")
+	if out == "-" {
+		return exportCandles(session, &options, os.Stdout)
+	}
+
+	file, noHeader, err := openExportFile(out, c.Bool("append"))
+	if err != nil {
+		return err
+	}
+	options.NoHeader = noHeader
+	err = exportCandles(session, &options, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// openExportFile opens --out, truncated unless appending. Appending, a header
+// is written once, for a new or empty file, and noHeader reports whether the
+// file already has one.
+func openExportFile(path string, appending bool) (file *os.File, noHeader bool, err error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err = os.OpenFile(path, flags, 0666)
+	if err != nil || !appending {
+		return file, false, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	return file, info.Size() > 0, nil
+}
+
+// exportCandles pages through [From, To) and writes the candles as CSV,
+// reporting progress to stderr after each page. Memory stays bounded by one
+// page, also in descending order, for which the pages are spooled to disk.
+func exportCandles(session *Session, options *ExportOptions, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if !options.NoHeader {
+		if err := writer.Write(candleCsvHeader); err != nil {
+			return err
+		}
+	}
+
+	var spool *PageSpool
+	if options.Descending {
+		var err error
+		spool, err = NewPageSpool()
+		if err != nil {
+			return err
+		}
+		defer spool.Close()
+	}
+
+	from := options.From
+	includeFirst := true
+	exported := 0
+
+	for {
+		query := fmt.Sprintf("from=%s&granularity=%s&price=MBA&count=%d&includeFirst=%t", from.Format(time.RFC3339), options.Granularity, exportPageSize, includeFirst)
+		body, err := getCandles(session, options.Instrument, query)
+		if err != nil {
+			return err
+		}
+		candles := *body.Candles
+
+		done := len(candles) < exportPageSize
+		page := [][]string{}
+		for _, candle := range candles {
+			if !candle.Time.Before(options.To) {
+				done = true
+				break
+			}
+			exported++
+			if spool != nil {
+				page = append(page, candleCsvRecord(&candle))
+				continue
+			}
+			if err := writer.Write(candleCsvRecord(&candle)); err != nil {
+				return err
+			}
+		}
+
+		if spool != nil && len(page) != 0 {
+			if err := spool.Add(page); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+
+		if len(candles) != 0 {
+			from = candles[len(candles)-1].Time
+			fmt.Fprintf(os.Stderr, "exported %d candles up to %s\n", exported, from.Format(time.RFC3339))
+		}
+		if done || len(candles) == 0 {
+			if spool != nil {
+				return spool.WriteReversed(writer)
+			}
+			return nil
+		}
+		includeFirst = false
+	}
+}
+
+// PageSpool keeps pages of CSV records in temporary files. The pages arrive
+// oldest first and are each in ascending order, so reading them back last
+// page first and each page backwards yields the newest candle first.
+type PageSpool struct {
+	Dir   string
+	pages []string
+}
+
+func NewPageSpool() (*PageSpool, error) {
+	dir, err := ioutil.TempDir("", "oanda-export-")
+	if err != nil {
+		return nil, err
+	}
+	return &PageSpool{Dir: dir}, nil
+}
+
+func (self *PageSpool) Add(records [][]string) error {
+	path := filepath.Join(self.Dir, fmt.Sprintf("%06d.csv", len(self.pages)))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = csv.NewWriter(file).WriteAll(records)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	self.pages = append(self.pages, path)
+	return nil
+}
+
+// WriteReversed writes every spooled record in reverse order, one page in
+// memory at a time.
+func (self *PageSpool) WriteReversed(writer *csv.Writer) error {
+	for i := len(self.pages) - 1; i >= 0; i-- {
+		file, err := os.Open(self.pages[i])
+		if err != nil {
+			return err
+		}
+		records, err := csv.NewReader(file).ReadAll()
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		for j := len(records) - 1; j >= 0; j-- {
+			if err := writer.Write(records[j]); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close removes the spooled pages.
+func (self *PageSpool) Close() error {
+	return os.RemoveAll(self.Dir)
+}
+
+var candleCsvHeader = []string{
+	"time", "complete", "volume",
+	"mid_o", "mid_h", "mid_l", "mid_c",
+	"bid_o", "bid_h", "bid_l", "bid_c",
+	"ask_o", "ask_h", "ask_l", "ask_c",
+}
+
+func candleCsvRecord(candle *Candlestick) []string {
+	record := []string{
+		candle.Time.Format(time.RFC3339Nano),
+		strconv.FormatBool(candle.Complete),
+		strconv.Itoa(candle.Volume),
+	}
+	for _, data := range []*CandlestickData{candle.Mid, candle.Bid, candle.Ask} {
+		if data == nil {
+			record = append(record, "", "", "", "")
+		} else {
+			record = append(record, data.O, data.H, data.L, data.C)
+		}
+	}
+	return record
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// minuteCandles serves available M1 candles from start, one page of at most
+// count per request the way OANDA does, and records the queries it answered.
+func minuteCandles(t *testing.T, start time.Time, available int, queries *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		*queries = append(*queries, query.Get("from")+" "+query.Get("includeFirst"))
+		from, err := time.Parse(time.RFC3339, query.Get("from"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		count, err := strconv.Atoi(query.Get("count"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		first := int(from.Sub(start) / time.Minute)
+		if query.Get("includeFirst") == "false" {
+			first++
+		}
+		candles := []Candlestick{}
+		for i := first; i < available && len(candles) < count; i++ {
+			candle := testCandle("1.1", "1.0", "1.05", 1, true)
+			candle.Time = start.Add(time.Duration(i) * time.Minute)
+			candles = append(candles, *candle)
+		}
+		json.NewEncoder(w).Encode(CandlesResponseBody{Candles: &candles, Granularity: "M1", Instrument: "EUR_USD"})
+	})
+}
+
+func TestExportCandlesPagination(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		available  int
+		to         time.Time
+		descending bool
+		rows       int
+		requests   int
+	}{
+		{"stops at to", 7000, start.Add(6000 * time.Minute), false, 6000, 2},
+		{"short last page", 7000, start.Add(24 * 7 * time.Hour), false, 7000, 2},
+		{"full last page", 2 * exportPageSize, start.Add(24 * 7 * time.Hour), false, 2 * exportPageSize, 3},
+		{"within one page", 7000, start.Add(90 * time.Minute), false, 90, 1},
+		{"descending", 7000, start.Add(6000 * time.Minute), true, 6000, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queries := []string{}
+			session, _ := newTestSession(t, minuteCandles(t, start, test.available, &queries))
+			options := ExportOptions{Instrument: "EUR_USD", Granularity: "M1", From: start, To: test.to, Descending: test.descending}
+
+			output := &bytes.Buffer{}
+			if err := exportCandles(session, &options, output); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := csv.NewReader(output).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != test.rows+1 {
+				t.Fatalf("got %d rows, want %d", len(records)-1, test.rows)
+			}
+			if len(queries) != test.requests {
+				t.Errorf("got %d requests, want %d: %v", len(queries), test.requests, queries)
+			}
+			if want := start.Format(time.RFC3339) + " true"; queries[0] != want {
+				t.Errorf("first query is %q, want %q", queries[0], want)
+			}
+			for _, query := range queries[1:] {
+				if !strings.HasSuffix(query, " false") {
+					t.Errorf("later query %q includes its first candle", query)
+				}
+			}
+
+			// Every candle appears once, in order, with none at or after to.
+			for i, record := range records[1:] {
+				n := i
+				if test.descending {
+					n = test.rows - 1 - i
+				}
+				if want := start.Add(time.Duration(n) * time.Minute).Format(time.RFC3339Nano); record[0] != want {
+					t.Fatalf("row %d is at %s, want %s", i, record[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	tests := []struct {
+		orderBy    string
+		descending bool
+		err        bool
+	}{
+		{"time", false, false},
+		{"time:asc", false, false},
+		{"time:desc", true, false},
+		{"desc", false, true},
+		{"volume", false, true},
+		{"", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.orderBy, func(t *testing.T) {
+			descending, err := ParseOrderBy(test.orderBy)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want an error: %v", err, test.err)
+			}
+			if descending != test.descending {
+				t.Errorf("got descending %v, want %v", descending, test.descending)
+			}
+		})
+	}
+}
+
+func TestExportCandlesNoHeader(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	queries := []string{}
+	session, _ := newTestSession(t, minuteCandles(t, start, 10, &queries))
+	options := ExportOptions{Instrument: "EUR_USD", Granularity: "M1", From: start, To: start.Add(time.Hour), NoHeader: true}
+
+	output := &bytes.Buffer{}
+	if err := exportCandles(session, &options, output); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 10 || records[0][0] != start.Format(time.RFC3339Nano) {
+		t.Errorf("got %d rows starting with %v, want 10 candles and no header", len(records), records[0])
+	}
+}
+
+func TestExportAppendHeader(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// existing is the file before the export, nil for none, and
+		// exported whether a first export without --append wrote it.
+		existing []byte
+		exported bool
+		append   bool
+		rows     int
+	}{
+		{"fresh", nil, false, false, 5},
+		{"fresh appended", nil, false, true, 5},
+		{"overwritten", []byte("time,old\n"), false, false, 5},
+		{"appended", nil, true, true, 10},
+		{"appended to empty", []byte{}, false, true, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "candles.csv")
+			export := func(appending bool) {
+				file, noHeader, err := openExportFile(path, appending)
+				if err != nil {
+					t.Fatal(err)
+				}
+				queries := []string{}
+				session, _ := newTestSession(t, minuteCandles(t, start, 5, &queries))
+				options := ExportOptions{Instrument: "EUR_USD", Granularity: "M1", From: start, To: start.Add(time.Hour), NoHeader: noHeader}
+				if err := exportCandles(session, &options, file); err != nil {
+					t.Fatal(err)
+				}
+				if err := file.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.existing != nil {
+				if err := ioutil.WriteFile(path, test.existing, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.exported {
+				export(false)
+			}
+			export(test.append)
+
+			bytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(bytes)), "\n")
+			headers := 0
+			for _, line := range lines {
+				if strings.HasPrefix(line, candleCsvHeader[0]+",") {
+					headers++
+				}
+			}
+			if headers != 1 || lines[0] != strings.Join(candleCsvHeader, ",") || len(lines)-headers != test.rows {
+				t.Errorf("got %d headers and %d rows, want one header first and %d rows:\n%s", headers, len(lines)-headers, test.rows, bytes)
+			}
+		})
+	}
+}
+
+func TestExportCandlesBoundedMemory(t *testing.T) {
+	// The spool is created under the temporary directory, so that the test
+	// can watch it.
+	tmp := t.TempDir()
+	for _, name := range []string{"TMPDIR", "TMP", "TEMP"} {
+		previous, set := os.LookupEnv(name)
+		os.Setenv(name, tmp)
+		if set {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	available := 4*exportPageSize + 17
+	pages := 5
+	for _, descending := range []bool{false, true} {
+		t.Run(fmt.Sprintf("descending %v", descending), func(t *testing.T) {
+			output := &bytes.Buffer{}
+			queries := []string{}
+			candles := minuteCandles(t, start, available, &queries)
+			session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Before each page is served, the previous ones are either
+				// already written or spooled to disk a page per file, never
+				// held in memory.
+				served := len(queries)
+				// Data rows, after the header, which is flushed with the first page.
+				written := strings.Count(output.String(), "\n")
+				if written > 0 {
+					written--
+				}
+				spooled := spooledRecords(t, tmp)
+				if descending {
+					if written != 0 || len(spooled) != served {
+						t.Errorf("before page %d: %d rows written and %d pages spooled", served+1, written, len(spooled))
+					}
+					for _, records := range spooled {
+						if records > exportPageSize {
+							t.Errorf("a spooled page has %d records", records)
+						}
+					}
+				} else if written != served*exportPageSize || len(spooled) != 0 {
+					t.Errorf("before page %d: %d rows written and %d pages spooled", served+1, written, len(spooled))
+				}
+				candles.ServeHTTP(w, r)
+			}))
+			options := ExportOptions{Instrument: "EUR_USD", Granularity: "M1", From: start, To: start.Add(24 * 30 * time.Hour), Descending: descending}
+
+			if err := exportCandles(session, &options, output); err != nil {
+				t.Fatal(err)
+			}
+			if len(queries) != pages {
+				t.Errorf("got %d requests, want %d", len(queries), pages)
+			}
+			if rows := strings.Count(output.String(), "\n") - 1; rows != available {
+				t.Errorf("got %d rows, want %d", rows, available)
+			}
+			if spooled := spooledRecords(t, tmp); len(spooled) != 0 {
+				t.Errorf("%d spooled pages are left behind", len(spooled))
+			}
+		})
+	}
+}
+
+// spooledRecords counts the records of every page spooled under dir.
+func spooledRecords(t *testing.T, dir string) []int {
+	paths, err := filepath.Glob(filepath.Join(dir, "oanda-export-*", "*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := []int{}
+	for _, path := range paths {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts = append(counts, strings.Count(string(bytes), "\n"))
+	}
+	return counts
+}
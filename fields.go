@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldPaths are dotted paths of fields, such as "bids" or "mid.o".
+type FieldPaths []string
+
+// ParseFieldPaths parses a CSV list of dotted paths.
+func ParseFieldPaths(spec string) (FieldPaths, error) {
+	paths := FieldPaths{}
+	for _, entry := range strings.Split(spec, ",") {
+		path := strings.TrimSpace(entry)
+		if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			return nil, fmt.Errorf("invalid field %q", entry)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// Remove deletes the fields from a JSON object line. Missing fields are
+// skipped, and lines which are not JSON objects are returned as is.
+func (self FieldPaths) Remove(line string) (string, error) {
+	if !strings.HasPrefix(line, "{") {
+		return line, nil
+	}
+
+	message, err := decodeMessage(line)
+	if err != nil {
+		return "", err
+	}
+	for _, path := range self {
+		removePath(message, path)
+	}
+	return encodeMessage(message)
+}
+
+// Select keeps only the fields of a JSON object line, reporting those the
+// message lacks. Lines which are not JSON objects are returned as is.
+func (self FieldPaths) Select(line string) (string, []string, error) {
+	if !strings.HasPrefix(line, "{") {
+		return line, nil, nil
+	}
+
+	message, err := decodeMessage(line)
+	if err != nil {
+		return "", nil, err
+	}
+	selected := map[string]interface{}{}
+	missing := []string{}
+	for _, path := range self {
+		value, ok := removePath(message, path)
+		if !ok {
+			missing = append(missing, path)
+			continue
+		}
+		setPath(selected, path, value)
+	}
+
+	line, err = encodeMessage(selected)
+	return line, missing, err
+}
+
+// Overlap returns a path of other which is, or is within or around, one of
+// the paths, e.g. to reject stripping a field that is also selected.
+func (self FieldPaths) Overlap(other FieldPaths) (string, bool) {
+	for _, path := range self {
+		for _, candidate := range other {
+			if path == candidate || strings.HasPrefix(path, candidate+".") || strings.HasPrefix(candidate, path+".") {
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// sameJSON reports whether two lines hold the same JSON value, since the
+// fields are written in order of their names once rewritten.
+func sameJSON(a string, b string) bool {
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil {
+		return a == b
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestParseFieldPaths(t *testing.T) {
+	tests := []struct {
+		spec string
+		want FieldPaths
+		err  bool
+	}{
+		{"bids", FieldPaths{"bids"}, false},
+		{"bids, mid.o ,closeoutBid", FieldPaths{"bids", "mid.o", "closeoutBid"}, false},
+		{"", nil, true},
+		{"bids,", nil, true},
+		{".bids", nil, true},
+		{"mid.", nil, true},
+		{"mid..o", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			got, err := ParseFieldPaths(test.spec)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want an error: %v", err, test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFieldPathsRemove(t *testing.T) {
+	price := `{"type":"PRICE","instrument":"EUR_USD","bids":[{"price":"1.2","liquidity":1000000}],"asks":[{"price":"1.3","liquidity":1000000}],"quoteHomeConversionFactors":{"positiveUnits":"1.0","negativeUnits":"1.0"},"closeoutBid":"1.2"}`
+	tests := []struct {
+		name  string
+		paths FieldPaths
+		line  string
+		want  string
+	}{
+		{
+			"top level",
+			FieldPaths{"bids", "asks"},
+			price,
+			`{"type":"PRICE","instrument":"EUR_USD","quoteHomeConversionFactors":{"positiveUnits":"1.0","negativeUnits":"1.0"},"closeoutBid":"1.2"}`,
+		},
+		{
+			"nested",
+			FieldPaths{"quoteHomeConversionFactors.negativeUnits"},
+			price,
+			`{"type":"PRICE","instrument":"EUR_USD","bids":[{"price":"1.2","liquidity":1000000}],"asks":[{"price":"1.3","liquidity":1000000}],"quoteHomeConversionFactors":{"positiveUnits":"1.0"},"closeoutBid":"1.2"}`,
+		},
+		{
+			"every nested field",
+			FieldPaths{"quoteHomeConversionFactors.negativeUnits", "quoteHomeConversionFactors.positiveUnits", "bids", "asks"},
+			price,
+			`{"type":"PRICE","instrument":"EUR_USD","quoteHomeConversionFactors":{},"closeoutBid":"1.2"}`,
+		},
+		{
+			"missing",
+			FieldPaths{"mid.o", "closeoutBid.x"},
+			`{"type":"PRICE","closeoutBid":"1.2"}`,
+			`{"type":"PRICE","closeoutBid":"1.2"}`,
+		},
+		{
+			"not an object",
+			FieldPaths{"bids"},
+			`[{"bids":[]}]`,
+			`[{"bids":[]}]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.paths.Remove(test.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(got, test.want) {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFieldPathsOverlap(t *testing.T) {
+	tests := []struct {
+		name     string
+		selected FieldPaths
+		stripped FieldPaths
+		want     string
+	}{
+		{"same", FieldPaths{"bids"}, FieldPaths{"bids"}, "bids"},
+		{"within", FieldPaths{"mid.o"}, FieldPaths{"mid"}, "mid"},
+		{"around", FieldPaths{"mid"}, FieldPaths{"mid.o"}, "mid.o"},
+		{"siblings", FieldPaths{"mid.o"}, FieldPaths{"mid.c"}, ""},
+		{"common prefix", FieldPaths{"closeoutBid"}, FieldPaths{"closeout"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := test.selected.Overlap(test.stripped)
+			if got != test.want || ok != (test.want != "") {
+				t.Errorf("got %q, %v, want %q", got, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestFieldPathsSelect(t *testing.T) {
+	fill := `{"id":"6","time":"2021-03-01T00:00:00Z","type":"ORDER_FILL","instrument":"EUR_USD","units":"100","price":"1.20715","pl":"0.0000","tradeOpened":{"tradeID":"6","units":"100"},"fullPrice":{"bids":[{"price":"1.20701"}]}}`
+	tests := []struct {
+		name    string
+		paths   FieldPaths
+		line    string
+		want    string
+		missing []string
+	}{
+		{
+			"subset",
+			FieldPaths{"id", "type", "instrument", "units", "price", "pl"},
+			fill,
+			`{"id":"6","type":"ORDER_FILL","instrument":"EUR_USD","units":"100","price":"1.20715","pl":"0.0000"}`,
+			[]string{},
+		},
+		{
+			"nested",
+			FieldPaths{"id", "tradeOpened.tradeID"},
+			fill,
+			`{"id":"6","tradeOpened":{"tradeID":"6"}}`,
+			[]string{},
+		},
+		{
+			"missing",
+			FieldPaths{"id", "reason", "tradeOpened.price"},
+			fill,
+			`{"id":"6"}`,
+			[]string{"reason", "tradeOpened.price"},
+		},
+		{
+			"not an object",
+			FieldPaths{"id"},
+			`[{"id":"6"}]`,
+			`[{"id":"6"}]`,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, missing, err := test.paths.Select(test.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(got, test.want) {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+			if !reflect.DeepEqual(missing, test.missing) {
+				t.Errorf("got missing %v, want %v", missing, test.missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FilterExpr is a parsed --filter-expr. The grammar is deliberately small:
+// comparisons of a dotted field path against a number, joined by && and ||
+// (&& binds tighter, there are no parentheses).
+//
+//	mid.c > 1.1000 && volume >= 10 || asks.0.price < 1.09
+type FilterExpr struct {
+	alternatives [][]FilterComparison
+}
+
+type FilterComparison struct {
+	Path     string
+	Operator string
+	Value    float64
+}
+
+var filterComparisonPattern = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_.]*)\s*(<=|>=|==|!=|<|>)\s*(\S+)\s*$`)
+
+func ParseFilterExpr(expr string) (*FilterExpr, error) {
+	filter := FilterExpr{}
+	for _, alternative := range strings.Split(expr, "||") {
+		comparisons := []FilterComparison{}
+		for _, term := range strings.Split(alternative, "&&") {
+			match := filterComparisonPattern.FindStringSubmatch(term)
+			if match == nil {
+				return nil, fmt.Errorf("invalid filter expression %q: expected <field> <op> <number>", strings.TrimSpace(term))
+			}
+			value, err := strconv.ParseFloat(match[3], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter expression %q: %s is not a number", strings.TrimSpace(term), match[3])
+			}
+			comparisons = append(comparisons, FilterComparison{Path: match[1], Operator: match[2], Value: value})
+		}
+		filter.alternatives = append(filter.alternatives, comparisons)
+	}
+
+	return &filter, nil
+}
+
+// Match evaluates the expression against a JSON message. Comparisons on
+// missing or non-numeric fields are false.
+func (self *FilterExpr) Match(line string) (bool, error) {
+	var message interface{}
+	if err := json.Unmarshal([]byte(line), &message); err != nil {
+		return false, err
+	}
+
+	for _, comparisons := range self.alternatives {
+		matched := true
+		for _, comparison := range comparisons {
+			if !comparison.Match(message) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (self *FilterComparison) Match(message interface{}) bool {
+	field, ok := lookupPath(message, self.Path)
+	if !ok {
+		return false
+	}
+	value, ok := toFloat(field)
+	if !ok {
+		return false
+	}
+
+	switch self.Operator {
+	case "<":
+		return value < self.Value
+	case "<=":
+		return value <= self.Value
+	case ">":
+		return value > self.Value
+	case ">=":
+		return value >= self.Value
+	case "==":
+		return value == self.Value
+	case "!=":
+		return value != self.Value
+	}
+	return false
+}
+
+// toFloat reads a decoded JSON number, or a string holding one as OANDA
+// sends prices.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestParseFilterExpr(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"mid.c > 1.1", true},
+		{"volume>=10", true},
+		{"mid.c > 1.1 && volume >= 10 || asks.0.price < 1.09", true},
+		{"volume == -1", true},
+		{"volume", false},
+		{"volume > ", false},
+		{"volume > ten", false},
+		{"volume => 10", false},
+		{"1volume > 10", false},
+		{"volume > 10 &&", false},
+	}
+	for _, test := range tests {
+		_, err := ParseFilterExpr(test.expr)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", test.expr, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.expr)
+		}
+	}
+}
+
+func TestFilterExprMatch(t *testing.T) {
+	candle := `{"complete":true,"volume":12,"mid":{"o":"1.2070","c":"1.2075"},"asks":[{"price":"1.0850"}]}`
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"volume > 10", true},
+		{"volume < 10", false},
+		{"volume == 12", true},
+		{"volume != 12", false},
+		{"volume <= 12", true},
+		{"volume >= 13", false},
+		// Prices sent as strings compare as numbers.
+		{"mid.c > 1.2", true},
+		{"asks.0.price < 1.09", true},
+		// && binds tighter than ||.
+		{"volume < 10 && mid.c > 1.2 || volume > 10", true},
+		{"volume < 10 || volume > 10 && mid.c < 1.2", false},
+		// Missing and non-numeric fields never match.
+		{"bid.c > 0", false},
+		{"mid > 0", false},
+		{"complete == 1", false},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilterExpr(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := filter.Match(candle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%q: got %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// formatAction re-emits a captured NDJSON file, or stdin, through the output
+// path of the streaming commands, pretty-printed unless --compact or another
+// format is given. It needs no credentials.
+func formatAction(c *cli.Context) (err error) {
+	var input io.Reader = os.Stdin
+	if path := c.Args().First(); path != "" && path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	session := &Session{
+		Context: context.Background(),
+		Client:  new(http.Client),
+		Output:  &Output{Writer: &LockedWriter{Writer: os.Stdout}},
+	}
+	defer session.CancelOnSignal()()
+	if err := session.OpenOutput(c); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	formatted := c.String("output") != "" || c.String("template") != "" || c.String("stdout-format") != ""
+	if !c.Bool("compact") && !formatted {
+		session.Output.Writer = &FormattedWriter{Writer: session.Output.Writer, Formatter: PrettyFormatter{Indent: c.String("indent")}}
+	}
+
+	reader := bufio.NewReader(input)
+	for session.Context.Err() == nil {
+		line, _, err := readLine(reader, 0)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(line)) == "" {
+			continue
+		}
+		if err := session.Output.Emit(string(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestFormatAction(t *testing.T) {
+	flags := append([]cli.Flag{
+		&cli.StringFlag{Name: "indent", Value: "  "},
+		&cli.BoolFlag{Name: "compact"},
+	}, outputFlags()...)
+	input := `{"type":"PRICE","instrument":"EUR_USD","closeoutBid":"1.2"}` + "\n\n" +
+		`{"type":"PRICE","instrument":"USD_JPY","closeoutBid":"110.5"}` + "\n"
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			"pretty",
+			nil,
+			"{\n  \"type\": \"PRICE\",\n  \"instrument\": \"EUR_USD\",\n  \"closeoutBid\": \"1.2\"\n}\n" +
+				"{\n  \"type\": \"PRICE\",\n  \"instrument\": \"USD_JPY\",\n  \"closeoutBid\": \"110.5\"\n}\n",
+		},
+		{
+			"indent",
+			[]string{"--indent", "\t", "--strip-fields", "closeoutBid,type"},
+			"{\n\t\"instrument\": \"EUR_USD\"\n}\n{\n\t\"instrument\": \"USD_JPY\"\n}\n",
+		},
+		{
+			"compact",
+			[]string{"--compact", "--strip-fields", "closeoutBid"},
+			`{"instrument":"EUR_USD","type":"PRICE"}` + "\n" + `{"instrument":"USD_JPY","type":"PRICE"}` + "\n",
+		},
+		{
+			"filtered",
+			[]string{"--compact", "--filter-expr", "closeoutBid > 100"},
+			`{"type":"PRICE","instrument":"USD_JPY","closeoutBid":"110.5"}` + "\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "captured.ndjson")
+			if err := ioutil.WriteFile(path, []byte(input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			out := filepath.Join(dir, "formatted")
+
+			args := append(append([]string{"--output-file", out}, test.args...), path)
+			if err := formatAction(newTestContext(t, flags, args...)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
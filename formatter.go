@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formatter renders a line of the output, as the message pipeline produced
+// it, in an output format. Lines which are not JSON are left as they are by
+// every format. A Formatter may keep state, e.g. a CSV header, and is called
+// for one line at a time.
+type Formatter interface {
+	Format(line string) (string, error)
+}
+
+// Ender is a Formatter which closes its output once the last line is
+// written, e.g. with the bracket of a JSON array.
+type Ender interface {
+	End() string
+}
+
+// FormatOptions are the settings of the formats which have any.
+type FormatOptions struct {
+	Indent   string
+	Template string
+}
+
+// formats are the formats of --output, --stdout-format and --file-format. A
+// Formatter is made anew for every sink, since some keep state. A new format
+// only needs to be registered here.
+var formats = map[string]func(options FormatOptions) (Formatter, error){
+	"ndjson": func(FormatOptions) (Formatter, error) {
+		return NdjsonFormatter{}, nil
+	},
+	"json": func(FormatOptions) (Formatter, error) {
+		return JsonFormatter{}, nil
+	},
+	"pretty": func(options FormatOptions) (Formatter, error) {
+		return PrettyFormatter{Indent: options.Indent}, nil
+	},
+	"csv": func(FormatOptions) (Formatter, error) {
+		return &DelimitedFormatter{Comma: ','}, nil
+	},
+	"tsv": func(FormatOptions) (Formatter, error) {
+		return &DelimitedFormatter{Comma: '\t'}, nil
+	},
+	"array": func(FormatOptions) (Formatter, error) {
+		return &ArrayFormatter{}, nil
+	},
+	"lwc": func(FormatOptions) (Formatter, error) {
+		return LwcFormatter{}, nil
+	},
+	"template": func(options FormatOptions) (Formatter, error) {
+		return NewTemplateFormatter(options.Template)
+	},
+}
+
+// formatNames lists the registered formats, sorted.
+func formatNames() []string {
+	names := []string{}
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFormatter makes a Formatter of a registered format.
+func NewFormatter(name string, options FormatOptions) (Formatter, error) {
+	format, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", name, strings.Join(formatNames(), ", "))
+	}
+	return format(options)
+}
+
+// NdjsonFormatter writes a message per line, as sent.
+type NdjsonFormatter struct{}
+
+func (self NdjsonFormatter) Format(line string) (string, error) {
+	return line, nil
+}
+
+// JsonFormatter writes a message per line with the whitespace removed, e.g.
+// to compact a pretty-printed capture with the format command.
+type JsonFormatter struct{}
+
+func (self JsonFormatter) Format(line string) (string, error) {
+	var buffer bytes.Buffer
+	if err := json.Compact(&buffer, []byte(line)); err != nil {
+		return line, nil
+	}
+	return buffer.String(), nil
+}
+
+// PrettyFormatter spreads a message over several indented lines.
+type PrettyFormatter struct {
+	Indent string
+}
+
+func (self PrettyFormatter) Format(line string) (string, error) {
+	var buffer bytes.Buffer
+	if err := json.Indent(&buffer, []byte(line), "", self.Indent); err != nil {
+		return line, nil
+	}
+	return buffer.String(), nil
+}
+
+// DelimitedFormatter writes a message per record, with a header naming the
+// columns before the first one. Nested objects are flattened into columns
+// named by their dotted path, e.g. mid.c, and arrays are written as JSON.
+// The columns are those of the first message: fields which only later
+// messages have are left out. An array of messages, a --batch-size batch,
+// is written a record per message.
+type DelimitedFormatter struct {
+	Comma   rune
+	columns []string
+}
+
+func (self *DelimitedFormatter) Format(line string) (string, error) {
+	trimmed := strings.TrimSpace(line)
+	messages := []json.RawMessage{}
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal([]byte(trimmed), &messages); err != nil {
+			return line, nil
+		}
+	} else {
+		messages = append(messages, json.RawMessage(trimmed))
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Comma = self.Comma
+	for _, message := range messages {
+		fields, ok := flattenMessage(message)
+		if !ok {
+			return line, nil
+		}
+		if self.columns == nil {
+			self.columns = []string{}
+			for _, field := range fields {
+				self.columns = append(self.columns, field.name)
+			}
+			writer.Write(self.columns)
+		}
+
+		values := map[string]string{}
+		for _, field := range fields {
+			values[field.name] = field.value
+		}
+		record := []string{}
+		for _, column := range self.columns {
+			record = append(record, values[column])
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
+
+// flatField is a column of a flattened message.
+type flatField struct {
+	name  string
+	value string
+}
+
+// flattenMessage lists the fields of a JSON object in the order sent, those
+// of nested objects under their dotted path, or reports that message is not
+// an object.
+func flattenMessage(message json.RawMessage) ([]flatField, bool) {
+	fields := []flatField{}
+	if err := flattenObject(message, "", &fields); err != nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+func flattenObject(object json.RawMessage, prefix string, fields *[]flatField) error {
+	decoder := json.NewDecoder(bytes.NewReader(object))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("not a JSON object: %s", object)
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		name := prefix + token.(string)
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+		switch {
+		case bytes.HasPrefix(value, []byte("{")):
+			if err := flattenObject(value, name+".", fields); err != nil {
+				return err
+			}
+		case bytes.HasPrefix(value, []byte(`"`)):
+			var text string
+			if err := json.Unmarshal(value, &text); err != nil {
+				return err
+			}
+			*fields = append(*fields, flatField{name, text})
+		case bytes.Equal(value, []byte("null")):
+			*fields = append(*fields, flatField{name, ""})
+		default:
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, value); err != nil {
+				return err
+			}
+			*fields = append(*fields, flatField{name, compact.String()})
+		}
+	}
+	return nil
+}
+
+// ArrayFormatter writes the whole output as one JSON array, a message per
+// line, for tools which read a JSON document rather than NDJSON.
+type ArrayFormatter struct {
+	count int
+}
+
+func (self *ArrayFormatter) Format(line string) (string, error) {
+	self.count++
+	if self.count == 1 {
+		return "[" + line, nil
+	}
+	return "," + line, nil
+}
+
+func (self *ArrayFormatter) End() string {
+	if self.count == 0 {
+		return "[]"
+	}
+	return "]"
+}
+
+// LwcFormatter writes candles and prices as the data points of TradingView's
+// Lightweight Charts: a candle as {"time","open","high","low","close"} of its
+// mid prices, or bid or ask without them, and a price as {"time","value"} of
+// the middle of its best bid and ask. Times are in seconds since the epoch.
+// Other messages are left as they are.
+type LwcFormatter struct{}
+
+func (self LwcFormatter) Format(line string) (string, error) {
+	var message interface{}
+	if err := json.Unmarshal([]byte(line), &message); err != nil {
+		return line, nil
+	}
+
+	var point interface{}
+	switch value := message.(type) {
+	case map[string]interface{}:
+		var ok bool
+		if point, ok = lwcPoint(value); !ok {
+			return line, nil
+		}
+	case []interface{}:
+		points := []interface{}{}
+		for _, element := range value {
+			object, _ := element.(map[string]interface{})
+			p, ok := lwcPoint(object)
+			if !ok {
+				return line, nil
+			}
+			points = append(points, p)
+		}
+		point = points
+	default:
+		return line, nil
+	}
+
+	bytes, err := json.Marshal(point)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+type lwcCandle struct {
+	Time  int64   `json:"time"`
+	Open  float64 `json:"open"`
+	High  float64 `json:"high"`
+	Low   float64 `json:"low"`
+	Close float64 `json:"close"`
+}
+
+type lwcValue struct {
+	Time  int64   `json:"time"`
+	Value float64 `json:"value"`
+}
+
+// lwcPoint converts a candle or price message, or reports that it is neither.
+func lwcPoint(message map[string]interface{}) (interface{}, bool) {
+	text, _ := message["time"].(string)
+	t, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, component := range []string{"mid", "bid", "ask"} {
+		data, ok := message[component].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		prices := [4]float64{}
+		for i, name := range []string{"o", "h", "l", "c"} {
+			if prices[i], ok = toFloat(data[name]); !ok {
+				return nil, false
+			}
+		}
+		return lwcCandle{Time: t.Unix(), Open: prices[0], High: prices[1], Low: prices[2], Close: prices[3]}, true
+	}
+
+	bid, bidOk := bestPrice(message["bids"])
+	ask, askOk := bestPrice(message["asks"])
+	if !bidOk || !askOk {
+		if bid, bidOk = toFloat(message["closeoutBid"]); !bidOk {
+			return nil, false
+		}
+		if ask, askOk = toFloat(message["closeoutAsk"]); !askOk {
+			return nil, false
+		}
+	}
+	return lwcValue{Time: t.Unix(), Value: (bid + ask) / 2}, true
+}
+
+// bestPrice is the price of the first entry of a price's bids or asks.
+func bestPrice(levels interface{}) (float64, bool) {
+	list, _ := levels.([]interface{})
+	if len(list) == 0 {
+		return 0, false
+	}
+	level, _ := list[0].(map[string]interface{})
+	return toFloat(level["price"])
+}
+
+// TemplateFormatter renders a message with a Go text/template (--template),
+// e.g. '{{.time}} {{fixed 5 .mid.c}}'. A --batch-size batch is rendered as
+// a whole, an array of candles.
+type TemplateFormatter struct {
+	Template *template.Template
+}
+
+// NewTemplateFormatter parses text, so that a broken template fails the
+// command before anything is streamed.
+func NewTemplateFormatter(text string) (*TemplateFormatter, error) {
+	if text == "" {
+		return nil, fmt.Errorf("the template format requires --template")
+	}
+	tmpl, err := template.New("output").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateFormatter{Template: tmpl}, nil
+}
+
+func (self *TemplateFormatter) Format(line string) (string, error) {
+	var message interface{}
+	if err := json.Unmarshal([]byte(line), &message); err != nil {
+		return line, nil
+	}
+
+	var buffer strings.Builder
+	if err := self.Template.Execute(&buffer, message); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// templateFuncs are the helpers available to --template.
+var templateFuncs = template.FuncMap{
+	// num converts a price string such as "1.10234" to a number.
+	"num": func(value interface{}) (float64, error) {
+		f, ok := toFloat(value)
+		if !ok {
+			return 0, fmt.Errorf("not a number: %v", value)
+		}
+		return f, nil
+	},
+	// fixed formats a number or price string with the given decimals.
+	"fixed": func(decimals int, value interface{}) (string, error) {
+		f, ok := toFloat(value)
+		if !ok {
+			return "", fmt.Errorf("not a number: %v", value)
+		}
+		return strconv.FormatFloat(f, 'f', decimals, 64), nil
+	},
+	// time reformats an RFC3339 timestamp with a Go time layout.
+	"time": func(layout string, value string) (string, error) {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return "", err
+		}
+		return t.Format(layout), nil
+	},
+	// unix converts an RFC3339 timestamp to seconds since the epoch.
+	"unix": func(value string) (int64, error) {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return 0, err
+		}
+		return t.Unix(), nil
+	},
+}
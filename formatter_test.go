@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const formatterCandle = `{"complete":true,"volume":42,"time":"2021-03-01T00:01:00Z","mid":{"o":"1.1","h":"1.3","l":"1.0","c":"1.2"},"tags":["a","b"]}`
+
+// decodeJSON decodes a JSON document for comparison, failing the test if it
+// is not one.
+func decodeJSON(t *testing.T, text string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		t.Fatalf("%q: %s", text, err)
+	}
+	return value
+}
+
+// readDelimited reads the records of a csv or tsv formatted output back into
+// messages keyed by the header.
+func readDelimited(t *testing.T, text string, comma rune) []map[string]string {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = comma
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []map[string]string{}
+	for _, record := range records[1:] {
+		message := map[string]string{}
+		for i, column := range records[0] {
+			message[column] = record[i]
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestFormattersRoundTrip(t *testing.T) {
+	flat := map[string]string{
+		"complete": "true", "volume": "42", "time": "2021-03-01T00:01:00Z",
+		"mid.o": "1.1", "mid.h": "1.3", "mid.l": "1.0", "mid.c": "1.2", "tags": `["a","b"]`,
+	}
+	checks := map[string]func(t *testing.T, output string){
+		"ndjson": func(t *testing.T, output string) {
+			if output != formatterCandle+"\n" {
+				t.Errorf("got %q", output)
+			}
+		},
+		"json": func(t *testing.T, output string) {
+			if output != formatterCandle+"\n" {
+				t.Errorf("got %q", output)
+			}
+		},
+		"pretty": func(t *testing.T, output string) {
+			if !strings.Contains(output, "\n  \"mid\": {\n    \"o\": \"1.1\",") {
+				t.Errorf("got %q", output)
+			}
+			if got, want := decodeJSON(t, output), decodeJSON(t, formatterCandle); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		},
+		"csv": func(t *testing.T, output string) {
+			if !strings.HasPrefix(output, "complete,volume,time,mid.o,mid.h,mid.l,mid.c,tags\n") {
+				t.Errorf("got header %q", output)
+			}
+			if got := readDelimited(t, output, ','); len(got) != 1 || !reflect.DeepEqual(got[0], flat) {
+				t.Errorf("got %v, want %v", got, flat)
+			}
+		},
+		"tsv": func(t *testing.T, output string) {
+			if got := readDelimited(t, output, '\t'); len(got) != 1 || !reflect.DeepEqual(got[0], flat) {
+				t.Errorf("got %v, want %v", got, flat)
+			}
+		},
+		"array": func(t *testing.T, output string) {
+			want := decodeJSON(t, "["+formatterCandle+"]")
+			if got := decodeJSON(t, output); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		},
+		"lwc": func(t *testing.T, output string) {
+			want := `{"time":1614556860,"open":1.1,"high":1.3,"low":1,"close":1.2}` + "\n"
+			if output != want {
+				t.Errorf("got %q, want %q", output, want)
+			}
+		},
+		"template": func(t *testing.T, output string) {
+			if output != "2021-03-01T00:01:00Z 1.20000 42\n" {
+				t.Errorf("got %q", output)
+			}
+		},
+	}
+
+	for _, name := range formatNames() {
+		t.Run(name, func(t *testing.T) {
+			check, ok := checks[name]
+			if !ok {
+				t.Fatalf("format %s has no round-trip test", name)
+			}
+			var buffer bytes.Buffer
+			writer, err := NewFormattedWriter(&buffer, name, FormatOptions{Indent: "  ", Template: "{{.time}} {{fixed 5 .mid.c}} {{.volume}}"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writer.Write([]byte(formatterCandle + "\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			check(t, buffer.String())
+		})
+	}
+}
+
+func TestFormattersLeaveOtherLines(t *testing.T) {
+	for _, name := range formatNames() {
+		formatter, err := NewFormatter(name, FormatOptions{Template: "{{.time}}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := formatter.Format("EUR_USD 1.1")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		want := "EUR_USD 1.1"
+		if name == "array" {
+			want = "[" + want
+		}
+		if got != want {
+			t.Errorf("%s: got %q for a line which is not JSON", name, got)
+		}
+	}
+}
+
+func TestNewFormatterUnknown(t *testing.T) {
+	_, err := NewFormatter("yaml", FormatOptions{})
+	if err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+	if !strings.Contains(err.Error(), `"yaml"`) || !strings.Contains(err.Error(), strings.Join(formatNames(), ", ")) {
+		t.Errorf("error %q does not name the format and list the available ones", err)
+	}
+}
+
+func TestDelimitedFormatter(t *testing.T) {
+	formatter := &DelimitedFormatter{Comma: ','}
+	lines := []string{
+		`{"instrument":"EUR_USD","closeoutBid":"1.1","status":null}`,
+		// Missing fields are empty, fields the header lacks are left out.
+		`{"instrument":"USD_JPY","extra":1}`,
+		// A batch is a record per message.
+		`[{"instrument":"GBP_USD","closeoutBid":"1.3"},{"instrument":"AUD_USD","closeoutBid":"0.7"}]`,
+	}
+	want := []string{
+		"instrument,closeoutBid,status\nEUR_USD,1.1,",
+		"USD_JPY,,",
+		"GBP_USD,1.3,\nAUD_USD,0.7,",
+	}
+	for i, line := range lines {
+		got, err := formatter.Format(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestArrayFormatterEmpty(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := &FormattedWriter{Writer: &buffer, Formatter: &ArrayFormatter{}}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := buffer.String(); got != "[]\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLwcFormatter(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"bid candle", `{"time":"2021-03-01T00:00:00Z","bid":{"o":1.1,"h":1.3,"l":1.0,"c":1.2}}`, `{"time":1614556800,"open":1.1,"high":1.3,"low":1,"close":1.2}`},
+		{"price", `{"type":"PRICE","time":"2021-03-01T00:00:00.5Z","bids":[{"price":"1.25"}],"asks":[{"price":"1.75"}]}`, `{"time":1614556800,"value":1.5}`},
+		{"price closeout", `{"type":"PRICE","time":"2021-03-01T00:00:00Z","bids":[],"asks":[],"closeoutBid":"1.5","closeoutAsk":"2.5"}`, `{"time":1614556800,"value":2}`},
+		{"batch", `[{"time":"2021-03-01T00:00:00Z","mid":{"o":"1","h":"1","l":"1","c":"1"}}]`, `[{"time":1614556800,"open":1,"high":1,"low":1,"close":1}]`},
+		{"heartbeat", `{"type":"HEARTBEAT","time":"2021-03-01T00:00:00Z"}`, `{"type":"HEARTBEAT","time":"2021-03-01T00:00:00Z"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := LwcFormatter{}.Format(test.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTemplateFormatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		line     string
+		want     string
+		err      bool
+	}{
+		{"candle", "{{.time}} {{fixed 3 .mid.c}}", formatterCandle, "2021-03-01T00:01:00Z 1.200", false},
+		{"helpers", "{{unix .time}} {{time \"15:04\" .time}} {{num .mid.h}}", formatterCandle, "1614556860 00:01 1.3", false},
+		{"missing field", "{{.instrument}}", formatterCandle, "<no value>", false},
+		{"batch", "{{range .}}{{.mid.c}};{{end}}", "[" + formatterCandle + "," + formatterCandle + "]", "1.2;1.2;", false},
+		{"not a number", "{{fixed 2 .time}}", formatterCandle, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formatter, err := NewTemplateFormatter(test.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := formatter.Format(test.line)
+			if (err != nil) != test.err {
+				t.Fatalf("error %v, want an error: %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewTemplateFormatterInvalid(t *testing.T) {
+	for _, text := range []string{"", "{{.time", "{{nosuchfunc .time}}"} {
+		if _, err := NewTemplateFormatter(text); err == nil {
+			t.Errorf("template %q was accepted", text)
+		}
+	}
+}
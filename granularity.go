@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// granularityDurations maps every OANDA candlestick granularity to its length.
+// W and M have no fixed length; W is taken as 7 days and M as 30 days, which is
+// only an approximation for month candles and must not be used for calendar math.
+var granularityDurations = map[string]time.Duration{
+	"S5":  5 * time.Second,
+	"S10": 10 * time.Second,
+	"S15": 15 * time.Second,
+	"S30": 30 * time.Second,
+	"M1":  1 * time.Minute,
+	"M2":  2 * time.Minute,
+	"M4":  4 * time.Minute,
+	"M5":  5 * time.Minute,
+	"M10": 10 * time.Minute,
+	"M15": 15 * time.Minute,
+	"M30": 30 * time.Minute,
+	"H1":  1 * time.Hour,
+	"H2":  2 * time.Hour,
+	"H3":  3 * time.Hour,
+	"H4":  4 * time.Hour,
+	"H6":  6 * time.Hour,
+	"H8":  8 * time.Hour,
+	"H12": 12 * time.Hour,
+	"D":   24 * time.Hour,
+	"W":   7 * 24 * time.Hour,
+	"M":   30 * 24 * time.Hour,
+}
+
+// GranularityDuration returns the length of a candle of the given granularity.
+// Note that "M" is the month granularity, not minutes, and is approximated as 30 days.
+func GranularityDuration(granularity string) (time.Duration, error) {
+	duration, ok := granularityDurations[granularity]
+	if !ok {
+		return 0, fmt.Errorf("unknown granularity: %s", granularity)
+	}
+	return duration, nil
+}
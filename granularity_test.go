@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGranularityDuration(t *testing.T) {
+	tests := []struct {
+		granularity string
+		want        time.Duration
+		valid       bool
+	}{
+		{"S5", 5 * time.Second, true},
+		{"M1", time.Minute, true},
+		{"M30", 30 * time.Minute, true},
+		{"H4", 4 * time.Hour, true},
+		{"D", 24 * time.Hour, true},
+		{"W", 7 * 24 * time.Hour, true},
+		// M is a month, not a minute.
+		{"M", 30 * 24 * time.Hour, true},
+		{"m1", 0, false},
+		{"M3", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		got, err := GranularityDuration(test.granularity)
+		if test.valid && (err != nil || got != test.want) {
+			t.Errorf("%q: got %s, %v, want %s", test.granularity, got, err, test.want)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.granularity)
+		}
+	}
+}
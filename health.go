@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultHealthStaleAfter is how long /healthz tolerates a silent stream when
+// the heartbeat timeout is disabled.
+const defaultHealthStaleAfter = 30 * time.Second
+
+// StreamHealth tracks whether the streams of a session are connected and
+// still receiving lines, for --health-addr.
+type StreamHealth struct {
+	StaleAfter  time.Duration
+	mutex       sync.Mutex
+	connections int
+	lastLine    time.Time
+}
+
+func (self *StreamHealth) Connected() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.connections++
+	self.lastLine = time.Now()
+}
+
+func (self *StreamHealth) Disconnected() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.connections--
+}
+
+func (self *StreamHealth) Received() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.lastLine = time.Now()
+}
+
+// Ready reports whether a stream is connected.
+func (self *StreamHealth) Ready() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.connections > 0
+}
+
+// Live reports whether a stream is connected and a line, heartbeats
+// included, arrived within StaleAfter.
+func (self *StreamHealth) Live() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.connections > 0 && time.Since(self.lastLine) < self.StaleAfter
+}
+
+// ServeHealth starts an HTTP server on addr exposing /healthz and /readyz,
+// which is shut down with the session context.
+func (self *Session) ServeHealth(addr string, staleAfter time.Duration) error {
+	if staleAfter == 0 {
+		staleAfter = defaultHealthStaleAfter
+	}
+	health := &StreamHealth{StaleAfter: staleAfter}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler(health.Live))
+	mux.HandleFunc("/readyz", healthHandler(health.Ready))
+	if err := serveHTTP(self, addr, mux); err != nil {
+		return err
+	}
+
+	self.Health = health
+	return nil
+}
+
+// serveHTTP listens on addr right away, so that a taken port fails the
+// command, and serves handler until the session context is done.
+func serveHTTP(session *Session, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	go func() {
+		<-session.Context.Done()
+		server.Close()
+	}()
+
+	return nil
+}
+
+func healthHandler(check func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if check() {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok\n"))
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("unavailable\n"))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamHealth(t *testing.T) {
+	health := &StreamHealth{StaleAfter: 50 * time.Millisecond}
+	tests := []struct {
+		name    string
+		step    func()
+		healthz int
+		readyz  int
+	}{
+		{"before connecting", func() {}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"connected", health.Connected, http.StatusOK, http.StatusOK},
+		{"silent", func() { time.Sleep(100 * time.Millisecond) }, http.StatusServiceUnavailable, http.StatusOK},
+		{"received", health.Received, http.StatusOK, http.StatusOK},
+		{"second stream", health.Connected, http.StatusOK, http.StatusOK},
+		{"one disconnected", health.Disconnected, http.StatusOK, http.StatusOK},
+		{"all disconnected", health.Disconnected, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.step()
+			for path, want := range map[string]int{"/healthz": test.healthz, "/readyz": test.readyz} {
+				check := health.Live
+				if path == "/readyz" {
+					check = health.Ready
+				}
+				recorder := httptest.NewRecorder()
+				healthHandler(check)(recorder, httptest.NewRequest("GET", path, nil))
+				if recorder.Code != want {
+					t.Errorf("%s: got %d, want %d", path, recorder.Code, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamHealthFollowsTheStream(t *testing.T) {
+	session, _ := newTestSession(t, fixedStream(`{"type":"HEARTBEAT"}`))
+	session.Health = &StreamHealth{StaleAfter: time.Minute}
+
+	ready := []bool{}
+	err := streamLines(session, "http://stream/v3/accounts/1/pricing/stream", &StreamOptions{}, func(line []byte) (bool, error) {
+		ready = append(ready, session.Health.Ready() && session.Health.Live())
+		return true, nil
+	})
+	if err == nil {
+		t.Fatal("the stream did not end")
+	}
+	if len(ready) != 1 || !ready[0] {
+		t.Errorf("got %v while streaming, want ready and live", ready)
+	}
+	if session.Health.Ready() {
+		t.Error("still ready after the stream ended")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TradingHours is a daily window such as 08:00-16:00 in a given time zone.
+// A window whose end is before its start crosses midnight.
+type TradingHours struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// ParseTradingHours parses a "HH:MM-HH:MM" window, in UTC when timezone is empty.
+func ParseTradingHours(spec string, timezone string) (*TradingHours, error) {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid session %q, expected HH:MM-HH:MM", spec)
+	}
+
+	hours := TradingHours{Location: time.UTC}
+	for i, bound := range []*time.Duration{&hours.Start, &hours.End} {
+		clock, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid session %q, expected HH:MM-HH:MM", spec)
+		}
+		*bound = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+	}
+	if hours.Start == hours.End {
+		return nil, fmt.Errorf("invalid session %q, start and end are equal", spec)
+	}
+
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		hours.Location = location
+	}
+
+	return &hours, nil
+}
+
+// Contains reports whether t falls within the window, start inclusive and end exclusive.
+func (self *TradingHours) Contains(t time.Time) bool {
+	local := t.In(self.Location)
+	clock := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+
+	if self.Start < self.End {
+		return clock >= self.Start && clock < self.End
+	}
+	return clock >= self.Start || clock < self.End
+}
+
+// TradingDate labels daily and weekly candles with the date they close on in
+// the alignment time zone, e.g. a D candle opening Monday 17:00 New York time
+// trades as Tuesday.
+type TradingDate struct {
+	Days     int
+	Location *time.Location
+}
+
+// NewTradingDate is the labelling for granularity D or W, with the candles
+// aligned in timezone.
+func NewTradingDate(granularity string, timezone string) (*TradingDate, error) {
+	days := map[string]int{"D": 1, "W": 7}[granularity]
+	if days == 0 {
+		return nil, fmt.Errorf("trading dates need granularity D or W, not %s", granularity)
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &TradingDate{Days: days, Location: location}, nil
+}
+
+// Label is the trading date of the candle opening at t. The period is added
+// in calendar days, so that a candle spanning a DST change is still labelled
+// by the day it closes on.
+func (self *TradingDate) Label(t time.Time) string {
+	return t.In(self.Location).AddDate(0, 0, self.Days).Add(-time.Nanosecond).Format("2006-01-02")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTradingHours(t *testing.T) {
+	tests := []struct {
+		spec     string
+		timezone string
+		valid    bool
+	}{
+		{"08:00-16:00", "", true},
+		{"22:00-06:00", "Asia/Tokyo", true},
+		{" 08:00 - 16:30 ", "", true},
+		{"08:00", "", false},
+		{"08:00-16:00-18:00", "", false},
+		{"8am-4pm", "", false},
+		{"25:00-16:00", "", false},
+		{"08:00-08:00", "", false},
+		{"08:00-16:00", "Nowhere/City", false},
+	}
+	for _, test := range tests {
+		_, err := ParseTradingHours(test.spec, test.timezone)
+		if test.valid && err != nil {
+			t.Errorf("%q in %q: unexpected error %s", test.spec, test.timezone, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q in %q: expected an error", test.spec, test.timezone)
+		}
+	}
+}
+
+func TestTradingHoursContains(t *testing.T) {
+	tests := []struct {
+		spec     string
+		timezone string
+		time     string
+		want     bool
+	}{
+		{"08:00-16:00", "", "2021-03-01T08:00:00Z", true},
+		{"08:00-16:00", "", "2021-03-01T15:59:59Z", true},
+		{"08:00-16:00", "", "2021-03-01T16:00:00Z", false},
+		{"08:00-16:00", "", "2021-03-01T07:59:59Z", false},
+		// Crossing midnight.
+		{"22:00-06:00", "", "2021-03-01T23:00:00Z", true},
+		{"22:00-06:00", "", "2021-03-01T05:00:00Z", true},
+		{"22:00-06:00", "", "2021-03-01T12:00:00Z", false},
+		// 08:00 in Tokyo is 23:00 UTC the day before.
+		{"08:00-16:00", "Asia/Tokyo", "2021-02-28T23:00:00Z", true},
+		{"08:00-16:00", "Asia/Tokyo", "2021-03-01T08:00:00Z", false},
+	}
+	for _, test := range tests {
+		hours, err := ParseTradingHours(test.spec, test.timezone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, err := time.Parse(time.RFC3339, test.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hours.Contains(at); got != test.want {
+			t.Errorf("%s in %q at %s: got %v, want %v", test.spec, test.timezone, test.time, got, test.want)
+		}
+	}
+}
+
+func TestTradingDateLabel(t *testing.T) {
+	tests := []struct {
+		granularity string
+		open        string
+		want        string
+	}{
+		// Monday 17:00 New York opens Tuesday's daily candle.
+		{"D", "2021-03-01T22:00:00Z", "2021-03-02"},
+		// Across the change to daylight saving time on 2021-03-14.
+		{"D", "2021-03-13T22:00:00Z", "2021-03-14"},
+		{"D", "2021-03-14T21:00:00Z", "2021-03-15"},
+		// Friday 17:00 opens the week closing the next Friday.
+		{"W", "2021-02-26T22:00:00Z", "2021-03-05"},
+	}
+	for _, test := range tests {
+		date, err := NewTradingDate(test.granularity, defaultAlignmentTimezone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		open, err := time.Parse(time.RFC3339, test.open)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := date.Label(open); got != test.want {
+			t.Errorf("%s candle opening %s: got %s, want %s", test.granularity, test.open, got, test.want)
+		}
+	}
+
+	if _, err := NewTradingDate("H1", defaultAlignmentTimezone); err == nil {
+		t.Error("expected an error for granularity H1")
+	}
+}
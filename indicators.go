@@ -0,0 +1,85 @@
+package main
+
+import "strconv"
+
+// MovingAverage is a simple moving average of the closes of the last Period
+// completed candles.
+type MovingAverage struct {
+	Period int
+	closes []float64
+}
+
+// Next returns the average for candle, nil until Period closes are known. A
+// completed candle joins the window; a forming candle is averaged with the
+// last Period-1 completed ones without joining it.
+func (self *MovingAverage) Next(candle *Candlestick) *float64 {
+	data := candle.Prices()
+	if data == nil {
+		return nil
+	}
+	last, err := strconv.ParseFloat(data.C, 64)
+	if err != nil {
+		return nil
+	}
+
+	window := append([]float64{}, self.closes...)
+	window = append(window, last)
+	if len(window) > self.Period {
+		window = window[len(window)-self.Period:]
+	}
+	if candle.Complete {
+		self.closes = window
+	}
+	if len(window) < self.Period {
+		return nil
+	}
+
+	sum := 0.0
+	for _, value := range window {
+		sum += value
+	}
+	average := sum / float64(self.Period)
+	return &average
+}
+
+// VWAP is the volume weighted average of the typical prices of the last
+// Period completed candles.
+type VWAP struct {
+	Period   int
+	typicals []float64
+	volumes  []float64
+}
+
+// Next returns the VWAP for candle, nil until Period candles are known or
+// while they have no volume. Like MovingAverage, a forming candle is
+// weighted in without joining the window.
+func (self *VWAP) Next(candle *Candlestick) *float64 {
+	typical, ok := candle.Typical()
+	if !ok {
+		return nil
+	}
+
+	typicals := append(append([]float64{}, self.typicals...), typical)
+	volumes := append(append([]float64{}, self.volumes...), float64(candle.Volume))
+	if len(typicals) > self.Period {
+		typicals = typicals[len(typicals)-self.Period:]
+		volumes = volumes[len(volumes)-self.Period:]
+	}
+	if candle.Complete {
+		self.typicals, self.volumes = typicals, volumes
+	}
+	if len(typicals) < self.Period {
+		return nil
+	}
+
+	weighted, volume := 0.0, 0.0
+	for i := range typicals {
+		weighted += typicals[i] * volumes[i]
+		volume += volumes[i]
+	}
+	if volume == 0 {
+		return nil
+	}
+	vwap := weighted / volume
+	return &vwap
+}
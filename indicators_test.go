@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestMovingAverage(t *testing.T) {
+	type step struct {
+		close    string
+		complete bool
+		want     *float64
+	}
+	value := func(v float64) *float64 { return &v }
+	steps := []step{
+		{"1", true, nil},
+		{"2", true, nil},
+		{"3", true, value(2)},
+		// A forming candle is averaged in without joining the window.
+		{"6", false, value(11.0 / 3)},
+		{"9", false, value(14.0 / 3)},
+		{"4", true, value(3)},
+		{"5", true, value(4)},
+		// Candles without a numeric close are skipped.
+		{"", true, nil},
+		{"6", true, value(5)},
+	}
+
+	average := MovingAverage{Period: 3}
+	for i, step := range steps {
+		got := average.Next(testCandle(step.close, step.close, step.close, 0, step.complete))
+		if (got == nil) != (step.want == nil) || got != nil && !approx(*got, *step.want) {
+			t.Errorf("step %d: got %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestVWAP(t *testing.T) {
+	type step struct {
+		candle *Candlestick
+		want   *float64
+	}
+	value := func(v float64) *float64 { return &v }
+	steps := []step{
+		// Typical prices 2, 4 and 6.
+		{testCandle("3", "1", "2", 1, true), nil},
+		{testCandle("5", "3", "4", 3, true), value((2*1 + 4*3) / 4.0)},
+		// A forming candle is weighted in without joining the window.
+		{testCandle("7", "5", "6", 4, false), value((4*3 + 6*4) / 7.0)},
+		{testCandle("7", "5", "6", 2, true), value((4*3 + 6*2) / 5.0)},
+		// No volume, no average.
+		{testCandle("7", "5", "6", 0, true), value(6)},
+		{testCandle("7", "5", "6", 0, true), nil},
+	}
+
+	vwap := VWAP{Period: 2}
+	for i, step := range steps {
+		got := vwap.Next(step.candle)
+		if (got == nil) != (step.want == nil) || got != nil && !approx(*got, *step.want) {
+			t.Errorf("step %d: got %v, want %v", i, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type AccountInstrumentsResponseBody struct {
+	Instruments []Instrument `json:"instruments"`
+}
+
+type Instrument struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	DisplayName string `json:"displayName"`
+}
+
+// getAccountInstruments lists the instruments the account can trade.
+func getAccountInstruments(session *Session) ([]Instrument, error) {
+	account := session.Credentials.Default
+
+	baseUrl := account.ApiUrl()
+	url := fmt.Sprintf("%s/v3/accounts/%s/instruments", baseUrl, account.AccountId)
+
+	bytes, _, err := session.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var body AccountInstrumentsResponseBody
+	if err := json.Unmarshal(bytes, &body); err != nil {
+		return nil, err
+	}
+
+	return body.Instruments, nil
+}
+
+// getTradeableInstrumentNames lists the names of the instruments the account
+// can trade, failing rather than returning none, which a stream would reject
+// as a malformed query.
+func getTradeableInstrumentNames(session *Session) ([]string, error) {
+	instruments, err := getAccountInstruments(session)
+	if err != nil {
+		return nil, err
+	}
+	if len(instruments) == 0 {
+		return nil, fmt.Errorf("account %s has no tradeable instruments", session.Credentials.Default.AccountId)
+	}
+
+	names := []string{}
+	for _, instrument := range instruments {
+		names = append(names, instrument.Name)
+	}
+	return names, nil
+}
+
+// assertTradeable fails listing every requested instrument the account cannot
+// trade, with suggestions for likely typos.
+func assertTradeable(session *Session, requested []string) error {
+	instruments, err := getAccountInstruments(session)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, instrument := range instruments {
+		names = append(names, instrument.Name)
+	}
+
+	problems := []string{}
+	for _, name := range requested {
+		if containsString(names, name) {
+			continue
+		}
+		problem := name
+		if suggestions := suggestInstruments(name, names); len(suggestions) != 0 {
+			problem += fmt.Sprintf(" (did you mean %s?)", strings.Join(suggestions, ", "))
+		}
+		problems = append(problems, problem)
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("not tradeable on this account: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// suggestInstruments finds names within a small edit distance of name, or
+// with the currencies swapped (USD_EUR for EUR_USD).
+func suggestInstruments(name string, names []string) []string {
+	name = strings.ToUpper(name)
+
+	swapped := ""
+	if parts := strings.Split(name, "_"); len(parts) == 2 {
+		swapped = parts[1] + "_" + parts[0]
+	}
+
+	suggestions := []string{}
+	for _, candidate := range names {
+		if candidate == name || candidate == swapped || editDistance(name, candidate) <= 2 {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	sort.Strings(suggestions)
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
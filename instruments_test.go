@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// accountInstruments serves the instruments of the test account.
+func accountInstruments(t *testing.T, names ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/accounts/101-001-0000000-001/instruments" {
+			t.Errorf("requested %s", r.URL.Path)
+		}
+		instruments := []string{}
+		for _, name := range names {
+			instruments = append(instruments, `{"name":"`+name+`","type":"CURRENCY"}`)
+		}
+		w.Write([]byte(`{"instruments":[` + strings.Join(instruments, ",") + `]}`))
+	})
+}
+
+func TestAssertTradeable(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		err       string
+	}{
+		{"tradeable", []string{"EUR_USD", "USD_JPY"}, ""},
+		{"typo", []string{"EUR_USD", "EUR_UDS"}, "not tradeable on this account: EUR_UDS (did you mean EUR_USD?)"},
+		{"swapped", []string{"JPY_USD"}, "JPY_USD (did you mean USD_JPY?)"},
+		{"no suggestion", []string{"XAU_USD", "BCO_USD"}, "not tradeable on this account: XAU_USD; BCO_USD"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, _ := newTestSession(t, accountInstruments(t, "EUR_USD", "USD_JPY", "GBP_USD"))
+			err := assertTradeable(session, test.requested)
+			if test.err == "" {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestTradeableInstrumentNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruments []string
+		want        []string
+		err         string
+	}{
+		{"listed", []string{"EUR_USD", "USD_JPY"}, []string{"EUR_USD", "USD_JPY"}, ""},
+		{"none", nil, nil, "account 101-001-0000000-001 has no tradeable instruments"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, _ := newTestSession(t, accountInstruments(t, test.instruments...))
+			names, err := getTradeableInstrumentNames(session)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got %v, %v, want error %q", names, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("got %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestSuggestInstruments(t *testing.T) {
+	names := []string{"EUR_USD", "EUR_GBP", "USD_JPY", "GBP_USD"}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"eur_usd", []string{"EUR_USD"}},
+		{"EUR_UDS", []string{"EUR_USD"}},
+		{"USD_EUR", []string{"EUR_USD"}},
+		{"EUR_GPB", []string{"EUR_GBP"}},
+		{"EUR_US", []string{"EUR_USD"}},
+		{"XAU_USD", []string{}},
+	}
+	for _, test := range tests {
+		if got := suggestInstruments(test.name, names); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"EUR_USD", "EUR_USD", 0},
+		{"EUR_USD", "EUR_UDS", 2},
+		{"EUR_USD", "EUR_US", 1},
+		{"", "USD", 3},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("%q %q: got %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
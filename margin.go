@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+)
+
+type AccountSummaryResponseBody struct {
+	Account AccountSummary `json:"account"`
+}
+
+// AccountSummary holds the fields of the account summary used here. OANDA
+// sends decimal numbers as strings.
+type AccountSummary struct {
+	Id            string `json:"id"`
+	Currency      string `json:"currency"`
+	MarginRate    string `json:"marginRate"`
+	NAV           string `json:"NAV"`
+	PositionValue string `json:"positionValue"`
+	MarginUsed    string `json:"marginUsed"`
+}
+
+// MarginResult is the margin rate together with the leverage it allows and
+// the leverage actually in use.
+type MarginResult struct {
+	AccountId         string  `json:"account_id"`
+	Currency          string  `json:"currency"`
+	MarginRate        float64 `json:"margin_rate"`
+	MaxLeverage       float64 `json:"max_leverage"`
+	EffectiveLeverage float64 `json:"effective_leverage"`
+	MarginUsed        float64 `json:"margin_used"`
+}
+
+func marginAction(c *cli.Context) error {
+	session, err := NewProfileSession(c.String("config"), c.String("profile"))
+	if err != nil {
+		return err
+	}
+
+	err = watch(session, c.Duration("watch"), func() error {
+		summary, err := getAccountSummary(session)
+		if err != nil {
+			return err
+		}
+
+		result, err := computeMargin(summary)
+		if err != nil {
+			return err
+		}
+
+		bytes, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		return session.Output.Println(string(bytes))
+	})
+
+	return err
+}
+
+func getAccountSummary(session *Session) (*AccountSummary, error) {
+	account := session.Credentials.Default
+
+	baseUrl := account.ApiUrl()
+	url := fmt.Sprintf("%s/v3/accounts/%s/summary", baseUrl, account.AccountId)
+
+	bytes, _, err := session.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var body AccountSummaryResponseBody
+	if err := json.Unmarshal(bytes, &body); err != nil {
+		return nil, err
+	}
+
+	return &body.Account, nil
+}
+
+// computeMargin derives the maximum leverage as the inverse of the margin
+// rate, and the effective leverage as the open position value over the NAV.
+func computeMargin(summary *AccountSummary) (*MarginResult, error) {
+	values := map[string]float64{}
+	for name, value := range map[string]string{
+		"marginRate":    summary.MarginRate,
+		"NAV":           summary.NAV,
+		"positionValue": summary.PositionValue,
+		"marginUsed":    summary.MarginUsed,
+	} {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("account summary: invalid %s %q", name, value)
+		}
+		values[name] = parsed
+	}
+
+	result := MarginResult{
+		AccountId:  summary.Id,
+		Currency:   summary.Currency,
+		MarginRate: values["marginRate"],
+		MarginUsed: values["marginUsed"],
+	}
+	if result.MarginRate != 0 {
+		result.MaxLeverage = 1 / result.MarginRate
+	}
+	if values["NAV"] != 0 {
+		result.EffectiveLeverage = values["positionValue"] / values["NAV"]
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestComputeMargin(t *testing.T) {
+	tests := []struct {
+		name      string
+		summary   AccountSummary
+		max       float64
+		effective float64
+		err       string
+	}{
+		{"open positions", AccountSummary{MarginRate: "0.05", NAV: "10000", PositionValue: "50000", MarginUsed: "2500"}, 20, 5, ""},
+		{"flat", AccountSummary{MarginRate: "0.02", NAV: "10000", PositionValue: "0", MarginUsed: "0"}, 50, 0, ""},
+		{"no margin rate", AccountSummary{MarginRate: "0", NAV: "0", PositionValue: "0", MarginUsed: "0"}, 0, 0, ""},
+		{"invalid", AccountSummary{MarginRate: "", NAV: "10000", PositionValue: "0", MarginUsed: "0"}, 0, 0, `invalid marginRate ""`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := computeMargin(&test.summary)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !approx(result.MaxLeverage, test.max) || !approx(result.EffectiveLeverage, test.effective) {
+				t.Errorf("got leverage %v and %v, want %v and %v", result.MaxLeverage, result.EffectiveLeverage, test.max, test.effective)
+			}
+		})
+	}
+}
+
+func TestGetAccountSummary(t *testing.T) {
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/accounts/101-001-0000000-001/summary" {
+			t.Errorf("requested %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"account":{"id":"101-001-0000000-001","currency":"USD","marginRate":"0.05","NAV":"10000.0000","positionValue":"25000.0000","marginUsed":"1250.0000","balance":"9900.0000"},"lastTransactionID":"7"}`))
+	}))
+	summary, err := getAccountSummary(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := computeMargin(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MarginResult{AccountId: "101-001-0000000-001", Currency: "USD", MarginRate: 0.05, MaxLeverage: 20, EffectiveLeverage: 2.5, MarginUsed: 1250}
+	if *result != want {
+		t.Errorf("got %+v, want %+v", *result, want)
+	}
+}
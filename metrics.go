@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StreamMetrics counts what the streams of a session receive, for
+// --metrics-addr. Messages are tallied by type like --count-only does, and
+// by shard when a subscription is split over several streams.
+type StreamMetrics struct {
+	Messages    *MessageCounts
+	mutex       sync.Mutex
+	heartbeats  int64
+	reconnects  int64
+	bytes       int64
+	lastMessage time.Time
+	shards      map[string]*ShardCounts
+}
+
+// ShardCounts are the lines received by one shard of a subscription.
+type ShardCounts struct {
+	Messages   int64
+	Heartbeats int64
+}
+
+func NewStreamMetrics() *StreamMetrics {
+	return &StreamMetrics{Messages: NewMessageCounts(), shards: map[string]*ShardCounts{}}
+}
+
+// Line records a line read from a stream, by the given shard unless empty.
+func (self *StreamMetrics) Line(shard string, line []byte, heartbeat bool) {
+	if !heartbeat {
+		// A line which is not JSON is still counted in bytes_total.
+		self.Messages.Add(string(line))
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.bytes += int64(len(line)) + 1
+	if heartbeat {
+		self.heartbeats++
+	} else {
+		self.lastMessage = time.Now()
+	}
+
+	if shard == "" {
+		return
+	}
+	counts, ok := self.shards[shard]
+	if !ok {
+		counts = &ShardCounts{}
+		self.shards[shard] = counts
+	}
+	if heartbeat {
+		counts.Heartbeats++
+	} else {
+		counts.Messages++
+	}
+}
+
+func (self *StreamMetrics) Reconnect() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.reconnects++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (self *StreamMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.Messages.mutex.Lock()
+	types := []string{}
+	byType := map[string]int{}
+	for messageType, count := range self.Messages.ByType {
+		types = append(types, messageType)
+		byType[messageType] = count
+	}
+	self.Messages.mutex.Unlock()
+	sort.Strings(types)
+
+	self.mutex.Lock()
+	heartbeats, reconnects, bytes, lastMessage := self.heartbeats, self.reconnects, self.bytes, self.lastMessage
+	shards := []string{}
+	byShard := map[string]ShardCounts{}
+	for shard, counts := range self.shards {
+		shards = append(shards, shard)
+		byShard[shard] = *counts
+	}
+	self.mutex.Unlock()
+	sort.Strings(shards)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP oanda_messages_total Data messages received, by type.")
+	fmt.Fprintln(w, "# TYPE oanda_messages_total counter")
+	for _, messageType := range types {
+		fmt.Fprintf(w, "oanda_messages_total{type=%q} %d\n", messageType, byType[messageType])
+	}
+	fmt.Fprintln(w, "# HELP oanda_heartbeats_total Heartbeats received.")
+	fmt.Fprintln(w, "# TYPE oanda_heartbeats_total counter")
+	fmt.Fprintf(w, "oanda_heartbeats_total %d\n", heartbeats)
+	fmt.Fprintln(w, "# HELP oanda_reconnects_total Reconnects after a stream error.")
+	fmt.Fprintln(w, "# TYPE oanda_reconnects_total counter")
+	fmt.Fprintf(w, "oanda_reconnects_total %d\n", reconnects)
+	fmt.Fprintln(w, "# HELP oanda_bytes_total Bytes read from the streams.")
+	fmt.Fprintln(w, "# TYPE oanda_bytes_total counter")
+	fmt.Fprintf(w, "oanda_bytes_total %d\n", bytes)
+	fmt.Fprintln(w, "# HELP oanda_last_message_timestamp_seconds Unix time of the last data message.")
+	fmt.Fprintln(w, "# TYPE oanda_last_message_timestamp_seconds gauge")
+	if lastMessage.IsZero() {
+		fmt.Fprintln(w, "oanda_last_message_timestamp_seconds 0")
+	} else {
+		fmt.Fprintf(w, "oanda_last_message_timestamp_seconds %.3f\n", float64(lastMessage.UnixNano())/float64(time.Second))
+	}
+	if len(shards) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "# HELP oanda_shard_messages_total Data messages received, by shard of the subscription.")
+	fmt.Fprintln(w, "# TYPE oanda_shard_messages_total counter")
+	for _, shard := range shards {
+		fmt.Fprintf(w, "oanda_shard_messages_total{shard=%q} %d\n", shard, byShard[shard].Messages)
+	}
+	fmt.Fprintln(w, "# HELP oanda_shard_heartbeats_total Heartbeats received, by shard of the subscription.")
+	fmt.Fprintln(w, "# TYPE oanda_shard_heartbeats_total counter")
+	for _, shard := range shards {
+		fmt.Fprintf(w, "oanda_shard_heartbeats_total{shard=%q} %d\n", shard, byShard[shard].Heartbeats)
+	}
+}
+
+// ServeMetrics starts an HTTP server on addr exposing /metrics, which is shut
+// down with the session context.
+func (self *Session) ServeMetrics(addr string) error {
+	metrics := NewStreamMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	if err := serveHTTP(self, addr, mux); err != nil {
+		return err
+	}
+
+	self.Metrics = metrics
+	return nil
+}
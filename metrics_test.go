@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamMetricsScrape(t *testing.T) {
+	price := `{"type":"PRICE","instrument":"EUR_USD"}`
+	heartbeat := `{"type":"HEARTBEAT"}`
+	tests := []struct {
+		name  string
+		shard string
+		lines []string
+		want  []string
+		not   []string
+	}{
+		{
+			"prices and heartbeats", "", []string{price, heartbeat, price, heartbeat, heartbeat},
+			[]string{
+				`oanda_messages_total{type="PRICE"} 2`,
+				"oanda_heartbeats_total 3",
+				"oanda_reconnects_total 0",
+				"oanda_bytes_total 143",
+			},
+			[]string{"oanda_last_message_timestamp_seconds 0\n", "oanda_shard_"},
+		},
+		{
+			"heartbeats only", "", []string{heartbeat},
+			[]string{"oanda_heartbeats_total 1", "oanda_last_message_timestamp_seconds 0\n"},
+			[]string{"oanda_messages_total{"},
+		},
+		{
+			"sharded", "2", []string{price, heartbeat},
+			[]string{`oanda_shard_messages_total{shard="2"} 1`, `oanda_shard_heartbeats_total{shard="2"} 1`},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, _ := newTestSession(t, fixedStream(test.lines...))
+			session.Metrics = NewStreamMetrics()
+			session.Shard = test.shard
+			if err := getStream(session, &PricingOptions{Heartbeat: true}); err != io.EOF {
+				t.Fatalf("the stream ended with %v", err)
+			}
+
+			recorder := httptest.NewRecorder()
+			session.Metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			body := recorder.Body.String()
+			for _, want := range test.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("scrape lacks %q:\n%s", want, body)
+				}
+			}
+			for _, not := range test.not {
+				if strings.Contains(body, not) {
+					t.Errorf("scrape has %q:\n%s", not, body)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamMetricsReconnects(t *testing.T) {
+	session, _ := newTestSession(t, droppingStream(3))
+	session.Metrics = NewStreamMetrics()
+	captureStderr(t, func() {
+		readStream(t, session, &StreamOptions{ReconnectOnAnyError: true, MaxRetries: 5}, 3)
+	})
+
+	recorder := httptest.NewRecorder()
+	session.Metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if body := recorder.Body.String(); !strings.Contains(body, "oanda_reconnects_total 2\n") {
+		t.Errorf("got\n%s", body)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !plan9
+// +build !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnectionRefused reports whether the other side refused the connection.
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// isConnectionReset reports whether the other side dropped the connection.
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,24 @@
+//go:build plan9
+// +build plan9
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Plan 9 has no errno, so the errors are recognized by their message.
+
+// isConnectionRefused reports whether the other side refused the connection.
+func isConnectionRefused(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Err != nil && strings.Contains(opErr.Err.Error(), "refused")
+}
+
+// isConnectionReset reports whether the other side dropped the connection.
+func isConnectionReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Err != nil && strings.Contains(opErr.Err.Error(), "reset")
+}
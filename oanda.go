@@ -1,42 +1,269 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v2"
 )
 
+// Credentials is the credentials file. Besides default, it may hold further
+// named profiles, such as a live account next to a practice one:
+//
+//	default:
+//	  account_id: 101-001-0000000-001
+//	  token: ...
+//	live:
+//	  account_id: 001-001-0000000-001
+//	  token: ...
+//	  environment: live
 type Credentials struct {
-	Default struct {
-		AccountId string `yaml:"account_id"`
-		Token     string `yaml:"token"`
+	Default  Account
+	Profiles map[string]Account `yaml:",inline"`
+}
+
+const defaultProfile = "default"
+
+type Account struct {
+	AccountId   string `yaml:"account_id"`
+	Token       string `yaml:"token"`
+	Environment string `yaml:"environment"`
+	// DefaultPrice is the candle price component used when --price is not given.
+	DefaultPrice string `yaml:"default_price"`
+}
+
+const (
+	practiceApiUrl    = "https://api-fxpractice.oanda.com"
+	practiceStreamUrl = "https://stream-fxpractice.oanda.com"
+	liveApiUrl        = "https://api-fxtrade.oanda.com"
+	liveStreamUrl     = "https://stream-fxtrade.oanda.com"
+)
+
+// ApiUrl is the REST endpoint of the account's environment.
+func (self *Account) ApiUrl() string {
+	if self.Environment == "live" {
+		return liveApiUrl
 	}
+	return practiceApiUrl
 }
 
-func GetCredentials(path string) (*Credentials, error) {
-	bytes, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+// StreamUrl is the streaming endpoint of the account's environment.
+func (self *Account) StreamUrl() string {
+	if self.Environment == "live" {
+		return liveStreamUrl
 	}
+	return practiceStreamUrl
+}
 
+// GetCredentials reads the credentials file and makes the given profile the
+// default, then lets OANDA_TOKEN, OANDA_ACCOUNT_ID and OANDA_ENV override it.
+// The file may be missing when OANDA_TOKEN is set.
+func GetCredentials(path string, profile string) (*Credentials, error) {
 	credentials := Credentials{}
-	err = yaml.Unmarshal(bytes, &credentials)
-	if err != nil {
+
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && os.Getenv("OANDA_TOKEN") == "" {
+		return nil, &MissingConfigError{Path: path}
+	}
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
+	if err == nil {
+		err = unmarshalConfig(bytes, &credentials)
+		if err == nil && strictConfig {
+			err = credentials.ValidateProfiles()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed credentials file: %w\n%s", path, err, credentialsHint)
+		}
+	}
+
+	if profile != "" && profile != defaultProfile {
+		account, ok := credentials.Profiles[profile]
+		if !ok && os.Getenv("OANDA_TOKEN") == "" {
+			return nil, fmt.Errorf("profile %q not found in %s", profile, path)
+		}
+		credentials.Default = account
+	}
+
+	account := &credentials.Default
+	if token := os.Getenv("OANDA_TOKEN"); token != "" {
+		account.Token = token
+	}
+	if accountId := os.Getenv("OANDA_ACCOUNT_ID"); accountId != "" {
+		account.AccountId = accountId
+	}
+	if environment := os.Getenv("OANDA_ENV"); environment != "" {
+		account.Environment = environment
+	}
+	if account.Environment != "" && account.Environment != "practice" && account.Environment != "live" {
+		return nil, fmt.Errorf("unknown environment %q, expected practice or live", account.Environment)
+	}
 
 	return &credentials, nil
 }
 
+// ValidateProfiles checks the profiles besides the default one. Since every
+// other top-level key is a profile, a misspelt key is a profile too, which
+// --strict-config would not notice: a profile must have a token and an
+// account id, and must not be named like the default profile.
+func (self *Credentials) ValidateProfiles() error {
+	names := []string{}
+	for name := range self.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if isLookalike(name, defaultProfile) {
+			return fmt.Errorf("profile %q looks like a misspelling of %q", name, defaultProfile)
+		}
+		account := self.Profiles[name]
+		if account.Token == "" || account.AccountId == "" {
+			return fmt.Errorf("profile %q needs both token and account_id", name)
+		}
+	}
+	return nil
+}
+
+// isLookalike reports whether a differs from b, ignoring case, by at most two
+// inserted, deleted, replaced or swapped letters.
+func isLookalike(a string, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if a == b {
+		return true
+	}
+
+	// Optimal string alignment distance.
+	distance := make([][]int, len(a)+1)
+	for i := range distance {
+		distance[i] = make([]int, len(b)+1)
+		distance[i][0] = i
+	}
+	for j := range distance[0] {
+		distance[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := distance[i-1][j-1] + cost
+			if distance[i-1][j]+1 < d {
+				d = distance[i-1][j] + 1
+			}
+			if distance[i][j-1]+1 < d {
+				d = distance[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && distance[i-2][j-2]+1 < d {
+				d = distance[i-2][j-2] + 1
+			}
+			distance[i][j] = d
+		}
+	}
+	return distance[len(a)][len(b)] <= 2
+}
+
+// strictConfig rejects unknown keys in the credentials file and batch specs (--strict-config).
+var strictConfig bool
+
+// unmarshalConfig decodes a YAML configuration file, strictly under --strict-config.
+func unmarshalConfig(bytes []byte, out interface{}) error {
+	if strictConfig {
+		return yaml.UnmarshalStrict(bytes, out)
+	}
+	return yaml.Unmarshal(bytes, out)
+}
+
+const credentialsHint = `expected a profile per top-level key, for example:
+
+  default:
+    account_id: 101-001-0000000-001
+    token: 0123456789abcdef-0123456789abcdef
+    environment: practice`
+
+// exitCodeCredentials is the exit status when no credentials are found.
+const exitCodeCredentials = 3
+
+// MissingConfigError is a credentials file which does not exist while no
+// token is given by the environment either, typically on first use.
+type MissingConfigError struct {
+	Path string
+}
+
+func (self *MissingConfigError) Error() string {
+	return fmt.Sprintf("credentials file %s not found; create it (or pass --config, or set OANDA_CREDENTIALS_PATH), or set OANDA_TOKEN and OANDA_ACCOUNT_ID instead\n%s", self.Path, credentialsHint)
+}
+
+// Validate fails when a field every request needs is empty. The account id
+// is not needed to list the accounts of a token.
+func (self *Account) Validate(path string, profile string, requireAccountId bool) error {
+	missing := []string{}
+	if requireAccountId && self.AccountId == "" {
+		missing = append(missing, "account_id")
+	}
+	if self.Token == "" {
+		missing = append(missing, "token")
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("%s: missing required field %s in profile %s (or set OANDA_ACCOUNT_ID/OANDA_TOKEN)\n%s", path, strings.Join(missing, " and "), profile, credentialsHint)
+	}
+	return nil
+}
+
+// LoadEnvFile sets the KEY=VALUE pairs of a .env file as environment
+// variables. Variables which are already set are left alone, and blank lines,
+// comments and an optional "export " prefix are accepted.
+func LoadEnvFile(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func GetDefaultConfigPath() (*string, error) {
 	path := os.Getenv("OANDA_CREDENTIALS_PATH")
 	if path != "" {
@@ -52,7 +279,302 @@ func GetDefaultConfigPath() (*string, error) {
 	}
 }
 
+// Session holds everything a command needs to talk to OANDA, so that
+// several commands in one invocation can share a single credentials load
+// and HTTP client.
+type Session struct {
+	Context     context.Context
+	Credentials *Credentials
+	// ConfigPath and Profile are where Credentials were read from, for
+	// ReloadCredentials.
+	ConfigPath    string
+	Profile       string
+	Client        *http.Client
+	Output        *Output
+	ShowRateLimit bool
+	// Headers are extra headers sent with every request (--header).
+	Headers http.Header
+	// Health, when set, is told about the state of the streams (--health-addr).
+	Health *StreamHealth
+	// Metrics, when set, counts what the streams receive (--metrics-addr).
+	Metrics *StreamMetrics
+	// Shard names the part of a subscription split over several streams
+	// which the session reads (--limit-instruments-per-stream).
+	Shard string
+	// now is the local clock, time.Now unless replaced.
+	now func() time.Time
+	// AccountId is --account-id, which replaces the account of Profile
+	// only, not of the other profiles the session is used with.
+	AccountId string
+}
+
+// Now is the local time.
+func (self *Session) Now() time.Time {
+	if self.now == nil {
+		return time.Now()
+	}
+	return self.now()
+}
+
+// requestHeaders are the --header values, parsed before any command runs.
+var requestHeaders = http.Header{}
+
+// showRateLimit is the global --show-rate-limit.
+var showRateLimit bool
+
+// accountIdOverride is --account-id, given globally or after the command.
+var accountIdOverride string
+
+// accountIdFlag is --account-id after a command which takes --profile.
+func accountIdFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "account-id",
+		Usage: "Use this account with the token of the profile, overriding OANDA_ACCOUNT_ID",
+	}
+}
+
+// accountIdBefore picks up --account-id given after the command.
+func accountIdBefore(c *cli.Context) error {
+	if accountId := c.String("account-id"); accountId != "" {
+		accountIdOverride = accountId
+	}
+	return nil
+}
+
+// ParseHeaders parses "Key: Value" headers. Authorization and Content-Type
+// are set by the session itself and cannot be overridden.
+func ParseHeaders(values []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, value := range values {
+		colon := strings.Index(value, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("invalid header %q, expected \"Key: Value\"", value)
+		}
+		key := strings.TrimSpace(value[:colon])
+		if strings.EqualFold(key, "Authorization") || strings.EqualFold(key, "Content-Type") {
+			return nil, fmt.Errorf("header %s cannot be overridden", key)
+		}
+		headers.Add(key, strings.TrimSpace(value[colon+1:]))
+	}
+	return headers, nil
+}
+
+// NewRequest builds an authenticated GET request carrying the extra headers.
+func (self *Session) NewRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range self.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", self.Credentials.Default.Token))
+	return req, nil
+}
+
+func NewSession(configPath string) (*Session, error) {
+	return NewProfileSession(configPath, defaultProfile)
+}
+
+// NewProfileSession is NewSession using the named profile of the credentials file.
+func NewProfileSession(configPath string, profile string) (*Session, error) {
+	return newSession(configPath, profile, true)
+}
+
+func newSession(configPath string, profile string, requireAccountId bool) (*Session, error) {
+	credentials, err := GetCredentials(configPath, profile)
+	if err != nil {
+		return nil, err
+	}
+	if accountIdOverride != "" {
+		credentials.Default.AccountId = accountIdOverride
+	}
+	if err := credentials.Default.Validate(configPath, profile, requireAccountId); err != nil {
+		return nil, err
+	}
+
+	session := Session{
+		Context:     context.Background(),
+		Credentials: credentials,
+		ConfigPath:  configPath,
+		Profile:     profile,
+		Client:      new(http.Client),
+		Output:      &Output{Writer: &LockedWriter{Writer: os.Stdout}},
+		Headers:     requestHeaders,
+
+		ShowRateLimit: showRateLimit,
+		AccountId:     accountIdOverride,
+	}
+	return &session, nil
+}
+
+// CancelOnSignal cancels the session's context on SIGINT or SIGTERM, so that
+// a streaming command stops like on --deadline and flushes its output instead
+// of being killed mid-write. A second signal kills the process as usual. Only
+// commands which stop on a done context install it; a one-shot command, or
+// one blocked on stdin, keeps the default of exiting on the first signal. The
+// returned function removes the trap and must always be called.
+func (self *Session) CancelOnSignal() context.CancelFunc {
+	ctx, cancel := context.WithCancel(self.Context)
+	self.Context = ctx
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// SetDeadline bounds the session's context by an absolute stop time. The
+// returned function releases the context and must always be called.
+func (self *Session) SetDeadline(deadline *time.Time) context.CancelFunc {
+	if deadline == nil {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithDeadline(self.Context, *deadline)
+	self.Context = ctx
+	return cancel
+}
+
+// Get performs an authenticated REST request and returns the response body
+// together with the response headers.
+func (self *Session) Get(url string) ([]byte, http.Header, error) {
+	req, err := self.NewRequest(self.Context, url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := self.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if line := rateLimitHeaders(res.Header); self.ShowRateLimit && line != "" {
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	bytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.StatusCode != 200 {
+		fmt.Fprintln(os.Stderr, res.Status)
+		return nil, nil, errors.New(string(bytes))
+	}
+
+	return bytes, res.Header, nil
+}
+
+// rateLimitHeaders is the --show-rate-limit line of the rate-limit related
+// response headers, empty if there are none.
+func rateLimitHeaders(header http.Header) string {
+	fields := []string{}
+	for key, values := range header {
+		name := strings.ToLower(key)
+		if strings.Contains(name, "ratelimit") || strings.Contains(name, "rate-limit") || name == "retry-after" {
+			fields = append(fields, fmt.Sprintf("%s=%s", key, strings.Join(values, ",")))
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+
+	sort.Strings(fields)
+	return "rate-limit: " + strings.Join(fields, " ")
+}
+
+// ForProfile returns a copy of the session using another profile of the
+// credentials file, sharing the context and output. The AccountId override
+// is kept for the session's own profile only.
+func (self *Session) ForProfile(configPath string, profile string) (*Session, error) {
+	credentials, err := GetCredentials(configPath, profile)
+	if err != nil {
+		return nil, err
+	}
+	accountId := ""
+	if configPath == self.ConfigPath && profile == self.Profile {
+		accountId = self.AccountId
+	}
+	if accountId != "" {
+		credentials.Default.AccountId = accountId
+	}
+	if err := credentials.Default.Validate(configPath, profile, true); err != nil {
+		return nil, err
+	}
+
+	session := *self
+	session.AccountId = accountId
+	session.Credentials = credentials
+	session.ConfigPath = configPath
+	session.Profile = profile
+	return &session, nil
+}
+
+// ReloadCredentials reads the credentials of the session again, e.g. after
+// the token was rotated (--reload-credentials).
+func (self *Session) ReloadCredentials() error {
+	reloaded, err := self.ForProfile(self.ConfigPath, self.Profile)
+	if err != nil {
+		return err
+	}
+	self.Credentials = reloaded.Credentials
+	return nil
+}
+
+// WithContext returns a copy of the session using ctx, e.g. to stop one of
+// several concurrent streams along with the others.
+func (self *Session) WithContext(ctx context.Context) *Session {
+	session := *self
+	session.Context = ctx
+	return &session
+}
+
+// Tagged returns a copy of the session whose output is tagged with the given name.
+func (self *Session) Tagged(tag string) *Session {
+	session := *self
+	output := *self.Output
+	output.Tag = tag
+	// Every job is a stream of its own, numbered from 1.
+	if output.Seq != nil {
+		output.Seq = &Sequence{}
+	}
+	session.Output = &output
+	return &session
+}
+
+const (
+	defaultPricingHeartbeatTimeout      = 7 * time.Second
+	defaultTransactionsHeartbeatTimeout = 6 * time.Second
+	defaultGranularity                  = "S5"
+	defaultPrice                        = "MBA"
+	defaultPollingInterval              = 1 * time.Second
+	defaultDailyAlignment               = 17
+	defaultAlignmentTimezone            = "America/New_York"
+	defaultWeeklyAlignment              = "Friday"
+	defaultOutputBuffer                 = 4096
+	defaultSampleKeep                   = 10
+)
+
 func main() {
+	// Seeded so that the reconnect jitter differs between processes.
+	rand.Seed(time.Now().UnixNano())
+
 	defaultConfig, err := GetDefaultConfigPath()
 	if err != nil {
 		log.Fatal(err)
@@ -61,248 +583,1514 @@ func main() {
 	app := &cli.App{
 		Name:  "oanda-cli",
 		Usage: "oanda v20 cli",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "env-file",
+				Usage: "Load OANDA_TOKEN, OANDA_ACCOUNT_ID and OANDA_ENV from a .env file, without overriding the environment",
+			},
+			&cli.StringFlag{
+				Name:  "account-id",
+				Usage: "Use this account with the token of the selected profile, overriding OANDA_ACCOUNT_ID",
+			},
+			&cli.BoolFlag{
+				Name:  "strict-config",
+				Usage: "Fail on unknown keys in the credentials file and batch specs, e.g. a misspelt account_id",
+			},
+			&cli.StringSliceFlag{
+				Name:  "header",
+				Usage: "Send an extra \"Key: Value\" header with every request, may be repeated",
+			},
+			&cli.BoolFlag{
+				Name:  "show-rate-limit",
+				Usage: "Log rate-limit response headers of each REST request to stderr",
+			},
+			&cli.GenericFlag{
+				Name:  "print-curl",
+				Usage: "Print the first request as a curl command instead of sending it, the token redacted unless --print-curl=unsafe",
+				Value: printCurl,
+			},
+		},
+		Before: func(c *cli.Context) error {
+			headers, err := ParseHeaders(c.StringSlice("header"))
+			if err != nil {
+				return err
+			}
+			requestHeaders = headers
+			strictConfig = c.Bool("strict-config")
+			showRateLimit = c.Bool("show-rate-limit")
+
+			accountIdOverride = c.String("account-id")
+
+			if path := c.String("env-file"); path != "" {
+				return LoadEnvFile(path)
+			}
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
-				Name:    "pricing",
-				Aliases: []string{"p"},
-				Usage:   "Get pricing stream",
-				Action:  pricingAction,
-				Flags: []cli.Flag{
+				Name:      "pricing",
+				Aliases:   []string{"p"},
+				Usage:     "Get pricing stream",
+				ArgsUsage: "[instrument...]",
+				Action:    pricingAction,
+				Before:    accountIdBefore,
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:    "instruments",
 						Aliases: []string{"i"},
 						Usage:   "List of instruments (CSV)",
 					},
+					&cli.StringFlag{
+						Name:  "instruments-file",
+						Usage: "Also stream the instruments listed in this file, re-read on SIGHUP",
+					},
 					&cli.BoolFlag{
 						Name: "heartbeat",
 					},
+					&cli.StringFlag{
+						Name:  "emit-heartbeat-as",
+						Usage: "Re-emit heartbeats in this shape, <time> is replaced by the heartbeat time (implies --heartbeat)",
+					},
 					&cli.DurationFlag{
 						Name:    "heartbeat-timeout",
 						Aliases: []string{"t"},
-						Value:   7 * time.Second,
+						Usage:   "Fail when no heartbeat arrives within this duration, 0 disables the check",
+						Value:   defaultPricingHeartbeatTimeout,
+					},
+					&cli.BoolFlag{
+						Name:  "no-heartbeat-timeout",
+						Usage: "Disable the heartbeat timeout check, same as --heartbeat-timeout 0",
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "Profile of the credentials file to use",
+						Value: defaultProfile,
+					},
+					accountIdFlag(),
+					&cli.StringFlag{
+						Name:  "profiles",
+						Usage: "Stream from several profiles (CSV) at once, with a \"_job\" field naming the profile of each line",
+					},
+					&cli.BoolFlag{
+						Name:  "with-closeout",
+						Usage: "Add the closeout prices as numeric closeout_bid and closeout_ask fields",
+					},
+					&cli.BoolFlag{
+						Name:  "only-tradeable",
+						Usage: "Drop prices of instruments which cannot currently be traded",
+					},
+					&cli.BoolFlag{
+						Name:  "status-changes-only",
+						Usage: "Only emit the first price of each instrument and those whose tradeable status changed",
+					},
+					&cli.BoolFlag{
+						Name:  "with-tradeable",
+						Usage: "Add the tradeable field to prices which only carry the deprecated status field",
+					},
+					&cli.TimestampFlag{
+						Name:   "deadline",
+						Usage:  "Stop cleanly at this time (RFC3339)",
+						Layout: time.RFC3339,
+					},
+					&cli.BoolFlag{
+						Name:  "assert-tradeable",
+						Usage: "Check that every instrument is tradeable on the account before starting",
 					},
 					&cli.BoolFlag{
 						Name:    "all-instruments",
 						Aliases: []string{"a"},
+						Usage:   "Stream every instrument the account can trade",
+					},
+					&cli.IntFlag{
+						Name:  "limit-instruments-per-stream",
+						Usage: "Split the instruments evenly over as many streams as it takes to have at most this many per stream",
+					},
+					&cli.BoolFlag{
+						Name:  "sample-on-backpressure",
+						Usage: "Queue the output and, while more than --high-water lines are pending, keep 1 in --sample-keep lines only",
+					},
+					&cli.IntFlag{
+						Name:  "output-buffer",
+						Usage: "Lines queued by --sample-on-backpressure",
+						Value: defaultOutputBuffer,
+					},
+					&cli.IntFlag{
+						Name:  "high-water",
+						Usage: "Pending lines above which --sample-on-backpressure starts sampling",
+						Value: defaultOutputBuffer / 2,
+					},
+					&cli.IntFlag{
+						Name:  "sample-keep",
+						Usage: "Under backpressure, keep 1 in this many lines",
+						Value: defaultSampleKeep,
 					},
 					&cli.StringFlag{
 						Name:    "config",
 						Aliases: []string{"c"},
 						Value:   *defaultConfig,
 					},
-				},
+				}, append(streamFlags(), outputFlags()...)...),
 			},
 			{
 				Name:    "candles",
 				Aliases: []string{"p"},
 				Usage:   "Get candles stream by polling",
 				Action:  candlesAction,
-				Flags: []cli.Flag{
+				Before:  accountIdBefore,
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
-						Name:     "instrument",
-						Aliases:  []string{"i"},
-						Required: true,
+						Name:    "instrument",
+						Aliases: []string{"i"},
+						Usage:   "Instrument, or list of instruments (CSV) each polled on its own",
 					},
 					&cli.StringFlag{
+						Name:  "volume-type",
+						Usage: "JSON type of the volume: int, or float to write it with a decimal point",
+						Value: "int",
+					},
+					&cli.BoolFlag{
+						Name:  "annotate",
+						Usage: "Add instrument and granularity fields to every candle, as done anyway for several instruments or granularities",
+					},
+					&cli.StringSliceFlag{
+						Name:  "spec",
+						Usage: "Series as instrument:granularity[:price], e.g. EUR_USD:M1:BM, instead of --instrument, --granularity and --price; may be repeated",
+					},
+					&cli.StringSliceFlag{
 						Name:    "granularity",
 						Aliases: []string{"g"},
-						Value:   "S5",
+						Usage:   "Candle granularity, may be repeated to poll several at once",
+						Value:   cli.NewStringSlice(defaultGranularity),
 					},
 					&cli.TimestampFlag{
 						Name:        "from",
 						Layout:      time.RFC3339,
 						DefaultText: time.Now().Format(time.RFC3339),
 					},
-					&cli.DurationFlag{
+					&cli.StringFlag{
 						Name:    "polling-interval",
 						Aliases: []string{"p"},
-						Value:   1 * time.Second,
+						Usage:   "Polling interval, optionally per instrument e.g. EUR_USD=1s,USD_JPY=5s,2s",
+						Value:   defaultPollingInterval.String(),
 					},
 					&cli.BoolFlag{
 						Name: "completed-only",
 					},
+					&cli.BoolFlag{
+						Name:  "since-last-run",
+						Usage: "Continue from the last candle of the previous run, falling back to --from on the first run",
+					},
 					&cli.StringFlag{
-						Name:    "config",
-						Aliases: []string{"c"},
-						Value:   *defaultConfig,
+						Name:        "state-file",
+						Usage:       "Where --since-last-run keeps its cursor",
+						DefaultText: "~/.config/oanda/state/candles_<instrument>_<granularity>.json",
 					},
-				},
-			},
-			{
-				Name:    "transactions",
-				Aliases: []string{"t"},
-				Usage:   "Get transaction stream",
-				Action:  transactionsAction,
-				Flags: []cli.Flag{
 					&cli.BoolFlag{
-						Name: "heartbeat",
+						Name:  "smooth",
+						Usage: "Ask OANDA for smoothed candles, whose open is the previous candle's close",
 					},
-					&cli.DurationFlag{
-						Name:    "heartbeat-timeout",
-						Aliases: []string{"t"},
-						Value:   6 * time.Second,
+					&cli.BoolFlag{
+						Name:  "assert-tradeable",
+						Usage: "Check that every instrument is tradeable on the account before starting",
 					},
-					&cli.StringFlag{
-						Name:    "config",
-						Aliases: []string{"c"},
-						Value:   *defaultConfig,
+					&cli.BoolFlag{
+						Name:  "adaptive-polling",
+						Usage: "Back off the polling interval while no new candles arrive (e.g. market closed)",
+					},
+					&cli.TimestampFlag{
+						Name:   "deadline",
+						Usage:  "Stop cleanly at this time (RFC3339)",
+						Layout: time.RFC3339,
+					},
+					&cli.IntFlag{
+						Name:  "emit-volume-delta",
+						Usage: "Only emit a forming candle once its volume grew by this much since it was last emitted",
+					},
+					&cli.IntFlag{
+						Name:  "batch-size",
+						Usage: "Emit candles as JSON arrays of this many candles per line, each filtered, validated and counted by --max-lines on its own (not with --template)",
+					},
+					&cli.BoolFlag{
+						Name:  "with-typical",
+						Usage: "Add the typical price (H+L+C)/3 of the mid prices, else of the bid or ask prices",
+					},
+					&cli.IntFlag{
+						Name:  "sma",
+						Usage: "Add the simple moving average of the closes of this many completed candles (null until known)",
+					},
+					&cli.IntFlag{
+						Name:  "vwap",
+						Usage: "Add the volume weighted average typical price of this many completed candles (null until known)",
+					},
+					&cli.BoolFlag{
+						Name:  "delta",
+						Usage: "Emit updates of a forming candle as its time and the changed fields only",
+					},
+					&cli.StringFlag{
+						Name:  "session",
+						Usage: "Only emit candles starting within these daily trading hours, e.g. 08:00-16:00 (may cross midnight)",
+					},
+					&cli.StringFlag{
+						Name:  "session-tz",
+						Usage: "Time zone of --session, e.g. America/New_York",
+						Value: "UTC",
+					},
+					&cli.IntFlag{
+						Name:  "daily-alignment",
+						Usage: "Hour of the day (0-23) in --alignment-tz at which D candles start",
+						Value: defaultDailyAlignment,
+					},
+					&cli.StringFlag{
+						Name:  "alignment-tz",
+						Usage: "Time zone of --daily-alignment",
+						Value: defaultAlignmentTimezone,
+					},
+					&cli.StringFlag{
+						Name:  "weekly-alignment",
+						Usage: "Day of the week at which W candles start",
+						Value: defaultWeeklyAlignment,
+					},
+					&cli.DurationFlag{
+						Name:  "emit-tick",
+						Usage: "Emit the latest forming candle every interval on the clock, e.g. 1s on the second, independent of polling",
+					},
+					&cli.BoolFlag{
+						Name:  "drop-incomplete-on-exit",
+						Usage: "On stopping, replace a last written incomplete candle by its completed version, or else retract it",
+					},
+					&cli.BoolFlag{
+						Name:  "trading-date",
+						Usage: "Add the trading_date, the date in --alignment-tz a D or W candle closes on",
+					},
+					&cli.BoolFlag{
+						Name:  "quiet",
+						Usage: "Do not write the banner with env, account, instruments, granularity and endpoint to stderr before polling",
+					},
+					&cli.StringFlag{
+						Name:        "price",
+						Usage:       "Price component (M, B, A or a combination), overriding the profile's default_price",
+						DefaultText: "default_price of the profile, else MBA",
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "Profile of the credentials file to use",
+						Value: defaultProfile,
+					},
+					accountIdFlag(),
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   *defaultConfig,
+					},
+				}, outputFlags()...),
+			},
+			{
+				Name:      "batch",
+				Aliases:   []string{"b"},
+				Usage:     "Run several commands concurrently from a job spec (YAML or JSON)",
+				ArgsUsage: "<job spec file>",
+				Action:    batchAction,
+				Flags: append([]cli.Flag{
+					&cli.TimestampFlag{
+						Name:   "deadline",
+						Usage:  "Stop cleanly at this time (RFC3339)",
+						Layout: time.RFC3339,
+					},
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   *defaultConfig,
+					},
+				}, outputFlags()...),
+			},
+			{
+				Name:   "accounts",
+				Usage:  "List the accounts available to the token",
+				Action: accountsAction,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "select",
+						Usage: "Choose one of the accounts and write it to the credentials file",
+					},
+					&cli.DurationFlag{
+						Name:  "watch",
+						Usage: "Refresh on this interval until interrupted",
+					},
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   *defaultConfig,
 					},
 				},
 			},
+			{
+				Name:   "probe",
+				Usage:  "Measure round-trip latency to OANDA",
+				Action: probeAction,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:    "count",
+						Aliases: []string{"n"},
+						Value:   5,
+					},
+					&cli.DurationFlag{
+						Name:    "interval",
+						Aliases: []string{"i"},
+						Value:   1 * time.Second,
+					},
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   *defaultConfig,
+					},
+				},
+			},
+			{
+				Name:  "account",
+				Usage: "Inspect the account",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "diff",
+						Usage:  "Print what changed on the account between two transactions as JSON",
+						Action: accountDiffAction,
+						Before: accountIdBefore,
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:     "from-id",
+								Required: true,
+							},
+							&cli.IntFlag{
+								Name:     "to-id",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "profile",
+								Usage: "Profile of the credentials file to use",
+								Value: defaultProfile,
+							},
+							accountIdFlag(),
+							&cli.StringFlag{
+								Name:    "config",
+								Aliases: []string{"c"},
+								Value:   *defaultConfig,
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "margin",
+				Usage:  "Show the account's margin rate and leverage",
+				Action: marginAction,
+				Before: accountIdBefore,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "watch",
+						Usage: "Refresh on this interval until interrupted",
+					},
+					&cli.StringFlag{
+						Name:    "profile",
+						Aliases: []string{"p"},
+						Usage:   "Profile of the credentials file to use",
+						Value:   defaultProfile,
+					},
+					accountIdFlag(),
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   *defaultConfig,
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Inspect the configuration",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "show",
+						Usage:  "Print the resolved configuration as JSON, with secrets redacted",
+						Action: configShowAction,
+						Before: accountIdBefore,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "profile",
+								Usage: "Profile of the credentials file to use",
+								Value: defaultProfile,
+							},
+							accountIdFlag(),
+							&cli.StringFlag{
+								Name:    "config",
+								Aliases: []string{"c"},
+								Value:   *defaultConfig,
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "benchmark",
+				Usage:  "Measure the throughput of the output path with synthetic messages",
+				Hidden: true,
+				Action: benchmarkAction,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "kind",
+						Usage: "Kind of message to generate, price or candle",
+						Value: "price",
+					},
+					&cli.DurationFlag{
+						Name:    "duration",
+						Aliases: []string{"d"},
+						Value:   5 * time.Second,
+					},
+					&cli.IntFlag{
+						Name:  "batch-size",
+						Usage: "Emit candles as JSON arrays of this many candles per line",
+					},
+				}, outputFlags()...),
+			},
+			{
+				Name:      "format",
+				Usage:     "Pretty-print a captured NDJSON file, or stdin, applying the output options",
+				ArgsUsage: "[file]",
+				Action:    formatAction,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "indent",
+						Usage: "Indentation of the pretty-printed messages",
+						Value: "  ",
+					},
+					&cli.BoolFlag{
+						Name:  "compact",
+						Usage: "Keep one message per line, e.g. to only --filter-expr or --strip-fields",
+					},
+				}, outputFlags()...),
+			},
+			{
+				Name:   "export",
+				Usage:  "Export a bounded range of candles to a CSV file",
+				Action: exportAction,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "instrument",
+						Aliases:  []string{"i"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "granularity",
+						Aliases: []string{"g"},
+						Value:   defaultGranularity,
+					},
+					&cli.TimestampFlag{
+						Name:     "from",
+						Layout:   time.RFC3339,
+						Required: true,
+					},
+					&cli.TimestampFlag{
+						Name:        "to",
+						Layout:      time.RFC3339,
+						DefaultText: "now",
+					},
+					&cli.StringFlag{
+						Name:     "out",
+						Aliases:  []string{"o"},
+						Usage:    "CSV file to write, - for stdout",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "append",
+						Usage: "Append to --out instead of replacing it, writing the CSV header only if it is empty",
+					},
+					&cli.StringFlag{
+						Name:  "order-by",
+						Usage: "Order of the candles: time (ascending) or time:desc",
+						Value: "time",
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "Profile of the credentials file to use",
+						Value: defaultProfile,
+					},
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   *defaultConfig,
+					},
+				},
+			},
+			{
+				Name:    "transactions",
+				Aliases: []string{"t"},
+				Usage:   "Get transaction stream",
+				Action:  transactionsAction,
+				Before:  accountIdBefore,
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "explain",
+						Usage: "Print common transaction types as flat JSON of their most relevant fields",
+					},
+					&cli.BoolFlag{
+						Name:  "dedup-across-reconnect",
+						Usage: "Skip transactions whose id was recently emitted, e.g. delivered again after a reconnect",
+					},
+					&cli.BoolFlag{
+						Name:  "coalesce",
+						Usage: "Skip a transaction identical to the previous one except for its id and time",
+					},
+					&cli.StringFlag{
+						Name:  "instrument",
+						Usage: "Only emit transactions of these instruments (CSV)",
+					},
+					&cli.BoolFlag{
+						Name:  "running-pl",
+						Usage: "Log the realized P/L summed over the fills since the command started to stderr",
+					},
+					&cli.StringFlag{
+						Name:  "fields",
+						Usage: "Only keep these fields of every transaction (CSV, dotted for nested ones), e.g. id,type,instrument,units,price,pl",
+					},
+					&cli.BoolFlag{
+						Name:  "skip-snapshot",
+						Usage: "Drop state snapshot messages, i.e. anything but transactions and heartbeats",
+					},
+					&cli.BoolFlag{
+						Name:  "tag-snapshot",
+						Usage: "Mark state snapshot messages with \"_snapshot\":true",
+					},
+					&cli.DurationFlag{
+						Name:  "aggregate-transactions",
+						Usage: "Instead of the transactions, emit their counts by type per window of this length, e.g. 1m",
+					},
+					&cli.BoolFlag{
+						Name:  "include-account-level",
+						Usage: "With --instrument, also emit transactions without an instrument, e.g. transfers and financing",
+					},
+					&cli.TimestampFlag{
+						Name:   "deadline",
+						Usage:  "Stop cleanly at this time (RFC3339)",
+						Layout: time.RFC3339,
+					},
+					&cli.BoolFlag{
+						Name: "heartbeat",
+					},
+					&cli.StringFlag{
+						Name:  "emit-heartbeat-as",
+						Usage: "Re-emit heartbeats in this shape, <time> is replaced by the heartbeat time (implies --heartbeat)",
+					},
+					&cli.DurationFlag{
+						Name:    "heartbeat-timeout",
+						Aliases: []string{"t"},
+						Usage:   "Fail when no heartbeat arrives within this duration, 0 disables the check",
+						Value:   defaultTransactionsHeartbeatTimeout,
+					},
+					&cli.BoolFlag{
+						Name:  "no-heartbeat-timeout",
+						Usage: "Disable the heartbeat timeout check, same as --heartbeat-timeout 0",
+					},
+					&cli.StringFlag{
+						Name:  "profile",
+						Usage: "Profile of the credentials file to use",
+						Value: defaultProfile,
+					},
+					accountIdFlag(),
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   *defaultConfig,
+					},
+				}, append(streamFlags(), outputFlags()...)...),
+			},
 		},
 	}
 
 	err = app.Run(os.Args)
-	if err != nil {
+	var missingConfig *MissingConfigError
+	if errors.As(err, &missingConfig) {
+		log.Print(err)
+		os.Exit(exitCodeCredentials)
+	}
+	if err != nil && !errors.Is(err, errPrintedCurl) {
 		log.Fatal(err)
 	}
 }
 
-func pricingAction(c *cli.Context) error {
-	instruments := c.String("instruments")
-	heartbeat := c.Bool("heartbeat")
+type PricingOptions struct {
+	StreamOptions `yaml:",inline"`
+	Instruments   string `yaml:"instruments"`
+	Heartbeat     bool   `yaml:"heartbeat"`
+	HeartbeatAs   string `yaml:"emit_heartbeat_as"`
+	WithCloseout  bool   `yaml:"with_closeout"`
+	OnlyTradeable bool   `yaml:"only_tradeable"`
+	WithTradeable bool   `yaml:"with_tradeable"`
+	// StatusChangesOnly emits a price only when the tradeable status of its
+	// instrument differs from the previous price's.
+	StatusChangesOnly bool `yaml:"status_changes_only"`
+}
+
+func (self *PricingOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PricingOptions
+	*self = PricingOptions{
+		StreamOptions: defaultStreamOptions(defaultPricingHeartbeatTimeout),
+	}
+	return unmarshal((*plain)(self))
+}
+
+// pricingInstruments are the instruments of --instruments followed by those
+// given as arguments.
+func pricingInstruments(c *cli.Context) []string {
+	instruments := []string{}
+	if c.String("instruments") != "" {
+		instruments = append(instruments, strings.Split(c.String("instruments"), ",")...)
+	}
+	return append(instruments, c.Args().Slice()...)
+}
+
+func pricingAction(c *cli.Context) (err error) {
+	instruments := pricingInstruments(c)
+	static := instruments
+	instrumentsFile := c.String("instruments-file")
+	if instrumentsFile != "" {
+		listed, err := ReadInstrumentsFile(instrumentsFile)
+		if err != nil {
+			return err
+		}
+		instruments = append(append([]string{}, static...), listed...)
+	}
+	all := c.Bool("all-instruments")
+	if len(instruments) == 0 && !all {
+		return errors.New("at least one instrument is required, via --instruments, --instruments-file or as arguments")
+	}
+	if len(instruments) != 0 && all {
+		return errors.New("--all-instruments cannot be combined with other instruments")
+	}
+	if all && printingCurl() {
+		return errors.New("--print-curl cannot be combined with --all-instruments, whose instruments are only known from a request")
+	}
+	limit := c.Int("limit-instruments-per-stream")
+	if limit > 0 && instrumentsFile != "" {
+		return errors.New("--limit-instruments-per-stream cannot be combined with --instruments-file")
+	}
+
+	streamOptions, err := streamOptionsFlags(c)
+	if err != nil {
+		return err
+	}
+
+	options := PricingOptions{
+		StreamOptions: *streamOptions,
+		Instruments:   strings.Join(instruments, ","),
+		Heartbeat:     c.Bool("heartbeat"),
+		HeartbeatAs:   c.String("emit-heartbeat-as"),
+		WithCloseout:  c.Bool("with-closeout"),
+		OnlyTradeable: c.Bool("only-tradeable"),
+		WithTradeable: c.Bool("with-tradeable"),
+
+		StatusChangesOnly: c.Bool("status-changes-only"),
+	}
+	// With --instruments-file, the stream is reopened on SIGHUP.
+	stream := func(session *Session) error {
+		if instrumentsFile != "" {
+			return getStreamWithReload(session, options, static, instrumentsFile)
+		}
+		options := options
+		if all {
+			names, err := getTradeableInstrumentNames(session)
+			if err != nil {
+				return err
+			}
+			options.Instruments = strings.Join(names, ",")
+		}
+		return getShardedStream(session, &options, limit)
+	}
+
+	profiles := []string{c.String("profile")}
+	if c.IsSet("profiles") {
+		if c.IsSet("profile") {
+			return errors.New("--profile and --profiles are mutually exclusive")
+		}
+		if accountIdOverride != "" {
+			return errors.New("--account-id cannot be combined with --profiles, whose profiles each have their own account")
+		}
+		profiles = strings.Split(c.String("profiles"), ",")
+	}
+
+	session, err := NewProfileSession(c.String("config"), profiles[0])
+	if err != nil {
+		return err
+	}
+	cancel := session.SetDeadline(c.Timestamp("deadline"))
+	defer cancel()
+	defer session.CancelOnSignal()()
+	if err := session.OpenOutput(c); err != nil {
+		return err
+	}
+	if c.Bool("sample-on-backpressure") {
+		writer, err := NewSamplingWriter(session.Output.Writer, c.Int("output-buffer"), c.Int("high-water"), c.Int("sample-keep"))
+		if err != nil {
+			return err
+		}
+		session.Output.Writer = writer
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if addr := c.String("health-addr"); addr != "" {
+		if err := session.ServeHealth(addr, options.HeartbeatTimeout); err != nil {
+			return err
+		}
+	}
+	if addr := c.String("metrics-addr"); addr != "" {
+		if err := session.ServeMetrics(addr); err != nil {
+			return err
+		}
+	}
+	if c.Bool("assert-tradeable") && !printingCurl() {
+		if err := assertTradeable(session, instruments); err != nil {
+			return err
+		}
+	}
+
+	// The instruments of --all-instruments are only known once listed.
+	bannerInstruments := instruments
+	if all {
+		bannerInstruments = []string{"all"}
+	}
+	banner := func(session *Session) {
+		if !c.Bool("quiet") {
+			account := session.Credentials.Default
+			session.PrintBanner(bannerInstruments, "", fmt.Sprintf("%s/v3/accounts/%s/pricing/stream", account.StreamUrl(), account.AccountId))
+		}
+	}
+
+	if len(profiles) == 1 {
+		banner(session)
+		err = stream(session)
+		return err
+	}
+
+	// One stream per profile, each with its own heartbeat watchdog, and
+	// every line tagged with the profile it came from.
+	tasks := []func(context.Context) error{}
+	for _, profile := range profiles {
+		profileSession, err := session.ForProfile(c.String("config"), profile)
+		if err != nil {
+			return err
+		}
+		profileSession = profileSession.Tagged(profile)
+		banner(profileSession)
+		profile := profile
+		tasks = append(tasks, func(ctx context.Context) error {
+			err := stream(profileSession.WithContext(ctx))
+			if err != nil {
+				err = fmt.Errorf("profile %s: %w", profile, err)
+			}
+			return err
+		})
+	}
+	err = runConcurrently(session.Context, tasks)
+
+	return err
+}
+
+// streamOptionsFlags resolves the streamFlags.
+func streamOptionsFlags(c *cli.Context) (*StreamOptions, error) {
+	heartbeatTimeout, err := heartbeatTimeoutFlag(c)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := ParseReconnectStatuses(c.String("reconnect-on-status"))
+	if err != nil {
+		return nil, err
+	}
+
+	options := StreamOptions{
+		HeartbeatTimeout:    heartbeatTimeout,
+		ReconnectOnAnyError: c.Bool("reconnect-on-any-error"),
+		ReconnectStatuses:   statuses,
+		MaxRetries:          c.Int("max-retries"),
+		MaxBackoff:          c.Duration("reconnect-max-backoff"),
+		MaxLineBytes:        c.Int("max-line-bytes"),
+		OnOversize:          c.String("on-oversize"),
+		ReloadCredentials:   c.Bool("reload-credentials"),
+		ReconnectMarkers:    c.Bool("reconnect-markers"),
+	}
+	return &options, nil
+}
+
+// heartbeatTimeoutFlag resolves --heartbeat-timeout and --no-heartbeat-timeout.
+// Either a zero timeout or --no-heartbeat-timeout disables the watchdog.
+func heartbeatTimeoutFlag(c *cli.Context) (time.Duration, error) {
 	heartbeatTimeout := c.Duration("heartbeat-timeout")
-	configPath := c.String("config")
-	err := getStream(instruments, heartbeat, heartbeatTimeout, configPath)
+	if !c.Bool("no-heartbeat-timeout") {
+		return heartbeatTimeout, nil
+	}
+
+	if c.IsSet("heartbeat-timeout") && heartbeatTimeout != 0 {
+		return 0, errors.New("--no-heartbeat-timeout conflicts with a non-zero --heartbeat-timeout")
+	}
+	return 0, nil
+}
+
+// getShardedStream splits the instruments evenly over as many streams as it
+// takes to have at most limit per stream, or opens a single stream when limit
+// is not positive. Every shard is counted on its own by --metrics-addr.
+func getShardedStream(session *Session, options *PricingOptions, limit int) error {
+	instruments := strings.Split(options.Instruments, ",")
+	if limit <= 0 || len(instruments) <= limit {
+		return getStream(session, options)
+	}
+
+	tasks := []func(context.Context) error{}
+	for i, shard := range ShardInstruments(instruments, limit) {
+		shardSession := *session
+		shardSession.Shard = strconv.Itoa(i)
+		shardOptions := *options
+		shardOptions.Instruments = strings.Join(shard, ",")
+		tasks = append(tasks, func(ctx context.Context) error {
+			return getStream(shardSession.WithContext(ctx), &shardOptions)
+		})
+	}
+	return runConcurrently(session.Context, tasks)
+}
+
+// ShardInstruments deals the instruments round robin into the fewest shards
+// of at most limit, so that shard sizes differ by one at most.
+func ShardInstruments(instruments []string, limit int) [][]string {
+	shards := make([][]string, (len(instruments)+limit-1)/limit)
+	for i, instrument := range instruments {
+		shards[i%len(shards)] = append(shards[i%len(shards)], instrument)
+	}
+	return shards
+}
+
+func getStream(session *Session, options *PricingOptions) error {
+	account := session.Credentials.Default
+	instruments := options.Instruments
+	heartbeat := options.Heartbeat
+	heartbeatAs := options.HeartbeatAs
+
+	baseUrl := account.StreamUrl()
+	query := fmt.Sprintf("instruments=%s", instruments)
+	url := fmt.Sprintf("%s/v3/accounts/%s/pricing/stream?%s", baseUrl, account.AccountId, query)
+
+	// statuses are the last tradeable status of every instrument, for
+	// --status-changes-only.
+	statuses := map[string]bool{}
+
+	err := streamLines(session, url, &options.StreamOptions, func(line []byte) (bool, error) {
+		var ph PriceOrHeartbeat
+		if err := json.Unmarshal(line, &ph); err != nil {
+			return false, err
+		}
+
+		if ph.Type == "PRICE" {
+			tradeable, known := ph.IsTradeable()
+			if options.OnlyTradeable && known && !tradeable {
+				return false, nil
+			}
+			if options.StatusChangesOnly {
+				previous, seen := statuses[ph.Instrument]
+				if !known || (seen && previous == tradeable) {
+					return false, nil
+				}
+				statuses[ph.Instrument] = tradeable
+			}
+			price := string(line)
+			if options.WithTradeable && ph.Tradeable == nil && known {
+				price = injectField(price, "tradeable", tradeable)
+			}
+			if options.WithCloseout {
+				price = withCloseout(price, &ph)
+			}
+			return false, session.Output.Emit(price)
+		} else if ph.Type == "HEARTBEAT" {
+			if heartbeatAs != "" {
+				return true, session.Output.Println(formatHeartbeat(heartbeatAs, ph.Time))
+			} else if heartbeat {
+				return true, session.Output.Println(string(line))
+			}
+			return true, nil
+		}
+		return false, nil
+	})
 
 	return err
 }
 
-func getStream(instruments string, heartbeat bool, heartbeatTimeout time.Duration, configPath string) error {
-	credentials, err := GetCredentials(configPath)
+type PriceOrHeartbeat struct {
+	Type        string `json:"type"`
+	Time        string `json:"time"`
+	CloseoutBid string `json:"closeoutBid"`
+	CloseoutAsk string `json:"closeoutAsk"`
+	Instrument  string `json:"instrument"`
+	Tradeable   *bool  `json:"tradeable"`
+	// Status is the deprecated predecessor of Tradeable.
+	Status string `json:"status"`
+}
+
+// IsTradeable reports whether the instrument can currently be traded, from
+// tradeable or else status. known is false when the message has neither.
+func (self *PriceOrHeartbeat) IsTradeable() (tradeable bool, known bool) {
+	if self.Tradeable != nil {
+		return *self.Tradeable, true
+	}
+	if self.Status != "" {
+		return self.Status == "tradeable", true
+	}
+	return false, false
+}
+
+// withCloseout adds the closeout prices as numeric closeout_bid and
+// closeout_ask fields. Prices missing from the message are left out.
+func withCloseout(line string, price *PriceOrHeartbeat) string {
+	for _, field := range []struct {
+		key   string
+		value string
+	}{
+		{"closeout_ask", price.CloseoutAsk},
+		{"closeout_bid", price.CloseoutBid},
+	} {
+		value, err := strconv.ParseFloat(field.value, 64)
+		if err != nil {
+			continue
+		}
+		line = injectField(line, field.key, value)
+	}
+	return line
+}
+
+// formatHeartbeat renders a heartbeat in the shape given by --emit-heartbeat-as.
+func formatHeartbeat(shape string, heartbeatTime string) string {
+	return strings.ReplaceAll(shape, "<time>", heartbeatTime)
+}
+
+type CandlesOptions struct {
+	Instrument      string        `yaml:"instrument"`
+	Granularity     string        `yaml:"granularity"`
+	From            *time.Time    `yaml:"from"`
+	PollingInterval time.Duration `yaml:"polling_interval"`
+	CompletedOnly   bool          `yaml:"completed_only"`
+	BatchSize       int           `yaml:"batch_size"`
+	AdaptivePolling bool          `yaml:"adaptive_polling"`
+	EmitVolumeDelta int           `yaml:"emit_volume_delta"`
+	Smooth          bool          `yaml:"smooth"`
+	// Annotate adds the instrument to every candle, for multi-instrument
+	// polling, and AnnotateGranularity the granularity, for multi-granularity.
+	Annotate            bool `yaml:"annotate"`
+	AnnotateGranularity bool `yaml:"annotate_granularity"`
+	// StateFile, when set, persists the last candle so that the next run
+	// continues from it (--since-last-run).
+	StateFile string `yaml:"state_file"`
+	// Delta emits repeated updates of a forming candle as only its changed fields.
+	Delta bool `yaml:"delta"`
+	// WithTypical adds the typical price (H+L+C)/3 of every candle.
+	WithTypical bool `yaml:"with_typical"`
+	// SMA adds the simple moving average of this many closes, when positive.
+	SMA int `yaml:"sma"`
+	// VWAP adds the volume weighted average typical price of this many
+	// candles, when positive.
+	VWAP int `yaml:"vwap"`
+	// Price is the price component, such as M or BA. When empty, the
+	// profile's default_price is used, and MBA without one.
+	Price string `yaml:"price"`
+	// Session restricts emitted candles to daily trading hours in SessionTimezone.
+	Session         string `yaml:"session"`
+	SessionTimezone string `yaml:"session_tz"`
+	// DailyAlignment, AlignmentTimezone and WeeklyAlignment are where OANDA
+	// starts D and W candles. TradingDate adds the date they close on.
+	DailyAlignment    int    `yaml:"daily_alignment"`
+	AlignmentTimezone string `yaml:"alignment_tz"`
+	WeeklyAlignment   string `yaml:"weekly_alignment"`
+	TradingDate       bool   `yaml:"trading_date"`
+	// EmitTick, when set, writes the forming candle on a wall-clock aligned
+	// schedule of this interval instead of after every poll.
+	EmitTick time.Duration `yaml:"emit_tick"`
+	// VolumeType is the JSON type of the volume, int (default) or float.
+	VolumeType string `yaml:"volume_type"`
+	// DropIncompleteOnExit settles a last written incomplete candle when the
+	// stream stops, see settleIncomplete.
+	DropIncompleteOnExit bool `yaml:"drop_incomplete_on_exit"`
+}
+
+func (self *CandlesOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CandlesOptions
+	*self = CandlesOptions{
+		Granularity:       defaultGranularity,
+		PollingInterval:   defaultPollingInterval,
+		DailyAlignment:    defaultDailyAlignment,
+		AlignmentTimezone: defaultAlignmentTimezone,
+		WeeklyAlignment:   defaultWeeklyAlignment,
+	}
+	return unmarshal((*plain)(self))
+}
+
+// Validate checks the options which neither the flags nor the batch spec
+// parsing does.
+func (self *CandlesOptions) Validate() error {
+	if self.VolumeType != "" && self.VolumeType != "int" && self.VolumeType != "float" {
+		return fmt.Errorf("unknown volume type %q, expected int or float", self.VolumeType)
+	}
+	if self.Price != "" {
+		if err := ValidatePrice(self.Price); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// candleSeries are the options of every series polled by the candles
+// command. Candles carry their instrument and granularity with --annotate, or
+// when several series differ in them.
+func candleSeries(c *cli.Context, options CandlesOptions, specs []CandleSpec, intervals map[string]time.Duration) ([]CandlesOptions, error) {
+	instruments, granularities := specNames(specs)
+	for instrument := range intervals {
+		if !containsString(instruments, instrument) {
+			return nil, fmt.Errorf("polling interval given for %s, which is not among the instruments", instrument)
+		}
+	}
+	if c.IsSet("state-file") && len(specs) > 1 {
+		return nil, errors.New("--state-file can only be used with a single instrument and granularity")
+	}
+
+	series := []CandlesOptions{}
+	for _, spec := range specs {
+		o := options
+		o.Instrument = spec.Instrument
+		o.Granularity = spec.Granularity
+		o.Price = spec.Price
+		o.Annotate = c.Bool("annotate") || len(instruments) > 1
+		o.AnnotateGranularity = c.Bool("annotate") || len(granularities) > 1
+		if interval, ok := intervals[spec.Instrument]; ok {
+			o.PollingInterval = interval
+		}
+		if c.Bool("since-last-run") {
+			o.StateFile = c.String("state-file")
+			if o.StateFile == "" {
+				path, err := GetDefaultStatePath(o.Instrument, o.Granularity)
+				if err != nil {
+					return nil, err
+				}
+				o.StateFile = path
+			}
+		}
+		series = append(series, o)
+	}
+	return series, nil
+}
+
+// specNames are the distinct instruments and granularities of specs.
+func specNames(specs []CandleSpec) (instruments []string, granularities []string) {
+	for _, spec := range specs {
+		if !containsString(instruments, spec.Instrument) {
+			instruments = append(instruments, spec.Instrument)
+		}
+		if !containsString(granularities, spec.Granularity) {
+			granularities = append(granularities, spec.Granularity)
+		}
+	}
+	return instruments, granularities
+}
+
+func candlesAction(c *cli.Context) (err error) {
+	defaultInterval, intervals, err := ParsePollingIntervals(c.String("polling-interval"))
 	if err != nil {
 		return err
 	}
-	account := credentials.Default
 
-	baseUrl := "https://stream-fxpractice.oanda.com"
-	query := fmt.Sprintf("instruments=%s", instruments)
-	url := fmt.Sprintf("%s/v3/accounts/%s/pricing/stream?%s", baseUrl, account.AccountId, query)
+	options := CandlesOptions{
+		From:            c.Timestamp("from"),
+		PollingInterval: defaultInterval,
+		CompletedOnly:   c.Bool("completed-only"),
+		BatchSize:       c.Int("batch-size"),
+		AdaptivePolling: c.Bool("adaptive-polling"),
+		EmitVolumeDelta: c.Int("emit-volume-delta"),
+		Smooth:          c.Bool("smooth"),
+		Price:           c.String("price"),
+		Delta:           c.Bool("delta"),
+		WithTypical:     c.Bool("with-typical"),
+		SMA:             c.Int("sma"),
+		VWAP:            c.Int("vwap"),
+		Session:         c.String("session"),
+		SessionTimezone: c.String("session-tz"),
+		// The alignment defaults are OANDA's own.
+		DailyAlignment:    c.Int("daily-alignment"),
+		AlignmentTimezone: c.String("alignment-tz"),
+		WeeklyAlignment:   c.String("weekly-alignment"),
+		TradingDate:       c.Bool("trading-date"),
+
+		DropIncompleteOnExit: c.Bool("drop-incomplete-on-exit"),
+		EmitTick:             c.Duration("emit-tick"),
+		VolumeType:           c.String("volume-type"),
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	specs := []CandleSpec{}
+	if c.IsSet("spec") {
+		if c.IsSet("instrument") || c.IsSet("granularity") || c.IsSet("price") {
+			return errors.New("--spec cannot be combined with --instrument, --granularity or --price")
+		}
+		for _, value := range c.StringSlice("spec") {
+			spec, err := ParseCandleSpec(value)
+			if err != nil {
+				return err
+			}
+			specs = append(specs, *spec)
+		}
+	} else {
+		if c.String("instrument") == "" {
+			return errors.New("--instrument or --spec is required")
+		}
+		// Every instrument and granularity is a series polled on its own.
+		for _, instrument := range strings.Split(c.String("instrument"), ",") {
+			for _, granularity := range c.StringSlice("granularity") {
+				specs = append(specs, CandleSpec{Instrument: instrument, Granularity: granularity, Price: options.Price})
+			}
+		}
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	series, err := candleSeries(c, options, specs, intervals)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", account.Token))
+	instruments, granularities := specNames(specs)
 
-	client := new(http.Client)
-	res, err := client.Do(req)
+	session, err := NewProfileSession(c.String("config"), c.String("profile"))
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
+	cancel := session.SetDeadline(c.Timestamp("deadline"))
+	defer cancel()
+	defer session.CancelOnSignal()()
+	if err := session.OpenOutput(c); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 
-	if res.StatusCode != 200 {
-		fmt.Fprintln(os.Stderr, res.Status)
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
+	if c.Bool("assert-tradeable") && !printingCurl() {
+		if err := assertTradeable(session, instruments); err != nil {
 			return err
 		}
-		return errors.New(string(body))
 	}
 
-	heartbeatChannel := make(chan struct{})
+	if !c.Bool("quiet") {
+		account := session.Credentials.Default
+		path := "{instrument}"
+		if len(instruments) == 1 {
+			path = instruments[0]
+		}
+		endpoint := fmt.Sprintf("%s/v3/instruments/%s/candles", account.ApiUrl(), path)
+		session.PrintBanner(instruments, strings.Join(granularities, ","), endpoint)
+	}
 
-	if heartbeatTimeout != 0 {
-		go func() {
-			for {
-				select {
-				case <-heartbeatChannel:
-				case <-time.After(heartbeatTimeout):
-					panic("heartbeat timeout")
-				}
-			}
-		}()
+	tasks := []func(context.Context) error{}
+	for i := range series {
+		options := &series[i]
+		tasks = append(tasks, func(ctx context.Context) error {
+			return getCandlesStream(session.WithContext(ctx), options)
+		})
 	}
+	err = runConcurrently(session.Context, tasks)
 
-	reader := bufio.NewReader(res.Body)
-	for {
-		line, _, err := reader.ReadLine()
-		if err != nil {
-			return err
+	return err
+}
+
+// CandleSpec is one series of candles, written like OANDA's
+// candleSpecification as EUR_USD:M1:BM. Price is empty when not given.
+type CandleSpec struct {
+	Instrument  string
+	Granularity string
+	Price       string
+}
+
+// ParseCandleSpec parses instrument:granularity[:price].
+func ParseCandleSpec(value string) (*CandleSpec, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid spec %q, expected instrument:granularity[:price]", value)
+	}
+
+	spec := CandleSpec{Instrument: parts[0], Granularity: parts[1]}
+	if _, err := GranularityDuration(spec.Granularity); err != nil {
+		return nil, fmt.Errorf("invalid spec %q: %w", value, err)
+	}
+	if len(parts) == 3 {
+		spec.Price = parts[2]
+		if err := ValidatePrice(spec.Price); err != nil {
+			return nil, fmt.Errorf("invalid spec %q: %w", value, err)
 		}
-		if line == nil {
-			break
+	}
+	return &spec, nil
+}
+
+// ParsePollingIntervals parses --polling-interval, either a single duration or
+// per-instrument durations such as "EUR_USD=1s,USD_JPY=5s,2s" where an entry
+// without an instrument replaces the default.
+func ParsePollingIntervals(spec string) (time.Duration, map[string]time.Duration, error) {
+	fallback := defaultPollingInterval
+	intervals := map[string]time.Duration{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		instrument := ""
+		value := entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			instrument = strings.TrimSpace(entry[:i])
+			value = entry[i+1:]
 		}
 
-		var ph PriceOrHeartbeat
-		if err := json.Unmarshal(line, &ph); err != nil {
-			return err
+		interval, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid polling interval %q: %w", entry, err)
 		}
 
-		if ph.Type == "PRICE" {
-			fmt.Println(string(line))
-		} else if ph.Type == "HEARTBEAT" {
-			if heartbeatTimeout != 0 {
-				heartbeatChannel <- struct{}{}
-			}
-			if heartbeat {
-				fmt.Println(string(line))
-			}
+		if instrument == "" {
+			fallback = interval
+		} else {
+			intervals[instrument] = interval
 		}
 	}
 
-	return err
+	return fallback, intervals, nil
 }
 
-type PriceOrHeartbeat struct {
-	Type string `json:"type"`
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
-func candlesAction(c *cli.Context) error {
-	instrument := c.String("instrument")
-	granularity := c.String("granularity")
+func getCandlesStream(session *Session, options *CandlesOptions) (err error) {
+	instrument := options.Instrument
+	granularity := options.Granularity
+	pollingInterval := options.PollingInterval
+	completedOnly := options.CompletedOnly
 
-	from := time.Now()
-	_from := c.Timestamp("from")
-	if _from != nil {
-		from = *_from
+	if _, err := GranularityDuration(granularity); err != nil {
+		return err
 	}
 
-	pollingInterval := c.Duration("polling-interval")
-	completedOnly := c.Bool("completed-only")
-	configPath := c.String("config")
-	err := getCandlesStream(instrument, granularity, from, pollingInterval, completedOnly, configPath)
-
-	return err
-}
+	var tradingHours *TradingHours
+	if options.Session != "" {
+		tradingHours, err = ParseTradingHours(options.Session, options.SessionTimezone)
+		if err != nil {
+			return err
+		}
+	}
 
-func getCandlesStream(instrument string, granularity string, from time.Time, pollingInterval time.Duration, completedOnly bool, configPath string) error {
-	credentials, err := GetCredentials(configPath)
-	if err != nil {
-		return err
+	from := session.Now()
+	if options.From != nil {
+		from = *options.From
 	}
 
 	var lastCandle *Candlestick = nil
+	if options.StateFile != "" {
+		lastCandle, err = ReadCandleState(options.StateFile)
+		if err != nil {
+			return err
+		}
+		if lastCandle != nil {
+			from = lastCandle.Time
+		}
+	}
+
+	// Only the default from, the local now, depends on the local clock. With
+	// --print-curl, the candles request itself is printed, not the probe.
+	if options.From == nil && lastCandle == nil && !printingCurl() {
+		from = capToServerTime(session, instrument, from)
+	}
+
+	writer := CandleWriter{Output: session.Output, BatchSize: options.BatchSize, Delta: options.Delta, WithTypical: options.WithTypical}
+	writer.FloatVolume = options.VolumeType == "float"
+	if options.Annotate {
+		writer.Instrument = instrument
+	}
+	if options.AnnotateGranularity {
+		writer.Granularity = granularity
+	}
+	if options.SMA > 0 {
+		writer.SMA = &MovingAverage{Period: options.SMA}
+	}
+	if options.VWAP > 0 {
+		writer.VWAP = &VWAP{Period: options.VWAP}
+	}
+	if options.TradingDate {
+		writer.TradingDate, err = NewTradingDate(granularity, options.AlignmentTimezone)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if flushErr := writer.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
+
+	write := writer.Write
+	var ticker *CandleTicker
+	if options.EmitTick > 0 {
+		ticker = NewCandleTicker(session.Context, options.EmitTick, &writer)
+		defer ticker.Stop()
+		write = ticker.Write
+	}
+
+	volumeGate := VolumeDeltaGate{Delta: options.EmitVolumeDelta}
+
+	interval := pollingInterval
+	adaptive := AdaptivePolling{Interval: pollingInterval}
+
+	stop := func() error {
+		if ticker != nil {
+			ticker.Stop()
+		}
+		if options.DropIncompleteOnExit {
+			return settleIncomplete(session, options, &writer)
+		}
+		return nil
+	}
 
 	for {
-		candles, err := getCandlesForStream(credentials, instrument, granularity, from)
+		candles, err := getCandlesForStream(session, options, from)
+		if session.Context.Err() != nil {
+			return stop()
+		}
 		if err != nil {
 			return err
 		}
 
+		fresh := false
 		for _, candle := range *candles {
+			if lastCandle != nil && !candle.NewerThan(lastCandle) {
+				continue
+			}
+			fresh = true
+
 			if completedOnly && candle.Complete == false {
 				continue
 			}
 
-			if lastCandle == nil || candle.NewerThan(lastCandle) {
-				bytes, err := json.Marshal(candle)
-				if err != nil {
-					return err
-				}
-				fmt.Println(string(bytes))
+			if tradingHours != nil && !tradingHours.Contains(candle.Time) {
+				continue
+			}
+
+			if volumeGate.Delta > 0 && !volumeGate.Pass(&candle) {
+				continue
+			}
+
+			if err := write(candle); err != nil {
+				return err
 			}
 		}
 
 		if len(*candles) != 0 {
 			lastCandle = &(*candles)[len(*candles)-1]
 			from = lastCandle.Time
+
+			if options.StateFile != "" {
+				if err := WriteCandleState(options.StateFile, lastCandle); err != nil {
+					return err
+				}
+			}
 		}
 
-		time.Sleep(pollingInterval)
+		if options.AdaptivePolling {
+			interval = adaptive.Next(fresh)
+		}
+
+		// A full page means more history is waiting, which is fetched
+		// right away so that catching up is not slowed by the interval.
+		if len(*candles) >= candlesPageSize {
+			continue
+		}
+
+		select {
+		case <-session.Context.Done():
+			return stop()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// candlesPageSize is the most candles OANDA returns per request. The history
+// since --from is fetched and written a page at a time, so memory stays
+// bounded by one page however long the lookback.
+const candlesPageSize = 5000
+
+const (
+	// adaptiveStalePolls is how many consecutive polls without new candles
+	// --adaptive-polling tolerates before backing off, e.g. over a weekend.
+	adaptiveStalePolls = 3
+	// adaptiveMaxPollingInterval caps the backed off polling interval.
+	adaptiveMaxPollingInterval = 1 * time.Minute
+)
+
+// AdaptivePolling doubles the polling interval, up to
+// adaptiveMaxPollingInterval, for every poll without new candles once there
+// were adaptiveStalePolls in a row, and returns to Interval with new candles.
+type AdaptivePolling struct {
+	Interval   time.Duration
+	stalePolls int
+	backoff    time.Duration
+}
+
+// Next is the interval until the next poll, after a poll which found new
+// candles or not.
+func (self *AdaptivePolling) Next(fresh bool) time.Duration {
+	if fresh {
+		self.stalePolls = 0
+		self.backoff = 0
+		return self.Interval
+	}
+
+	self.stalePolls++
+	if self.stalePolls < adaptiveStalePolls {
+		return self.Interval
+	}
+	if self.backoff == 0 {
+		self.backoff = self.Interval
+	}
+	self.backoff *= 2
+	if self.backoff > adaptiveMaxPollingInterval {
+		self.backoff = adaptiveMaxPollingInterval
+	}
+	return self.backoff
+}
+
+// VolumeDeltaGate lets a forming candle through only once its volume grew by
+// at least Delta since it was last let through. Completed candles always pass.
+type VolumeDeltaGate struct {
+	Delta  int
+	time   time.Time
+	volume int
+}
+
+func (self *VolumeDeltaGate) Pass(candle *Candlestick) bool {
+	if candle.Complete {
+		self.time = candle.Time
+		self.volume = candle.Volume
+		return true
+	}
+
+	base := 0
+	if candle.Time.Equal(self.time) {
+		base = self.volume
 	}
+	if candle.Volume-base < self.Delta {
+		return false
+	}
+
+	self.time = candle.Time
+	self.volume = candle.Volume
+	return true
 }
 
 func GetIntPointer(val int) *int {
@@ -340,6 +2128,35 @@ func (self *Candlestick) NewerThan(other *Candlestick) bool {
 	}
 }
 
+// Prices are the mid prices of the candle, or the bid or ask prices when the
+// candle has no mid, depending on the price component fetched.
+func (self *Candlestick) Prices() *CandlestickData {
+	for _, data := range []*CandlestickData{self.Mid, self.Bid, self.Ask} {
+		if data != nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// Typical is the typical price (H+L+C)/3 of Prices. ok is false when the
+// candle has no prices or they are not numbers.
+func (self *Candlestick) Typical() (typical float64, ok bool) {
+	data := self.Prices()
+	if data == nil {
+		return 0, false
+	}
+	sum := 0.0
+	for _, price := range []string{data.H, data.L, data.C} {
+		value, err := strconv.ParseFloat(price, 64)
+		if err != nil {
+			return 0, false
+		}
+		sum += value
+	}
+	return sum / 3, true
+}
+
 type CandlestickData struct {
 	O string `json:"o"`
 	H string `json:"h"`
@@ -347,35 +2164,51 @@ type CandlestickData struct {
 	C string `json:"c"`
 }
 
-func getCandlesForStream(credentials *Credentials, instrument string, granularity string, from time.Time) (*[]Candlestick, error) {
-	account := credentials.Default
-
-	baseUrl := "https://api-fxpractice.oanda.com"
-	query := fmt.Sprintf("from=%s&granularity=%s&price=MBA&count=5000", from.Format(time.RFC3339), granularity)
-	url := fmt.Sprintf("%s/v3/instruments/%s/candles?%s", baseUrl, instrument, query)
+func getCandlesForStream(session *Session, options *CandlesOptions, from time.Time) (*[]Candlestick, error) {
+	price := ResolvePrice(options.Price, &session.Credentials.Default)
+	query := fmt.Sprintf("from=%s&granularity=%s&price=%s&count=%d", from.Format(time.RFC3339), options.Granularity, price, candlesPageSize)
+	if options.Smooth {
+		query += "&smooth=true"
+	}
+	query += fmt.Sprintf("&dailyAlignment=%d&alignmentTimezone=%s&weeklyAlignment=%s", options.DailyAlignment, url.QueryEscape(options.AlignmentTimezone), options.WeeklyAlignment)
 
-	req, err := http.NewRequest("GET", url, nil)
+	body, err := getCandles(session, options.Instrument, query)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", account.Token))
 
-	client := new(http.Client)
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	return body.Candles, nil
+}
+
+// ResolvePrice picks the candle price component: the --price flag, then the
+// profile's default_price, then MBA.
+func ResolvePrice(price string, account *Account) string {
+	if price != "" {
+		return price
 	}
-	defer res.Body.Close()
+	if account.DefaultPrice != "" {
+		return account.DefaultPrice
+	}
+	return defaultPrice
+}
 
-	bytes, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+// ValidatePrice checks that price is a combination of M, B and A.
+func ValidatePrice(price string) error {
+	for _, component := range price {
+		if !strings.ContainsRune(defaultPrice, component) || strings.Count(price, string(component)) != 1 {
+			return fmt.Errorf("invalid price %q, expected a combination of M, B and A", price)
+		}
 	}
+	return nil
+}
 
-	if res.StatusCode != 200 {
-		fmt.Fprintln(os.Stderr, res.Status)
-		return nil, errors.New(string(bytes))
+func getCandles(session *Session, instrument string, query string) (*CandlesResponseBody, error) {
+	baseUrl := session.Credentials.Default.ApiUrl()
+	url := fmt.Sprintf("%s/v3/instruments/%s/candles?%s", baseUrl, instrument, query)
+
+	bytes, _, err := session.Get(url)
+	if err != nil {
+		return nil, err
 	}
 
 	// fmt.Fprintln(os.Stderr, string(bytes))
@@ -384,96 +2217,313 @@ func getCandlesForStream(credentials *Credentials, instrument string, granularit
 	if err := json.Unmarshal(bytes, &body); err != nil {
 		return nil, err
 	}
+	if body.Candles == nil {
+		body.Candles = &[]Candlestick{}
+	}
 
-	return body.Candles, nil
+	return &body, nil
 }
 
-func transactionsAction(c *cli.Context) error {
-	heartbeat := c.Bool("heartbeat")
-	heartbeatTimeout := c.Duration("heartbeat-timeout")
-	configPath := c.String("config")
-	err := getTransactionStream(heartbeat, heartbeatTimeout, configPath)
+// clockSkewThreshold is how far `from` may be ahead of the server clock before warning.
+const clockSkewThreshold = 5 * time.Second
 
-	return err
+// capToServerTime caps from at OANDA's clock, so that a local clock running
+// ahead does not ask for candles of the future. The probe is best effort:
+// when it fails, from is kept as it is.
+func capToServerTime(session *Session, instrument string, from time.Time) time.Time {
+	serverTime, err := getServerTime(session, instrument)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot read the server clock, using the local clock: %s\n", err)
+		return from
+	}
+	if skew := from.Sub(*serverTime); skew > 0 {
+		if skew > clockSkewThreshold {
+			fmt.Fprintf(os.Stderr, "warning: local clock is %s ahead of server, capping from to %s\n", skew, serverTime.Format(time.RFC3339))
+		}
+		return *serverTime
+	}
+	return from
 }
 
-func getTransactionStream(heartbeat bool, heartbeatTimeout time.Duration, configPath string) error {
-	credentials, err := GetCredentials(configPath)
+// getServerTime reads OANDA's clock from the Date header of a minimal candles request.
+func getServerTime(session *Session, instrument string) (*time.Time, error) {
+	baseUrl := session.Credentials.Default.ApiUrl()
+	url := fmt.Sprintf("%s/v3/instruments/%s/candles?count=1", baseUrl, instrument)
+
+	_, header, err := session.Get(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	account := credentials.Default
 
-	baseUrl := "https://stream-fxpractice.oanda.com"
-	url := fmt.Sprintf("%s/v3/accounts/%s/transactions/stream", baseUrl, account.AccountId)
+	serverTime, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverTime, nil
+}
+
+type TransactionsOptions struct {
+	StreamOptions `yaml:",inline"`
+	Explain       bool `yaml:"explain"`
+	Coalesce      bool `yaml:"coalesce"`
+	// DedupAcrossReconnect skips transactions whose id was recently emitted,
+	// which a resumed stream may deliver again.
+	DedupAcrossReconnect bool   `yaml:"dedup_across_reconnect"`
+	Heartbeat            bool   `yaml:"heartbeat"`
+	HeartbeatAs          string `yaml:"emit_heartbeat_as"`
+	// Instrument restricts the transactions to these instruments (CSV).
+	// IncludeAccountLevel still lets through those without an instrument.
+	Instrument          string `yaml:"instrument"`
+	IncludeAccountLevel bool   `yaml:"include_account_level"`
+	// Aggregate, when set, replaces the transactions by their counts per
+	// window of this length.
+	Aggregate time.Duration `yaml:"aggregate_transactions"`
+	// SkipSnapshot drops, and TagSnapshot marks, the messages which are
+	// neither transactions nor heartbeats, such as a state snapshot.
+	SkipSnapshot bool `yaml:"skip_snapshot"`
+	TagSnapshot  bool `yaml:"tag_snapshot"`
+	// Fields, when set, are the only fields of the transactions kept (CSV).
+	Fields string `yaml:"fields"`
+	// RunningPL logs the realized P/L summed since the command started. It
+	// carries on over reconnects, and starts from zero on every run.
+	RunningPL bool `yaml:"running_pl"`
+}
+
+func (self *TransactionsOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TransactionsOptions
+	*self = TransactionsOptions{
+		StreamOptions: defaultStreamOptions(defaultTransactionsHeartbeatTimeout),
+	}
+	return unmarshal((*plain)(self))
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+func transactionsAction(c *cli.Context) (err error) {
+	streamOptions, err := streamOptionsFlags(c)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", account.Token))
 
-	client := new(http.Client)
-	res, err := client.Do(req)
+	options := TransactionsOptions{
+		StreamOptions:        *streamOptions,
+		Explain:              c.Bool("explain"),
+		Coalesce:             c.Bool("coalesce"),
+		DedupAcrossReconnect: c.Bool("dedup-across-reconnect"),
+		Heartbeat:            c.Bool("heartbeat"),
+		HeartbeatAs:          c.String("emit-heartbeat-as"),
+		Instrument:           c.String("instrument"),
+		IncludeAccountLevel:  c.Bool("include-account-level"),
+		Aggregate:            c.Duration("aggregate-transactions"),
+		SkipSnapshot:         c.Bool("skip-snapshot"),
+		TagSnapshot:          c.Bool("tag-snapshot"),
+		Fields:               c.String("fields"),
+		RunningPL:            c.Bool("running-pl"),
+	}
+	if options.SkipSnapshot && options.TagSnapshot {
+		return errors.New("--skip-snapshot and --tag-snapshot are mutually exclusive")
+	}
+	session, err := NewProfileSession(c.String("config"), c.String("profile"))
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode != 200 {
-		fmt.Fprintln(os.Stderr, res.Status)
-		body, err := ioutil.ReadAll(res.Body)
+	cancel := session.SetDeadline(c.Timestamp("deadline"))
+	defer cancel()
+	defer session.CancelOnSignal()()
+	if err := session.OpenOutput(c); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if options.Fields != "" {
+		fields, err := ParseFieldPaths(options.Fields)
 		if err != nil {
 			return err
 		}
-		return errors.New(string(body))
+		if field, ok := fields.Overlap(session.Output.Transforms.Strip); ok {
+			return fmt.Errorf("field %s is both selected by --fields and removed by --strip-fields", field)
+		}
+	}
+	if addr := c.String("health-addr"); addr != "" {
+		if err := session.ServeHealth(addr, options.HeartbeatTimeout); err != nil {
+			return err
+		}
 	}
+	if addr := c.String("metrics-addr"); addr != "" {
+		if err := session.ServeMetrics(addr); err != nil {
+			return err
+		}
+	}
+	if !c.Bool("quiet") {
+		account := session.Credentials.Default
+		var instruments []string
+		if options.Instrument != "" {
+			instruments = []string{options.Instrument}
+		}
+		session.PrintBanner(instruments, "", fmt.Sprintf("%s/v3/accounts/%s/transactions/stream", account.StreamUrl(), account.AccountId))
+	}
+	err = getTransactionStream(session, &options)
 
-	heartbeatChannel := make(chan struct{})
+	return err
+}
 
-	if heartbeatTimeout != 0 {
-		go func() {
-			for {
-				select {
-				case <-heartbeatChannel:
-				case <-time.After(heartbeatTimeout):
-					panic("heartbeat timeout")
-				}
-			}
-		}()
-	}
+func getTransactionStream(session *Session, options *TransactionsOptions) error {
+	account := session.Credentials.Default
+	heartbeat := options.Heartbeat
+	heartbeatAs := options.HeartbeatAs
 
-	reader := bufio.NewReader(res.Body)
-	for {
-		line, _, err := reader.ReadLine()
+	baseUrl := account.StreamUrl()
+	url := fmt.Sprintf("%s/v3/accounts/%s/transactions/stream", baseUrl, account.AccountId)
+
+	coalescer := TransactionCoalescer{}
+	recentIds := NewRecentIds(recentTransactionIds)
+	instruments := []string{}
+	if options.Instrument != "" {
+		instruments = strings.Split(options.Instrument, ",")
+	}
+	var fields FieldPaths
+	if options.Fields != "" {
+		var err error
+		fields, err = ParseFieldPaths(options.Fields)
 		if err != nil {
 			return err
 		}
-		if line == nil {
-			break
-		}
+	}
+	// warned are the fields --fields warned about, once each.
+	warned := map[string]bool{}
+	runningPL := RunningPL{}
+	var aggregator *TransactionAggregator
+	if options.Aggregate > 0 {
+		aggregator = &TransactionAggregator{Window: options.Aggregate, Output: session.Output}
+	}
 
+	err := streamLines(session, url, &options.StreamOptions, func(line []byte) (bool, error) {
 		var th TransactionOrHeartbeat
 		if err := json.Unmarshal(line, &th); err != nil {
-			return err
+			return false, err
 		}
 
 		if th.Type == "HEARTBEAT" {
-			if heartbeatTimeout != 0 {
-				heartbeatChannel <- struct{}{}
+			if aggregator != nil {
+				if at, err := time.Parse(time.RFC3339Nano, th.Time); err == nil {
+					if err := aggregator.Advance(at); err != nil {
+						return true, err
+					}
+				}
 			}
-			if heartbeat {
-				fmt.Println(string(line))
+			if heartbeatAs != "" {
+				return true, session.Output.Println(formatHeartbeat(heartbeatAs, th.Time))
+			} else if heartbeat {
+				return true, session.Output.Println(string(line))
 			}
-		} else {
-			fmt.Println(string(line))
+			return true, nil
 		}
-	}
 
+		// Every transaction has an id, so a message without one is a
+		// snapshot of the account state rather than a transaction.
+		if th.Id == "" {
+			if options.SkipSnapshot {
+				return false, nil
+			}
+			if options.TagSnapshot {
+				return false, session.Output.Emit(injectField(string(line), "_snapshot", true))
+			}
+		}
+
+		if len(instruments) != 0 {
+			if th.Instrument == "" && !options.IncludeAccountLevel {
+				return false, nil
+			}
+			if th.Instrument != "" && !containsString(instruments, th.Instrument) {
+				return false, nil
+			}
+		}
+
+		if options.DedupAcrossReconnect && th.Id != "" && !recentIds.Add(th.Id) {
+			return false, nil
+		}
+
+		if options.Coalesce {
+			duplicate, err := coalescer.Duplicate(line)
+			if err != nil {
+				return false, err
+			}
+			if duplicate {
+				return false, nil
+			}
+		}
+
+		if options.RunningPL && th.PL != "" {
+			if err := runningPL.Add(th.PL); err != nil {
+				return false, err
+			}
+			fmt.Fprintf(os.Stderr, "running P/L: %s over %d fills\n", strconv.FormatFloat(runningPL.Total, 'f', 4, 64), runningPL.Fills)
+		}
+
+		if aggregator != nil && th.Id != "" {
+			at, err := time.Parse(time.RFC3339Nano, th.Time)
+			if err != nil {
+				return false, err
+			}
+			return false, aggregator.Add(th.Type, at)
+		}
+
+		if options.Explain {
+			explained, err := explainTransaction(line)
+			if err != nil {
+				return false, err
+			}
+			line = explained
+		}
+		if fields != nil {
+			projected, missing, err := fields.Select(string(line))
+			if err != nil {
+				return false, err
+			}
+			for _, field := range missing {
+				if !warned[field] {
+					warned[field] = true
+					fmt.Fprintf(os.Stderr, "warning: field %s is missing from a %s transaction\n", field, th.Type)
+				}
+			}
+			return false, session.Output.Emit(projected)
+		}
+		return false, session.Output.Emit(string(line))
+	})
+
+	// The final, partial window is emitted also when the stream failed.
+	if aggregator != nil {
+		if flushErr := aggregator.Flush(); err == nil {
+			err = flushErr
+		}
+	}
 	return err
 }
 
 type TransactionOrHeartbeat struct {
+	Id   string `json:"id"`
 	Type string `json:"type"`
+	Time string `json:"time"`
+	// Instrument is set on order, fill and trade transactions only.
+	Instrument string `json:"instrument"`
+	// PL is the realized profit or loss of a fill.
+	PL string `json:"pl"`
+}
+
+// RunningPL sums the realized P/L of fills (--running-pl).
+type RunningPL struct {
+	Total float64
+	Fills int
+}
+
+func (self *RunningPL) Add(pl string) error {
+	value, err := strconv.ParseFloat(pl, 64)
+	if err != nil {
+		return fmt.Errorf("invalid pl %q: %w", pl, err)
+	}
+	self.Total += value
+	self.Fills++
+	return nil
 }
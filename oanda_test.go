@@ -0,0 +1,1344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// rewriteTransport sends every request to target, whatever OANDA URL it is for.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (self *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = self.target.Scheme
+	req.URL.Host = self.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestSession returns a session whose requests are served by handler and
+// whose output is written to the returned buffer.
+func newTestSession(t *testing.T, handler http.Handler) (*Session, *bytes.Buffer) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := &bytes.Buffer{}
+	session := &Session{
+		Context:     context.Background(),
+		Credentials: &Credentials{Default: Account{AccountId: "101-001-0000000-001", Token: "token"}},
+		Client:      &http.Client{Transport: &rewriteTransport{target: target}},
+		Output:      &Output{Writer: &LockedWriter{Writer: output}},
+		Headers:     http.Header{},
+	}
+	return session, output
+}
+
+// newTestContext parses args with flags, as the command defining them would.
+func newTestContext(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestCapToServerTime(t *testing.T) {
+	serverTime := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", serverTime.Format(http.TimeFormat))
+		w.Write([]byte(`{"candles":[]}`))
+	}))
+
+	tests := []struct {
+		name  string
+		local time.Time
+		want  time.Time
+	}{
+		{"far ahead", serverTime.Add(time.Hour), serverTime},
+		{"slightly ahead", serverTime.Add(time.Second), serverTime},
+		{"in sync", serverTime, serverTime},
+		{"behind", serverTime.Add(-time.Minute), serverTime.Add(-time.Minute)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session.now = func() time.Time { return test.local }
+			got := capToServerTime(session, "EUR_USD", session.Now())
+			if !got.Equal(test.want) {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCapToServerTimeFailedProbe(t *testing.T) {
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"errorMessage":"unavailable"}`, http.StatusServiceUnavailable)
+	}))
+
+	local := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	if got := capToServerTime(session, "EUR_USD", local); !got.Equal(local) {
+		t.Errorf("got %s, want the local %s", got, local)
+	}
+}
+
+func TestGetCredentialsStrictProfiles(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{"valid", "default:\n  account_id: a\n  token: t\nlive:\n  account_id: b\n  token: u\n", ""},
+		{"misspelt default", "defualt:\n  account_id: a\n  token: t\n", "misspelling"},
+		{"capitalized default", "Default:\n  account_id: a\n  token: t\n", "misspelling"},
+		{"profile without token", "default:\n  account_id: a\n  token: t\nlive:\n  account_id: b\n", "needs both"},
+		{"unknown account key", "default:\n  acount_id: a\n  token: t\n", "acount_id"},
+	}
+
+	strictConfig = true
+	defer func() { strictConfig = false }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir() + "/credentials.yaml"
+			if err := ioutil.WriteFile(path, []byte(test.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := GetCredentials(path, defaultProfile)
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got error %v, want one mentioning %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestIsLookalike(t *testing.T) {
+	tests := []struct {
+		a    string
+		want bool
+	}{
+		{"default", true},
+		{"DEFAULT", true},
+		{"defualt", true},
+		{"defalt", true},
+		{"deafult", true},
+		{"live", false},
+		{"demo", false},
+		{"practice", false},
+	}
+	for _, test := range tests {
+		if got := isLookalike(test.a, defaultProfile); got != test.want {
+			t.Errorf("isLookalike(%q) = %v, want %v", test.a, got, test.want)
+		}
+	}
+}
+
+func TestShardInstruments(t *testing.T) {
+	tests := []struct {
+		instruments string
+		limit       int
+		want        []string
+	}{
+		{"A,B,C", 3, []string{"A,B,C"}},
+		{"A,B,C,D", 3, []string{"A,C", "B,D"}},
+		{"A,B,C,D,E", 2, []string{"A,D", "B,E", "C"}},
+		{"A,B,C,D,E,F,G", 3, []string{"A,D,G", "B,E", "C,F"}},
+		{"A", 1, []string{"A"}},
+	}
+	for _, test := range tests {
+		shards := ShardInstruments(strings.Split(test.instruments, ","), test.limit)
+		got := []string{}
+		for _, shard := range shards {
+			if len(shard) > test.limit {
+				t.Errorf("%s by %d: shard %v exceeds the limit", test.instruments, test.limit, shard)
+			}
+			got = append(got, strings.Join(shard, ","))
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s by %d: got %v, want %v", test.instruments, test.limit, got, test.want)
+		}
+	}
+}
+
+// testCandle is a mid candle with the given high, low and close.
+func testCandle(h, l, c string, volume int, complete bool) *Candlestick {
+	return &Candlestick{Complete: complete, Volume: volume, Mid: &CandlestickData{O: c, H: h, L: l, C: c}}
+}
+
+// approx compares computed prices to a precision far below a pip.
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestCandlestickTypical(t *testing.T) {
+	tests := []struct {
+		name   string
+		candle *Candlestick
+		want   float64
+		ok     bool
+	}{
+		{"mid", testCandle("1.3", "1.1", "1.2", 0, true), 1.2, true},
+		{"bid only", &Candlestick{Bid: &CandlestickData{H: "3", L: "1", C: "5"}}, 3, true},
+		{"no prices", &Candlestick{}, 0, false},
+		{"not a number", testCandle("1.3", "", "1.2", 0, true), 0, false},
+	}
+	for _, test := range tests {
+		got, ok := test.candle.Typical()
+		if ok != test.ok || !approx(got, test.want) {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseCandleSpec(t *testing.T) {
+	tests := []struct {
+		value string
+		want  *CandleSpec
+	}{
+		{"EUR_USD:M1", &CandleSpec{Instrument: "EUR_USD", Granularity: "M1"}},
+		{"EUR_USD:M1:BM", &CandleSpec{Instrument: "EUR_USD", Granularity: "M1", Price: "BM"}},
+		{"USD_JPY:D:A", &CandleSpec{Instrument: "USD_JPY", Granularity: "D", Price: "A"}},
+		{"EUR_USD", nil},
+		{":M1", nil},
+		{"EUR_USD:M3", nil},
+		{"EUR_USD:M1:X", nil},
+		{"EUR_USD:M1:BM:extra", nil},
+	}
+	for _, test := range tests {
+		got, err := ParseCandleSpec(test.value)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil || *got != *test.want {
+			t.Errorf("%q: got %+v, %v, want %+v", test.value, got, err, *test.want)
+		}
+	}
+}
+
+func TestRunningPL(t *testing.T) {
+	tests := []struct {
+		name  string
+		pls   []string
+		total float64
+		fills int
+		valid bool
+	}{
+		{"none", nil, 0, 0, true},
+		{"gains and losses", []string{"12.5000", "-2.2500", "0.0000"}, 10.25, 3, true},
+		{"tiny amounts", []string{"0.0001", "0.0002"}, 0.0003, 2, true},
+		{"not a number", []string{"1.0", "n/a"}, 1, 1, false},
+	}
+	for _, test := range tests {
+		running := RunningPL{}
+		var err error
+		for _, pl := range test.pls {
+			if err = running.Add(pl); err != nil {
+				break
+			}
+		}
+		if test.valid != (err == nil) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if !approx(running.Total, test.total) || running.Fills != test.fills {
+			t.Errorf("%s: got %v over %d fills, want %v over %d", test.name, running.Total, running.Fills, test.total, test.fills)
+		}
+	}
+}
+
+// candlePoll is a request of the candles stream and when it arrived.
+type candlePoll struct {
+	query url.Values
+	at    time.Time
+}
+
+// pollCandles runs getCandlesStream against a server answering the nth poll
+// with pages[n], which stops the stream once every page was served. It
+// returns the lines written and the polls.
+func pollCandles(t *testing.T, options CandlesOptions, pages ...[]Candlestick) ([]string, []candlePoll) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	polls := []candlePoll{}
+	session, output := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls = append(polls, candlePoll{query: r.URL.Query(), at: time.Now()})
+		candles := []Candlestick{}
+		if len(polls) > len(pages) {
+			cancel()
+		} else {
+			candles = pages[len(polls)-1]
+		}
+		json.NewEncoder(w).Encode(CandlesResponseBody{Candles: &candles, Granularity: options.Granularity, Instrument: options.Instrument})
+	}))
+	session.Context = ctx
+
+	if options.Instrument == "" {
+		options.Instrument = "EUR_USD"
+	}
+	if options.Granularity == "" {
+		options.Granularity = "M1"
+	}
+	if options.From == nil {
+		from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+		options.From = &from
+	}
+	if options.PollingInterval == 0 {
+		options.PollingInterval = time.Millisecond
+	}
+	if err := getCandlesStream(session, &options); err != nil {
+		t.Fatal(err)
+	}
+	if len(polls) <= len(pages) {
+		t.Fatalf("the stream stopped after %d of %d pages", len(polls), len(pages))
+	}
+	return outputLines(output), polls
+}
+
+// minuteCandle is a candle of the minute n after 2021-03-01T00:00:00Z.
+func minuteCandle(n int, volume int, complete bool) Candlestick {
+	candle := testCandle("1.2", "1.0", "1.1", volume, complete)
+	candle.Time = time.Date(2021, 3, 1, 0, n, 0, 0, time.UTC)
+	return *candle
+}
+
+func TestCandlesGranularityTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  CandlesOptions
+		prefix   string
+		polledAs string
+	}{
+		{"single granularity", CandlesOptions{Granularity: "M1"}, `{"complete"`, "M1"},
+		{"M1 of several", CandlesOptions{Granularity: "M1", AnnotateGranularity: true}, `{"granularity":"M1",`, "M1"},
+		{"M5 of several", CandlesOptions{Granularity: "M5", AnnotateGranularity: true}, `{"granularity":"M5",`, "M5"},
+		{"with the instrument", CandlesOptions{Granularity: "M5", Annotate: true, AnnotateGranularity: true}, `{"instrument":"EUR_USD","granularity":"M5",`, "M5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines, polls := pollCandles(t, test.options, []Candlestick{minuteCandle(0, 1, true), minuteCandle(5, 2, true)})
+			if len(lines) != 2 {
+				t.Fatalf("got %v", lines)
+			}
+			for _, line := range lines {
+				if !strings.HasPrefix(line, test.prefix) {
+					t.Errorf("got %s, want it to start with %s", line, test.prefix)
+				}
+			}
+			if got := polls[0].query.Get("granularity"); got != test.polledAs {
+				t.Errorf("polled granularity %s, want %s", got, test.polledAs)
+			}
+		})
+	}
+}
+
+func TestCandleSeriesAnnotate(t *testing.T) {
+	flags := []cli.Flag{
+		&cli.BoolFlag{Name: "annotate"},
+		&cli.BoolFlag{Name: "since-last-run"},
+		&cli.StringFlag{Name: "state-file"},
+	}
+	eurM1 := CandleSpec{Instrument: "EUR_USD", Granularity: "M1"}
+	eurM5 := CandleSpec{Instrument: "EUR_USD", Granularity: "M5"}
+	jpyM1 := CandleSpec{Instrument: "USD_JPY", Granularity: "M1"}
+	tests := []struct {
+		name        string
+		args        []string
+		specs       []CandleSpec
+		instrument  bool
+		granularity bool
+	}{
+		{"single series", nil, []CandleSpec{eurM1}, false, false},
+		{"annotated", []string{"--annotate"}, []CandleSpec{eurM1}, true, true},
+		{"several instruments", nil, []CandleSpec{eurM1, jpyM1}, true, false},
+		{"several granularities", nil, []CandleSpec{eurM1, eurM5}, false, true},
+		{"several annotated", []string{"--annotate"}, []CandleSpec{eurM1, jpyM1}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			series, err := candleSeries(newTestContext(t, flags, test.args...), CandlesOptions{}, test.specs, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(series) != len(test.specs) {
+				t.Fatalf("got %d series, want %d", len(series), len(test.specs))
+			}
+			for i, o := range series {
+				if o.Instrument != test.specs[i].Instrument || o.Granularity != test.specs[i].Granularity {
+					t.Errorf("series %d is %s %s", i, o.Instrument, o.Granularity)
+				}
+				if o.Annotate != test.instrument || o.AnnotateGranularity != test.granularity {
+					t.Errorf("series %d annotates the instrument %v and the granularity %v, want %v and %v", i, o.Annotate, o.AnnotateGranularity, test.instrument, test.granularity)
+				}
+			}
+		})
+	}
+
+	c := newTestContext(t, flags, "--since-last-run", "--state-file", "state.json")
+	if _, err := candleSeries(c, CandlesOptions{}, []CandleSpec{eurM1, eurM5}, nil); err == nil {
+		t.Error("--state-file was accepted for two series")
+	}
+	if _, err := candleSeries(newTestContext(t, flags), CandlesOptions{}, []CandleSpec{eurM1}, map[string]time.Duration{"USD_JPY": time.Second}); err == nil {
+		t.Error("an interval for another instrument was accepted")
+	}
+}
+
+func TestCandlesAnnotate(t *testing.T) {
+	lines, _ := pollCandles(t, CandlesOptions{Instrument: "USD_JPY", Granularity: "H1", Annotate: true, AnnotateGranularity: true}, []Candlestick{minuteCandle(0, 1, true)})
+	if len(lines) != 1 {
+		t.Fatalf("got %v", lines)
+	}
+	var candle struct {
+		Instrument  string `json:"instrument"`
+		Granularity string `json:"granularity"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &candle); err != nil {
+		t.Fatal(err)
+	}
+	if candle.Instrument != "USD_JPY" || candle.Granularity != "H1" {
+		t.Errorf("got %s", lines[0])
+	}
+}
+
+func TestCandlesVolumeType(t *testing.T) {
+	tests := []struct {
+		volumeType string
+		want       string
+		err        bool
+	}{
+		{"", `"volume":12,`, false},
+		{"int", `"volume":12,`, false},
+		{"float", `"volume":12.0,`, false},
+		{"double", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.volumeType, func(t *testing.T) {
+			options := CandlesOptions{VolumeType: test.volumeType}
+			if err := options.Validate(); (err != nil) != test.err {
+				t.Fatalf("got error %v, want an error: %v", err, test.err)
+			}
+			if test.err {
+				return
+			}
+			lines, _ := pollCandles(t, options, []Candlestick{minuteCandle(0, 12, true)})
+			if len(lines) != 1 || !strings.Contains(lines[0], test.want) {
+				t.Errorf("got %v, want %s", lines, test.want)
+			}
+		})
+	}
+}
+
+// lineCounter counts the lines written to it, safe to read while written.
+type lineCounter struct {
+	lines int64
+}
+
+func (self *lineCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&self.lines, int64(bytes.Count(p, []byte("\n"))))
+	return len(p), nil
+}
+
+func TestCandlesHistoryPages(t *testing.T) {
+	page := func(first int, n int) []Candlestick {
+		candles := []Candlestick{}
+		for i := first; i < first+n; i++ {
+			candles = append(candles, minuteCandle(i, 1, true))
+		}
+		return candles
+	}
+	pages := [][]Candlestick{page(0, candlesPageSize), page(candlesPageSize, candlesPageSize), page(2*candlesPageSize, 3)}
+
+	// Every poll notes how many candles were written before it.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	counter := &lineCounter{}
+	written := []int64{}
+	polls := []time.Time{}
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		written = append(written, atomic.LoadInt64(&counter.lines))
+		polls = append(polls, time.Now())
+		candles := []Candlestick{}
+		if len(polls) > len(pages) {
+			cancel()
+		} else {
+			candles = pages[len(polls)-1]
+		}
+		json.NewEncoder(w).Encode(CandlesResponseBody{Candles: &candles, Granularity: "M1", Instrument: "EUR_USD"})
+	}))
+	session.Context = ctx
+	session.Output.Writer = counter
+
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	options := CandlesOptions{Instrument: "EUR_USD", Granularity: "M1", From: &from, PollingInterval: 2 * time.Second}
+	if err := getCandlesStream(session, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each page is written before the next is requested.
+	want := []int64{0, candlesPageSize, 2 * candlesPageSize, 2*candlesPageSize + 3}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written before each poll %v, want %v", written, want)
+	}
+	// Full pages are followed right away, the last one after the interval.
+	for i, wait := range []time.Duration{polls[1].Sub(polls[0]), polls[2].Sub(polls[1])} {
+		if wait >= options.PollingInterval {
+			t.Errorf("page %d was requested after %s", i+2, wait)
+		}
+	}
+	if wait := polls[3].Sub(polls[2]); wait < options.PollingInterval {
+		t.Errorf("polled again after %s, before the interval", wait)
+	}
+}
+
+func TestCandlesStreamFlushesOnCancel(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	polls := 0
+	session, output := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		candles := []Candlestick{}
+		if polls > 1 {
+			// The candles of the first poll are still in the batch when
+			// the stream is stopped.
+			cancel()
+		} else {
+			for i := 0; i < 3; i++ {
+				candle := testCandle("1.1", "1.0", "1.05", 1, true)
+				candle.Time = start.Add(time.Duration(i) * time.Minute)
+				candles = append(candles, *candle)
+			}
+		}
+		json.NewEncoder(w).Encode(CandlesResponseBody{Candles: &candles})
+	}))
+	session.Context = ctx
+
+	options := CandlesOptions{Instrument: "EUR_USD", Granularity: "M1", From: &start, PollingInterval: time.Millisecond, BatchSize: 10}
+	if err := getCandlesStream(session, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch []Candlestick
+	if err := json.Unmarshal(output.Bytes(), &batch); err != nil {
+		t.Fatalf("%q: %s", output, err)
+	}
+	if len(batch) != 3 {
+		t.Errorf("got %d of 3 buffered candles", len(batch))
+	}
+}
+
+func TestCancelOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("interrupts cannot be sent on windows")
+	}
+	session := &Session{Context: context.Background()}
+	stop := session.CancelOnSignal()
+	defer stop()
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-session.Context.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the interrupt did not stop the session")
+	}
+}
+
+func TestCancelOnSignalStop(t *testing.T) {
+	session := &Session{Context: context.Background()}
+	stop := session.CancelOnSignal()
+	if session.Context.Err() != nil {
+		t.Fatal("the session stopped before any signal")
+	}
+	stop()
+	if session.Context.Err() == nil {
+		t.Error("stop did not release the session's context")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   http.Header
+		err    string
+	}{
+		{"one", []string{"X-Request-Source: backtest"}, http.Header{"X-Request-Source": {"backtest"}}, ""},
+		{"repeated", []string{"X-Tag: a", "x-tag:b"}, http.Header{"X-Tag": {"a", "b"}}, ""},
+		{"colon in the value", []string{"X-Trace:  id:42 "}, http.Header{"X-Trace": {"id:42"}}, ""},
+		{"none", nil, http.Header{}, ""},
+		{"authorization", []string{"Authorization: Bearer other"}, nil, "header Authorization cannot be overridden"},
+		{"authorization in any case", []string{"X-Ok: 1", "authorization: Bearer other"}, nil, "header authorization cannot be overridden"},
+		{"content type", []string{"CONTENT-TYPE: text/plain"}, nil, "header CONTENT-TYPE cannot be overridden"},
+		{"no colon", []string{"X-Request-Source backtest"}, nil, "invalid header"},
+		{"no key", []string{": backtest"}, nil, "invalid header"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseHeaders(test.values)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHeadersReachRequests(t *testing.T) {
+	received := make(chan http.Header, 2)
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.Write([]byte(`{"candles":[]}`))
+	}))
+	headers, err := ParseHeaders([]string{"X-Request-Source: backtest", "X-Tag: a", "X-Tag: b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Headers = headers
+
+	// Both the REST requests and the streams carry them.
+	if _, _, err := session.Get("https://api-fxpractice.oanda.com/v3/instruments/EUR_USD/candles"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := streamOnce(session, "https://stream-fxpractice.oanda.com/v3/accounts/1/pricing/stream", &StreamOptions{}, func([]byte) (bool, error) { return false, nil }); err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+
+	for _, request := range []string{"REST", "stream"} {
+		header := <-received
+		if got := header.Get("X-Request-Source"); got != "backtest" {
+			t.Errorf("%s: X-Request-Source is %q", request, got)
+		}
+		if got := header["X-Tag"]; !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("%s: X-Tag is %v", request, got)
+		}
+		if got := header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("%s: Authorization is %q", request, got)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"none", http.Header{"Content-Type": {"application/json"}}, ""},
+		{"sorted", http.Header{"X-Ratelimit-Remaining": {"99"}, "Retry-After": {"1"}, "Content-Type": {"application/json"}}, "rate-limit: Retry-After=1 X-Ratelimit-Remaining=99"},
+		{"dashed", http.Header{"Rate-Limit-Limit": {"100", "120"}}, "rate-limit: Rate-Limit-Limit=100,120"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rateLimitHeaders(test.header); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// captureStderr returns what f writes to stderr.
+func captureStderr(t *testing.T, f func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = writer
+	defer func() { os.Stderr = stderr }()
+
+	captured := make(chan []byte)
+	go func() {
+		bytes, _ := ioutil.ReadAll(reader)
+		captured <- bytes
+	}()
+	f()
+	writer.Close()
+	return string(<-captured)
+}
+
+func TestShowRateLimit(t *testing.T) {
+	for _, show := range []bool{false, true} {
+		session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Remaining", "99")
+			w.Write([]byte("{}"))
+		}))
+		session.ShowRateLimit = show
+		logged := captureStderr(t, func() {
+			if _, _, err := session.Get("https://api-fxpractice.oanda.com/v3/accounts"); err != nil {
+				t.Error(err)
+			}
+		})
+		want := ""
+		if show {
+			want = "rate-limit: X-Ratelimit-Remaining=99\n"
+		}
+		if logged != want {
+			t.Errorf("--show-rate-limit %v logged %q, want %q", show, logged, want)
+		}
+	}
+}
+
+func TestFormatHeartbeat(t *testing.T) {
+	tests := []struct {
+		shape string
+		want  string
+	}{
+		{`{"type":"hb","t":"<time>"}`, `{"type":"hb","t":"2021-03-01T00:00:00.000000000Z"}`},
+		{`<time> <time>`, `2021-03-01T00:00:00.000000000Z 2021-03-01T00:00:00.000000000Z`},
+		{`{"type":"hb"}`, `{"type":"hb"}`},
+	}
+	for _, test := range tests {
+		if got := formatHeartbeat(test.shape, "2021-03-01T00:00:00.000000000Z"); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.shape, got, test.want)
+		}
+	}
+}
+
+func TestEmitHeartbeatAs(t *testing.T) {
+	price := `{"type":"PRICE","instrument":"EUR_USD","time":"2021-03-01T00:00:01Z"}`
+	transaction := `{"id":"7","type":"ORDER_FILL","time":"2021-03-01T00:00:01Z"}`
+	heartbeat := `{"type":"HEARTBEAT","time":"2021-03-01T00:00:00Z"}`
+	transactionHeartbeat := `{"type":"HEARTBEAT","lastTransactionID":"6","time":"2021-03-01T00:00:00Z"}`
+	tests := []struct {
+		name      string
+		heartbeat bool
+		shape     string
+		want      string
+	}{
+		{"dropped", false, "", ""},
+		{"passed through", true, "", "as sent"},
+		{"reshaped", false, `{"type":"hb","t":"<time>"}`, `{"type":"hb","t":"2021-03-01T00:00:00Z"}`},
+		{"reshaping wins", true, `<time>`, `2021-03-01T00:00:00Z`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := func(sent string, data string) []string {
+				switch test.want {
+				case "":
+					return []string{data}
+				case "as sent":
+					return []string{sent, data}
+				default:
+					return []string{test.want, data}
+				}
+			}
+
+			got := pricingLines(t, PricingOptions{Heartbeat: test.heartbeat, HeartbeatAs: test.shape}, heartbeat, price)
+			if want := want(heartbeat, price); !reflect.DeepEqual(got, want) {
+				t.Errorf("pricing: got %v, want %v", got, want)
+			}
+			got = transactionLines(t, TransactionsOptions{Heartbeat: test.heartbeat, HeartbeatAs: test.shape}, transactionHeartbeat, transaction)
+			if want := want(transactionHeartbeat, transaction); !reflect.DeepEqual(got, want) {
+				t.Errorf("transactions: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPricingInstruments(t *testing.T) {
+	flags := []cli.Flag{&cli.StringFlag{Name: "instruments"}}
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"flag", []string{"--instruments", "EUR_USD,USD_JPY"}, []string{"EUR_USD", "USD_JPY"}},
+		{"arguments", []string{"EUR_USD", "USD_JPY"}, []string{"EUR_USD", "USD_JPY"}},
+		{"both", []string{"--instruments", "EUR_USD", "USD_JPY", "GBP_USD"}, []string{"EUR_USD", "USD_JPY", "GBP_USD"}},
+		{"none", nil, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := pricingInstruments(newTestContext(t, flags, test.args...))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		deadline := now.Add(d)
+		return &deadline
+	}
+	tests := []struct {
+		name     string
+		parent   time.Duration
+		deadline *time.Time
+		// want is when the context ends, 0 for never.
+		want time.Duration
+	}{
+		{"none", 0, nil, 0},
+		{"passed", 0, at(-time.Second), -time.Second},
+		{"ahead", 0, at(time.Hour), time.Hour},
+		{"sooner than the parent's", 2 * time.Hour, at(time.Hour), time.Hour},
+		{"later than the parent's", time.Hour, at(2 * time.Hour), time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := &Session{Context: context.Background()}
+			if test.parent != 0 {
+				ctx, cancel := context.WithDeadline(session.Context, now.Add(test.parent))
+				defer cancel()
+				session.Context = ctx
+			}
+			cancel := session.SetDeadline(test.deadline)
+			defer cancel()
+
+			deadline, ok := session.Context.Deadline()
+			if test.want == 0 {
+				if ok {
+					t.Errorf("got deadline %s, want none", deadline)
+				}
+				return
+			}
+			if !ok || !deadline.Equal(now.Add(test.want)) {
+				t.Errorf("got deadline %s, want %s", deadline, now.Add(test.want))
+			}
+			if (test.want < 0) != (session.Context.Err() != nil) {
+				t.Errorf("context error %v with the deadline %s away", session.Context.Err(), test.want)
+			}
+		})
+	}
+}
+
+func TestDeadlineEndsStream(t *testing.T) {
+	session, output := newTestSession(t, droppingStream(1))
+	deadline := time.Now().Add(100 * time.Millisecond)
+	cancel := session.SetDeadline(&deadline)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- getStream(session, &PricingOptions{})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("the stream ended with %v, want a clean stop", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream did not stop at the deadline")
+	}
+	if got := outputLines(output); len(got) != 1 {
+		t.Errorf("got %v, want the one price sent before the deadline", got)
+	}
+}
+
+func TestAdaptivePolling(t *testing.T) {
+	polling := AdaptivePolling{Interval: 20 * time.Second}
+	tests := []struct {
+		fresh bool
+		want  time.Duration
+	}{
+		{true, 20 * time.Second},
+		{false, 20 * time.Second},
+		{false, 20 * time.Second},
+		// Backing off from the third stale poll, up to the cap.
+		{false, 40 * time.Second},
+		{false, time.Minute},
+		{false, time.Minute},
+		// New candles restore the interval, and the count starts afresh.
+		{true, 20 * time.Second},
+		{false, 20 * time.Second},
+		{false, 20 * time.Second},
+		{false, 40 * time.Second},
+	}
+	for i, test := range tests {
+		if got := polling.Next(test.fresh); got != test.want {
+			t.Errorf("poll %d (fresh %v): got %s, want %s", i, test.fresh, got, test.want)
+		}
+	}
+}
+
+func TestCandlesStreamAdaptivePolling(t *testing.T) {
+	interval := 5 * time.Millisecond
+	stale := []Candlestick{minuteCandle(0, 1, false)}
+	pages := [][]Candlestick{stale, stale, stale, stale, stale, stale, {minuteCandle(0, 2, true), minuteCandle(1, 1, false)}}
+	lines, polls := pollCandles(t, CandlesOptions{PollingInterval: interval, AdaptivePolling: true}, pages...)
+
+	// The first poll is fresh and the next two are tolerated, then every
+	// stale poll doubles the wait.
+	waits := []time.Duration{interval, interval, interval, 2 * interval, 4 * interval, 8 * interval, interval}
+	for i, wait := range waits {
+		if gap := polls[i+1].at.Sub(polls[i].at); gap < wait {
+			t.Errorf("poll %d came %s after the previous one, want at least %s", i+2, gap, wait)
+		}
+	}
+	// The forming candle is written once, then its completion and the next.
+	if len(lines) != 3 || !strings.Contains(lines[1], `"complete":true`) {
+		t.Errorf("got %v", lines)
+	}
+}
+
+func TestVolumeDeltaGate(t *testing.T) {
+	gate := VolumeDeltaGate{Delta: 10}
+	tests := []struct {
+		candle Candlestick
+		want   bool
+	}{
+		// A new forming candle counts from zero.
+		{minuteCandle(0, 4, false), false},
+		{minuteCandle(0, 10, false), true},
+		// Then from the volume last let through.
+		{minuteCandle(0, 19, false), false},
+		{minuteCandle(0, 20, false), true},
+		{minuteCandle(0, 25, false), false},
+		// Completed candles always pass.
+		{minuteCandle(0, 26, true), true},
+		{minuteCandle(1, 9, false), false},
+		{minuteCandle(1, 31, false), true},
+		{minuteCandle(2, 1, true), true},
+	}
+	for i, test := range tests {
+		candle := test.candle
+		if got := gate.Pass(&candle); got != test.want {
+			t.Errorf("candle %d (%s, volume %d): got %v, want %v", i, candle.Time.Format("15:04"), candle.Volume, got, test.want)
+		}
+	}
+}
+
+func TestCandlesStreamEmitVolumeDelta(t *testing.T) {
+	lines, _ := pollCandles(t, CandlesOptions{EmitVolumeDelta: 10},
+		[]Candlestick{minuteCandle(0, 5, false)},
+		[]Candlestick{minuteCandle(0, 12, false)},
+		[]Candlestick{minuteCandle(0, 15, false)},
+		[]Candlestick{minuteCandle(0, 16, true), minuteCandle(1, 3, false)},
+	)
+	volumes := []int{}
+	for _, line := range lines {
+		var candle Candlestick
+		if err := json.Unmarshal([]byte(line), &candle); err != nil {
+			t.Fatal(err)
+		}
+		volumes = append(volumes, candle.Volume)
+	}
+	if want := []int{12, 16}; !reflect.DeepEqual(volumes, want) {
+		t.Errorf("emitted volumes %v, want %v", volumes, want)
+	}
+}
+
+func TestCandlesStreamSmooth(t *testing.T) {
+	for _, smooth := range []bool{false, true} {
+		_, polls := pollCandles(t, CandlesOptions{Smooth: smooth})
+		query := polls[0].query
+		if _, set := query["smooth"]; set != smooth || (smooth && query.Get("smooth") != "true") {
+			t.Errorf("--smooth %v requested smooth=%q", smooth, query.Get("smooth"))
+		}
+	}
+}
+
+func TestParsePollingIntervals(t *testing.T) {
+	tests := []struct {
+		spec      string
+		fallback  time.Duration
+		intervals map[string]time.Duration
+		err       bool
+	}{
+		{"2s", 2 * time.Second, map[string]time.Duration{}, false},
+		{"EUR_USD=1s,USD_JPY=5s", defaultPollingInterval, map[string]time.Duration{"EUR_USD": time.Second, "USD_JPY": 5 * time.Second}, false},
+		{"EUR_USD=1s, 3s", 3 * time.Second, map[string]time.Duration{"EUR_USD": time.Second}, false},
+		{" EUR_USD = 500ms ", defaultPollingInterval, map[string]time.Duration{"EUR_USD": 500 * time.Millisecond}, false},
+		{"EUR_USD=fast", 0, nil, true},
+		{"1s,", 0, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			fallback, intervals, err := ParsePollingIntervals(test.spec)
+			if test.err {
+				if err == nil {
+					t.Errorf("got %s %v, want an error", fallback, intervals)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fallback != test.fallback || !reflect.DeepEqual(intervals, test.intervals) {
+				t.Errorf("got %s %v, want %s %v", fallback, intervals, test.fallback, test.intervals)
+			}
+		})
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	keys := []string{"OANDA_TEST_TOKEN", "OANDA_TEST_ACCOUNT_ID", "OANDA_TEST_ENV", "OANDA_TEST_QUOTED", "OANDA_TEST_SET"}
+	for _, key := range keys {
+		previous, set := os.LookupEnv(key)
+		os.Unsetenv(key)
+		if set {
+			defer os.Setenv(key, previous)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+	os.Setenv("OANDA_TEST_SET", "process")
+
+	path := filepath.Join(t.TempDir(), ".env")
+	env := "# local settings\n\nOANDA_TEST_TOKEN=abc\nexport OANDA_TEST_ACCOUNT_ID = 101-001-1-001\nOANDA_TEST_ENV=\"practice\"\nOANDA_TEST_QUOTED='a=b'\nOANDA_TEST_SET=file\n"
+	if err := ioutil.WriteFile(path, []byte(env), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadEnvFile(path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"OANDA_TEST_TOKEN":      "abc",
+		"OANDA_TEST_ACCOUNT_ID": "101-001-1-001",
+		"OANDA_TEST_ENV":        "practice",
+		"OANDA_TEST_QUOTED":     "a=b",
+		// The process environment wins.
+		"OANDA_TEST_SET": "process",
+	}
+	for key, value := range want {
+		if got := os.Getenv(key); got != value {
+			t.Errorf("%s is %q, want %q", key, got, value)
+		}
+	}
+
+	for _, broken := range []string{"OANDA_TEST_TOKEN\n", "=abc\n"} {
+		if err := ioutil.WriteFile(path, []byte(broken), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadEnvFile(path); err == nil || !strings.Contains(err.Error(), ":1: expected KEY=VALUE") {
+			t.Errorf("%q: got error %v", broken, err)
+		}
+	}
+	if err := LoadEnvFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing .env file was accepted")
+	}
+}
+
+func TestWithCloseout(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"both", `{"type":"PRICE","closeoutBid":"1.1","closeoutAsk":"1.2"}`, `{"closeout_bid":1.1,"closeout_ask":1.2,"type":"PRICE","closeoutBid":"1.1","closeoutAsk":"1.2"}`},
+		{"bid only", `{"type":"PRICE","closeoutBid":"1.1"}`, `{"closeout_bid":1.1,"type":"PRICE","closeoutBid":"1.1"}`},
+		{"neither", `{"type":"PRICE"}`, `{"type":"PRICE"}`},
+		{"not a number", `{"type":"PRICE","closeoutBid":"n/a"}`, `{"type":"PRICE","closeoutBid":"n/a"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var price PriceOrHeartbeat
+			if err := json.Unmarshal([]byte(test.line), &price); err != nil {
+				t.Fatal(err)
+			}
+			if got := withCloseout(test.line, &price); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	// Only prices are extended, with the option only.
+	price := `{"type":"PRICE","closeoutBid":"1.1","closeoutAsk":"1.2"}`
+	heartbeat := `{"type":"HEARTBEAT","time":"2021-03-01T00:00:00Z"}`
+	got := pricingLines(t, PricingOptions{WithCloseout: true, Heartbeat: true}, heartbeat, price)
+	if want := []string{heartbeat, tests[0].want}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := pricingLines(t, PricingOptions{}, price); !reflect.DeepEqual(got, []string{price}) {
+		t.Errorf("got %v without --with-closeout", got)
+	}
+}
+
+func TestResolvePrice(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    string
+		profile string
+		want    string
+	}{
+		{"flag over profile", "B", "A", "B"},
+		{"profile", "", "BA", "BA"},
+		{"neither", "", "", "MBA"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			account := Account{DefaultPrice: test.profile}
+			if got := ResolvePrice(test.flag, &account); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+
+			// The resolved price is the one requested.
+			requested := ""
+			session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = r.URL.Query().Get("price")
+				w.Write([]byte(`{"candles":[]}`))
+			}))
+			session.Credentials.Default.DefaultPrice = test.profile
+			options := CandlesOptions{Instrument: "EUR_USD", Granularity: "M1", Price: test.flag}
+			if _, err := getCandlesForStream(session, &options, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if requested != test.want {
+				t.Errorf("requested price %q, want %s", requested, test.want)
+			}
+		})
+	}
+}
+
+func TestValidatePrice(t *testing.T) {
+	for price, valid := range map[string]bool{"M": true, "BA": true, "MBA": true, "ABM": true, "": true, "X": false, "MM": false, "mba": false} {
+		if err := ValidatePrice(price); (err == nil) != valid {
+			t.Errorf("%q: got error %v", price, err)
+		}
+	}
+}
+
+func TestCandlesStreamDelta(t *testing.T) {
+	lines, _ := pollCandles(t, CandlesOptions{Delta: true},
+		[]Candlestick{minuteCandle(0, 5, false)},
+		[]Candlestick{minuteCandle(0, 7, false)},
+		[]Candlestick{minuteCandle(0, 9, true), minuteCandle(1, 1, false)},
+	)
+	want := []string{
+		// The first update of a candle is full, later ones only what changed.
+		`"complete":false,"volume":5`,
+		`{"time":"2021-03-01T00:00:00Z","volume":7}`,
+		`{"complete":true,"time":"2021-03-01T00:00:00Z","volume":9}`,
+		`"complete":false,"volume":1`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %v", lines)
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, want[i]) {
+			t.Errorf("line %d is %s, want %s", i, line, want[i])
+		}
+	}
+}
+
+func TestGetCredentialsMalformed(t *testing.T) {
+	for _, key := range []string{"OANDA_TOKEN", "OANDA_ACCOUNT_ID", "OANDA_ENV"} {
+		if previous, set := os.LookupEnv(key); set {
+			os.Unsetenv(key)
+			defer os.Setenv(key, previous)
+		}
+	}
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"bad indentation", "default:\n  account_id: a\n token: t\n"},
+		{"tab", "default:\n\taccount_id: a\n"},
+		{"not a mapping", "- account_id: a\n"},
+		{"unclosed quote", "default:\n  token: \"t\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := GetCredentials(path, defaultProfile)
+			if err == nil {
+				t.Fatal("malformed credentials were accepted")
+			}
+			for _, want := range []string{path, "malformed credentials file", credentialsHint} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+
+	_, err := GetCredentials(filepath.Join(t.TempDir(), "missing.yaml"), defaultProfile)
+	var missing *MissingConfigError
+	if !errors.As(err, &missing) {
+		t.Errorf("got %v for a missing file, want a MissingConfigError", err)
+	}
+}
+
+func TestMissingCredentialsFile(t *testing.T) {
+	for _, key := range []string{"OANDA_TOKEN", "OANDA_ACCOUNT_ID", "OANDA_ENV"} {
+		if previous, set := os.LookupEnv(key); set {
+			os.Unsetenv(key)
+			defer os.Setenv(key, previous)
+		}
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   bool
+	}{
+		{"no token", "", true},
+		{"token from the environment", "env-token", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.token != "" {
+				os.Setenv("OANDA_TOKEN", test.token)
+				defer os.Unsetenv("OANDA_TOKEN")
+			}
+			path := filepath.Join(t.TempDir(), "missing.yaml")
+			_, err := NewProfileSession(path, defaultProfile)
+			if !test.err {
+				// The account id is still missing, but not the file.
+				if err == nil || !strings.Contains(err.Error(), "missing required field account_id") {
+					t.Errorf("got %v", err)
+				}
+				return
+			}
+
+			var missing *MissingConfigError
+			if !errors.As(err, &missing) || missing.Path != path {
+				t.Fatalf("got %v, want a MissingConfigError for %s", err, path)
+			}
+			for _, want := range []string{path, "--config", "OANDA_CREDENTIALS_PATH", "OANDA_TOKEN", credentialsHint} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+			if strings.Contains(err.Error(), "no such file") {
+				t.Errorf("error %q has the raw open error", err)
+			}
+		})
+	}
+}
+
+func TestAccountIdOverride(t *testing.T) {
+	for _, key := range []string{"OANDA_TOKEN", "OANDA_ACCOUNT_ID", "OANDA_ENV"} {
+		if previous, set := os.LookupEnv(key); set {
+			os.Unsetenv(key)
+			defer os.Setenv(key, previous)
+		}
+	}
+	defer func(previous string) { accountIdOverride = previous }(accountIdOverride)
+
+	credentials := "default:\n  account_id: 101-001-0000000-001\n  token: a\nsub:\n  account_id: 101-001-0000000-002\n  token: b\nnotoken:\n  account_id: 101-001-0000000-003\n"
+	tests := []struct {
+		name     string
+		override string
+		profile  string
+		path     string
+		err      string
+	}{
+		{"configured", "", defaultProfile, "/v3/accounts/101-001-0000000-001/pricing/stream", ""},
+		{"overridden", "101-001-0000000-009", defaultProfile, "/v3/accounts/101-001-0000000-009/pricing/stream", ""},
+		{"overridden in a profile", "101-001-0000000-009", "sub", "/v3/accounts/101-001-0000000-009/pricing/stream", ""},
+		{"no token", "101-001-0000000-009", "notoken", "", "missing required field token in profile notoken"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.yaml")
+			if err := ioutil.WriteFile(path, []byte(credentials), 0600); err != nil {
+				t.Fatal(err)
+			}
+			accountIdOverride = test.override
+			session, err := NewProfileSession(path, test.profile)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			requested := ""
+			testSession, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = r.URL.Path
+			}))
+			session.Client = testSession.Client
+			session.Output = testSession.Output
+			if err := getStream(session, &PricingOptions{}); err != io.EOF {
+				t.Fatalf("the stream ended with %v", err)
+			}
+			if requested != test.path {
+				t.Errorf("requested %s, want %s", requested, test.path)
+			}
+
+			// Another profile keeps its own account.
+			other, err := session.ForProfile(path, "sub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "101-001-0000000-002"
+			if test.profile == "sub" && test.override != "" {
+				want = test.override
+			}
+			if got := other.Credentials.Default.AccountId; got != want {
+				t.Errorf("profile sub uses account %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestAccountValidate(t *testing.T) {
+	tests := []struct {
+		name             string
+		account          Account
+		requireAccountId bool
+		missing          string
+	}{
+		{"complete", Account{AccountId: "a", Token: "t"}, true, ""},
+		{"no account id", Account{Token: "t"}, true, "missing required field account_id in profile default"},
+		{"no account id needed", Account{Token: "t"}, false, ""},
+		{"no token", Account{AccountId: "a"}, true, "missing required field token in profile default"},
+		{"empty", Account{}, true, "missing required field account_id and token in profile default"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.account.Validate("credentials.yaml", defaultProfile, test.requireAccountId)
+			if test.missing == "" {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "credentials.yaml: "+test.missing) {
+				t.Errorf("got error %v, want %q", err, test.missing)
+			}
+		})
+	}
+}
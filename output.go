@@ -0,0 +1,879 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Output writes emitted lines to Writer, stdout unless an output flag says
+// otherwise. When Tag or RunId is set, a "_job" or "_run" field is injected
+// into every JSON object line.
+type Output struct {
+	Tag    string
+	RunId  string
+	Writer io.Writer
+	Filter *FilterExpr
+	// Transforms apply to every message, after the InstrumentTransforms of
+	// the message's instrument.
+	Transforms           Transforms
+	InstrumentTransforms map[string]*Transforms
+	// Validate fails on the first message which is not valid JSON once
+	// transformed (--validate-output).
+	Validate bool
+	Limit    *LineLimit
+	Counts   *MessageCounts
+	// Seq numbers the data messages of the stream in a "_seq" field (--seq).
+	Seq *Sequence
+}
+
+// InvalidOutputError is a message which failed --validate-output.
+type InvalidOutputError struct {
+	Line string
+}
+
+func (self *InvalidOutputError) Error() string {
+	return fmt.Sprintf("invalid JSON output: %s", self.Line)
+}
+
+// Emit writes a data message, i.e. anything but a heartbeat, unless the
+// message level options drop it.
+func (self *Output) Emit(line string) error {
+	line, ok, err := self.Prepare(line)
+	if err != nil || !ok {
+		return err
+	}
+	return self.Deliver(line)
+}
+
+// Deliver writes a data message which Prepare accepted, or only counts it
+// under --count-only.
+func (self *Output) Deliver(line string) error {
+	if self.Counts != nil {
+		return self.Counts.Add(line)
+	}
+	return self.Println(line)
+}
+
+// Prepare applies the message level options to a data message, from
+// --filter-expr to --seq, and reports whether it is to be written.
+func (self *Output) Prepare(line string) (string, bool, error) {
+	accepted, err := self.Accept(line)
+	if err != nil || !accepted {
+		return "", false, err
+	}
+
+	line, err = self.Transform(line)
+	if err != nil {
+		return "", false, err
+	}
+
+	if self.Validate && !json.Valid([]byte(line)) {
+		return "", false, &InvalidOutputError{Line: line}
+	}
+
+	if !self.Take() {
+		return "", false, nil
+	}
+	return self.Number(line), true, nil
+}
+
+// Sequence is a counter of the messages of one stream. It lives as long as
+// the command, so that it carries on over reconnects: a reconnect is a gap in
+// the data, not in the numbering.
+type Sequence struct {
+	last int64
+}
+
+func (self *Sequence) Next() int64 {
+	return atomic.AddInt64(&self.last, 1)
+}
+
+// Number injects the next "_seq", when numbering messages.
+func (self *Output) Number(line string) string {
+	if self.Seq == nil {
+		return line
+	}
+	return injectField(line, "_seq", self.Seq.Next())
+}
+
+// MessageCounts tallies data messages by type and instrument for --count-only.
+// It is shared by all outputs of a session.
+type MessageCounts struct {
+	Total        int            `json:"total"`
+	ByType       map[string]int `json:"by_type"`
+	ByInstrument map[string]int `json:"by_instrument"`
+	mutex        sync.Mutex
+}
+
+func NewMessageCounts() *MessageCounts {
+	return &MessageCounts{ByType: map[string]int{}, ByInstrument: map[string]int{}}
+}
+
+func (self *MessageCounts) Add(line string) error {
+	var message struct {
+		Type       string `json:"type"`
+		Instrument string `json:"instrument"`
+		Complete   *bool  `json:"complete"`
+	}
+	if err := json.Unmarshal([]byte(line), &message); err != nil {
+		return err
+	}
+	if message.Type == "" && message.Complete != nil {
+		message.Type = "CANDLE"
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.Total++
+	if message.Type != "" {
+		self.ByType[message.Type]++
+	}
+	if message.Instrument != "" {
+		self.ByInstrument[message.Instrument]++
+	}
+	return nil
+}
+
+// Take reports whether another data line may be written under --max-lines.
+func (self *Output) Take() bool {
+	if self.Limit == nil {
+		return true
+	}
+	return self.Limit.Take()
+}
+
+// LineLimit ends the session once Max data lines have been written. It is
+// shared by all outputs of a session, so a batch stops after Max lines in total.
+type LineLimit struct {
+	Max    int64
+	count  int64
+	cancel context.CancelFunc
+}
+
+func (self *LineLimit) Take() bool {
+	count := atomic.AddInt64(&self.count, 1)
+	if count > self.Max {
+		return false
+	}
+	if count == self.Max {
+		self.cancel()
+	}
+	return true
+}
+
+// ByteLimit ends the session once the file sinks have been written Max bytes
+// (--max-output-bytes). A line which would go past Max is dropped whole, so
+// that the output never exceeds Max and ends with a complete line. Bytes are
+// counted before compression, as formatted for the file.
+type ByteLimit struct {
+	Max     int64
+	written int64
+	cancel  context.CancelFunc
+	mutex   sync.Mutex
+}
+
+// Take reports whether n more bytes may be written.
+func (self *ByteLimit) Take(n int) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.written+int64(n) > self.Max {
+		if self.written < self.Max {
+			fmt.Fprintf(os.Stderr, "output limit of %d bytes reached after %d bytes, stopping\n", self.Max, self.written)
+			// Nothing else fits once a line did not.
+			self.written = self.Max
+		}
+		self.cancel()
+		return false
+	}
+	self.written += int64(n)
+	if self.written == self.Max {
+		fmt.Fprintf(os.Stderr, "output limit of %d bytes reached, stopping\n", self.Max)
+		self.cancel()
+	}
+	return true
+}
+
+// Accept reports whether a data message passes --filter-expr.
+func (self *Output) Accept(line string) (bool, error) {
+	if self.Filter == nil {
+		return true, nil
+	}
+	return self.Filter.Match(line)
+}
+
+// Transform applies --transforms, then --numeric-prices and --rename. It
+// runs after --filter-expr, which therefore refers to the original fields,
+// and before the output format, e.g. --template.
+func (self *Output) Transform(line string) (string, error) {
+	if len(self.InstrumentTransforms) != 0 {
+		if transforms, ok := self.InstrumentTransforms[messageInstrument(line)]; ok {
+			var err error
+			line, err = transforms.Apply(line)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return self.Transforms.Apply(line)
+}
+
+func (self *Output) Println(line string) error {
+	if self.Tag != "" {
+		line = injectField(line, "_job", self.Tag)
+	}
+	if self.RunId != "" {
+		line = injectField(line, "_run", self.RunId)
+	}
+	if _, err := io.WriteString(self.Writer, line+"\n"); err != nil {
+		return &OutputError{Err: err}
+	}
+	return nil
+}
+
+// OutputError is a failure to write to the output sink, as opposed to a
+// failure of the stream being read.
+type OutputError struct {
+	Err error
+}
+
+func (self *OutputError) Error() string {
+	return self.Err.Error()
+}
+
+func (self *OutputError) Unwrap() error {
+	return self.Err
+}
+
+// injectField adds a key to the front of a JSON object line. Lines which are not
+// JSON objects are returned as is.
+func injectField(line string, key string, value interface{}) string {
+	if !strings.HasPrefix(line, "{") {
+		return line
+	}
+
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return line
+	}
+
+	field := fmt.Sprintf("%q:%s", key, string(bytes))
+	if strings.TrimSpace(line[1:]) == "}" {
+		return "{" + field + "}"
+	}
+	return "{" + field + "," + line[1:]
+}
+
+// outputFlags are the flags shared by every command which emits a stream.
+func outputFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "output-socket",
+			Usage: "Write output to tcp://host:port or unix:///path instead of stdout",
+		},
+		&cli.StringFlag{
+			Name:    "output-file",
+			Aliases: []string{"o"},
+			Usage:   "Write output to this file instead of stdout, gzip compressed if it ends in .gz",
+		},
+		&cli.BoolFlag{
+			Name:  "split-by-instrument",
+			Usage: "Write each instrument to its own file in --output-dir",
+		},
+		&cli.StringFlag{
+			Name:  "output-dir",
+			Usage: "Directory for --split-by-instrument files",
+			Value: ".",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "Format of the output: " + strings.Join(formatNames(), ", "),
+		},
+		&cli.StringFlag{
+			Name:  "file-format",
+			Usage: "Format of --output-file, if not that of --output",
+		},
+		&cli.StringFlag{
+			Name:  "stdout-format",
+			Usage: "Also write to stdout, in this format, next to any other output sink",
+		},
+		&cli.StringFlag{
+			Name:  "compress",
+			Usage: "Compression of --output-file: gzip or none (default: by file extension)",
+		},
+		&cli.DurationFlag{
+			Name:  "fsync-interval",
+			Usage: "Fsync --output-file and --split-by-instrument files this often and on exit, 0 leaves it to the OS",
+		},
+		&cli.StringFlag{
+			Name:  "syslog",
+			Usage: "Send each line as a syslog message, to the local daemon (local) or to udp://host:port or tcp://host:port",
+		},
+		&cli.StringFlag{
+			Name:  "syslog-facility",
+			Value: "user",
+		},
+		&cli.StringFlag{
+			Name:  "syslog-severity",
+			Value: "info",
+		},
+		&cli.StringFlag{
+			Name:  "syslog-tag",
+			Value: "oanda-cli",
+		},
+		&cli.StringFlag{
+			Name:  "filter-expr",
+			Usage: "Only emit messages matching e.g. 'mid.c > 1.1 && volume >= 10'",
+		},
+		&cli.StringFlag{
+			Name:  "strip-fields",
+			Usage: "Remove these fields (CSV, dotted for nested ones) from every message, e.g. bids,asks",
+		},
+		&cli.BoolFlag{
+			Name:  "numeric-prices",
+			Usage: "Write prices as JSON numbers instead of strings, leaving everything else as is",
+		},
+		&cli.StringFlag{
+			Name:  "rename",
+			Usage: "Rename fields, e.g. 'time=timestamp,mid.c=close'",
+		},
+		&cli.StringFlag{
+			Name:  "transforms",
+			Usage: "YAML file of --numeric-prices and --rename style transforms per instrument, applied by the message's instrument field",
+		},
+		&cli.StringFlag{
+			Name:  "template",
+			Usage: "Render each line with a Go text/template, e.g. '{{.time}} {{fixed 5 .mid.c}}', the template --output format",
+		},
+		&cli.BoolFlag{
+			Name:  "validate-output",
+			Usage: "Fail on the first message which is not valid JSON after --transforms and --rename",
+		},
+		&cli.BoolFlag{
+			Name:  "seq",
+			Usage: "Add an increasing \"_seq\" number to every data message, continued over reconnects",
+		},
+		&cli.Int64Flag{
+			Name:  "max-lines",
+			Usage: "Stop cleanly after emitting this many messages (heartbeats are not counted)",
+		},
+		&cli.Int64Flag{
+			Name:  "max-output-bytes",
+			Usage: "Stop cleanly before --output-file or --split-by-instrument would grow past this many bytes in total (uncompressed)",
+		},
+		&cli.BoolFlag{
+			Name:  "count-only",
+			Usage: "Print only the number of messages by type and instrument when the command ends",
+		},
+		&cli.StringFlag{
+			Name:  "run-id",
+			Usage: "Inject a \"_run\" field with this id into every line",
+		},
+		&cli.BoolFlag{
+			Name:  "tag-run",
+			Usage: "Inject a \"_run\" field with a generated UUID into every line",
+		},
+	}
+}
+
+// OpenOutput points the session output at the sink selected by outputFlags.
+func (self *Session) OpenOutput(c *cli.Context) error {
+	if expr := c.String("filter-expr"); expr != "" {
+		filter, err := ParseFilterExpr(expr)
+		if err != nil {
+			return err
+		}
+		self.Output.Filter = filter
+	}
+
+	if spec := c.String("strip-fields"); spec != "" {
+		paths, err := ParseFieldPaths(spec)
+		if err != nil {
+			return err
+		}
+		self.Output.Transforms.Strip = paths
+	}
+
+	self.Output.Transforms.NumericPrices = c.Bool("numeric-prices")
+
+	if spec := c.String("rename"); spec != "" {
+		renames, err := ParseRenames(spec)
+		if err != nil {
+			return err
+		}
+		self.Output.Transforms.Renames = renames
+	}
+
+	if path := c.String("transforms"); path != "" {
+		transforms, err := GetInstrumentTransforms(path)
+		if err != nil {
+			return err
+		}
+		self.Output.InstrumentTransforms = transforms
+	}
+
+	self.Output.Validate = c.Bool("validate-output")
+
+	format := c.String("output")
+	if c.String("template") != "" {
+		if format == "" {
+			format = "template"
+		} else if format != "template" {
+			return fmt.Errorf("--template cannot be combined with --output %s", format)
+		}
+	}
+	formatOptions := FormatOptions{Indent: "  ", Template: c.String("template")}
+
+	if c.Bool("seq") {
+		self.Output.Seq = &Sequence{}
+	}
+
+	if max := c.Int64("max-lines"); max > 0 {
+		ctx, cancel := context.WithCancel(self.Context)
+		self.Context = ctx
+		self.Output.Limit = &LineLimit{Max: max, cancel: cancel}
+	}
+
+	if c.Bool("count-only") {
+		self.Output.Counts = NewMessageCounts()
+	}
+
+	if runId := c.String("run-id"); runId != "" {
+		if c.Bool("tag-run") {
+			return errors.New("--run-id cannot be combined with --tag-run")
+		}
+		self.Output.RunId = runId
+	} else if c.Bool("tag-run") {
+		runId, err := NewRunId()
+		if err != nil {
+			return err
+		}
+		self.Output.RunId = runId
+	}
+
+	sinks := 0
+	for _, set := range []bool{c.String("output-socket") != "", c.String("output-file") != "", c.Bool("split-by-instrument"), c.String("syslog") != ""} {
+		if set {
+			sinks++
+		}
+	}
+	if sinks > 1 {
+		return errors.New("--output-socket, --output-file, --split-by-instrument and --syslog are mutually exclusive")
+	}
+
+	var byteLimit *ByteLimit
+	if max := c.Int64("max-output-bytes"); max > 0 {
+		if c.String("output-file") == "" && !c.Bool("split-by-instrument") {
+			return errors.New("--max-output-bytes requires --output-file or --split-by-instrument")
+		}
+		ctx, cancel := context.WithCancel(self.Context)
+		self.Context = ctx
+		byteLimit = &ByteLimit{Max: max, cancel: cancel}
+	}
+
+	if address := c.String("output-socket"); address != "" {
+		writer, err := NewSocketWriter(address)
+		if err != nil {
+			return err
+		}
+		self.Output.Writer = writer
+	}
+
+	if path := c.String("output-file"); path != "" {
+		writer, err := NewFileWriter(path, c.String("compress"), c.Duration("fsync-interval"))
+		if err != nil {
+			return err
+		}
+		writer.Limit = byteLimit
+		self.Output.Writer = writer
+		if fileFormat := c.String("file-format"); fileFormat != "" {
+			format = fileFormat
+		}
+	}
+
+	if c.Bool("split-by-instrument") {
+		writer, err := NewSplitWriter(c.String("output-dir"), c.String("compress"), c.Duration("fsync-interval"))
+		if err != nil {
+			return err
+		}
+		writer.Limit = byteLimit
+		self.Output.Writer = writer
+	}
+
+	if address := c.String("syslog"); address != "" {
+		writer, err := NewSyslogWriter(address, c.String("syslog-facility"), c.String("syslog-severity"), c.String("syslog-tag"))
+		if err != nil {
+			return err
+		}
+		self.Output.Writer = writer
+	}
+
+	// Without another sink, --stdout-format is the format of stdout.
+	stdoutFormat := c.String("stdout-format")
+	if stdoutFormat != "" && sinks == 0 {
+		format, stdoutFormat = stdoutFormat, ""
+	}
+	if format != "" {
+		formatted, err := NewFormattedWriter(self.Output.Writer, format, formatOptions)
+		if err != nil {
+			closeWriter(self.Output.Writer)
+			return err
+		}
+		self.Output.Writer = formatted
+	}
+	if stdoutFormat != "" {
+		if err := self.Output.teeStdout(stdoutFormat, formatOptions); err != nil {
+			closeWriter(self.Output.Writer)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewRunId generates a random (version 4) UUID identifying one invocation.
+func NewRunId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Close prints the --count-only totals, then flushes and releases the output
+// sink, if it buffers or needs releasing.
+func (self *Session) Close() error {
+	if counts := self.Output.Counts; counts != nil {
+		counts.mutex.Lock()
+		bytes, err := json.Marshal(counts)
+		counts.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		output := *self.Output
+		output.Tag = ""
+		if err := output.Println(string(bytes)); err != nil {
+			return err
+		}
+	}
+
+	if err := flushWriter(self.Output.Writer); err != nil {
+		return err
+	}
+	return closeWriter(self.Output.Writer)
+}
+
+// LockedWriter serializes writes to Writer, so that the goroutines of several
+// instruments or jobs sharing stdout never interleave within a line. The
+// other sinks lock on their own.
+type LockedWriter struct {
+	Writer io.Writer
+	mutex  sync.Mutex
+}
+
+func (self *LockedWriter) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.Writer.Write(p)
+}
+
+// SocketWriter writes to a TCP or Unix domain socket, redialing once when a
+// write fails so that a restarted listener does not end the stream.
+type SocketWriter struct {
+	Network string
+	Address string
+	conn    net.Conn
+	mutex   sync.Mutex
+}
+
+// NewSocketWriter dials tcp://host:port or unix:///path.
+func NewSocketWriter(address string) (*SocketWriter, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := SocketWriter{Network: u.Scheme}
+	switch u.Scheme {
+	case "tcp":
+		writer.Address = u.Host
+	case "unix":
+		writer.Address = u.Path
+	default:
+		return nil, errors.New("output socket must be tcp://host:port or unix:///path")
+	}
+
+	writer.conn, err = net.Dial(writer.Network, writer.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer, nil
+}
+
+func (self *SocketWriter) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.conn != nil {
+		n, err := self.conn.Write(p)
+		if err == nil {
+			return n, nil
+		}
+		self.conn.Close()
+		self.conn = nil
+	}
+
+	conn, err := net.Dial(self.Network, self.Address)
+	if err != nil {
+		return 0, err
+	}
+	self.conn = conn
+
+	return self.conn.Write(p)
+}
+
+func (self *SocketWriter) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+// FileWriter writes to a file, optionally through gzip. Flush and Close
+// complete the gzip stream so that a stopped capture is readable.
+//
+// With a sync interval, the file is flushed and fsynced that often and once
+// more when closed, so that a power loss costs at most an interval of data
+// without the cost of syncing every line.
+//
+// With a Limit, a line which does not fit is dropped instead of written.
+type FileWriter struct {
+	Limit *ByteLimit
+	// Syncer fsyncs the file, the file itself unless replaced. It is only
+	// used under the mutex.
+	Syncer Syncer
+	file   *os.File
+	gzip   *gzip.Writer
+	writer io.Writer
+	mutex  sync.Mutex
+	// syncErr is a failed periodic sync, returned by the next Write.
+	syncErr error
+	stop    chan struct{}
+}
+
+// NewFileWriter creates the file at path. compress is "gzip", "none", or
+// empty to compress when path ends in .gz. A zero syncInterval never fsyncs.
+func NewFileWriter(path string, compress string, syncInterval time.Duration) (*FileWriter, error) {
+	if compress == "" {
+		compress = "none"
+		if strings.HasSuffix(path, ".gz") {
+			compress = "gzip"
+		}
+	}
+	if compress != "gzip" && compress != "none" {
+		return nil, fmt.Errorf("unknown compression %q, expected gzip or none", compress)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &FileWriter{Syncer: file, file: file, writer: file}
+	if compress == "gzip" {
+		writer.gzip = gzip.NewWriter(file)
+		writer.writer = writer.gzip
+	}
+	if syncInterval > 0 {
+		writer.stop = make(chan struct{})
+		go writer.syncEvery(syncInterval)
+	}
+
+	return writer, nil
+}
+
+func (self *FileWriter) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			self.mutex.Lock()
+			// Close may have won the mutex in the meantime.
+			if self.file != nil {
+				if err := self.sync(); err != nil && self.syncErr == nil {
+					self.syncErr = err
+				}
+			}
+			self.mutex.Unlock()
+		}
+	}
+}
+
+// sync flushes the gzip stream, if any, and fsyncs the file. The mutex must be held.
+func (self *FileWriter) sync() error {
+	if self.gzip != nil {
+		if err := self.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+	return self.Syncer.Sync()
+}
+
+func (self *FileWriter) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.syncErr != nil {
+		return 0, self.syncErr
+	}
+	if self.Limit != nil && !self.Limit.Take(len(p)) {
+		return len(p), nil
+	}
+	return self.writer.Write(p)
+}
+
+func (self *FileWriter) Flush() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.gzip != nil {
+		return self.gzip.Flush()
+	}
+	return nil
+}
+
+func (self *FileWriter) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.gzip != nil {
+		if err := self.gzip.Close(); err != nil {
+			self.file.Close()
+			return err
+		}
+	}
+	file := self.file
+	self.file = nil
+	if self.stop != nil {
+		close(self.stop)
+		if err := self.Syncer.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Syncer commits written data to stable storage, like *os.File.
+type Syncer interface {
+	Sync() error
+}
+
+// SplitWriter routes every line to a file named after its "instrument" field,
+// creating the files as instruments first appear. Lines without an
+// instrument, such as heartbeats, go to _other.ndjson.
+type SplitWriter struct {
+	Dir          string
+	Compress     string
+	SyncInterval time.Duration
+	// Limit caps the bytes of all the files together.
+	Limit *ByteLimit
+	files map[string]*FileWriter
+	mutex sync.Mutex
+}
+
+func NewSplitWriter(dir string, compress string, syncInterval time.Duration) (*SplitWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &SplitWriter{Dir: dir, Compress: compress, SyncInterval: syncInterval, files: map[string]*FileWriter{}}, nil
+}
+
+// Write expects exactly one line per call, as Output writes them.
+func (self *SplitWriter) Write(p []byte) (int, error) {
+	var message struct {
+		Instrument string `json:"instrument"`
+	}
+	// Lines which are not JSON objects have no instrument either.
+	_ = json.Unmarshal(p, &message)
+
+	key := message.Instrument
+	if key == "" || strings.ContainsAny(key, "/\\") || strings.HasPrefix(key, ".") {
+		key = "_other"
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	file, ok := self.files[key]
+	if !ok {
+		path := filepath.Join(self.Dir, key+".ndjson")
+		if self.Compress == "gzip" {
+			path += ".gz"
+		}
+		var err error
+		file, err = NewFileWriter(path, self.Compress, self.SyncInterval)
+		if err != nil {
+			return 0, err
+		}
+		file.Limit = self.Limit
+		self.files[key] = file
+	}
+
+	return file.Write(p)
+}
+
+func (self *SplitWriter) Flush() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, file := range self.files {
+		if err := file.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every file, reporting the first error.
+func (self *SplitWriter) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var first error
+	for _, file := range self.files {
+		if err := file.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	self.files = map[string]*FileWriter{}
+	return first
+}
@@ -0,0 +1,889 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunIdStableWithinRun(t *testing.T) {
+	runId, err := NewRunId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(runId) {
+		t.Fatalf("%s is not a version 4 UUID", runId)
+	}
+
+	buffer := &bytes.Buffer{}
+	output := &Output{Writer: buffer, RunId: runId}
+	for _, line := range []string{`{"type":"PRICE"}`, `{}`, `{"type":"HEARTBEAT"}`} {
+		if err := output.Emit(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var message struct {
+			Run string `json:"_run"`
+		}
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Run != runId {
+			t.Errorf("line %s has _run %q, want %q", line, message.Run, runId)
+		}
+	}
+}
+
+func TestLineLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	buffer := &bytes.Buffer{}
+	output := &Output{Writer: buffer, Limit: &LineLimit{Max: 2, cancel: cancel}}
+
+	for i, line := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		if err := output.Emit(line); err != nil {
+			t.Fatal(err)
+		}
+		// The session stops as soon as the last line is written.
+		if done := ctx.Err() != nil; done != (i >= 1) {
+			t.Errorf("after line %d: context done is %v", i+1, done)
+		}
+	}
+	// Heartbeats are not counted.
+	if err := output.Println(`{"type":"HEARTBEAT"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "{\"n\":1}\n{\"n\":2}\n{\"type\":\"HEARTBEAT\"}\n"
+	if buffer.String() != want {
+		t.Errorf("got %q, want %q", buffer.String(), want)
+	}
+}
+
+func TestByteLimit(t *testing.T) {
+	line := `{"instrument":"EUR_USD"}` + "\n"
+	tests := []struct {
+		name    string
+		max     int64
+		written int
+		lines   int
+		stopped bool
+	}{
+		// The third line would go past the limit and is dropped whole.
+		{"between lines", int64(2*len(line) + 5), 2, 3, true},
+		{"at a line end", int64(2 * len(line)), 2, 3, true},
+		{"above the first line", int64(len(line) - 1), 0, 1, true},
+		{"not reached", int64(10 * len(line)), 3, 3, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			path := t.TempDir() + "/out.ndjson"
+			writer, err := NewFileWriter(path, "none", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.Limit = &ByteLimit{Max: test.max, cancel: cancel}
+
+			for i := 0; i < test.lines; i++ {
+				if _, err := writer.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			bytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Repeat(line, test.written); string(bytes) != want {
+				t.Errorf("got %q, want %q", bytes, want)
+			}
+			if int64(len(bytes)) > test.max {
+				t.Errorf("wrote %d bytes, over the limit of %d", len(bytes), test.max)
+			}
+			if stopped := ctx.Err() != nil; stopped != test.stopped {
+				t.Errorf("stopped is %v, want %v", stopped, test.stopped)
+			}
+		})
+	}
+}
+
+func TestByteLimitAcrossSplitFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	writer, err := NewSplitWriter(dir, "none", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eurUsd := `{"instrument":"EUR_USD"}` + "\n"
+	usdJpy := `{"instrument":"USD_JPY"}` + "\n"
+	writer.Limit = &ByteLimit{Max: int64(len(eurUsd) + len(usdJpy)), cancel: cancel}
+
+	for _, line := range []string{eurUsd, usdJpy, eurUsd} {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{"EUR_USD.ndjson": eurUsd, "USD_JPY.ndjson": usdJpy} {
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bytes) != want {
+			t.Errorf("%s: got %q, want %q", file, bytes, want)
+		}
+	}
+	if ctx.Err() == nil {
+		t.Error("the limit did not stop the session")
+	}
+}
+
+func TestOpenOutputFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// want is the output file, or err the expected error.
+		want string
+		err  string
+	}{
+		{"output", []string{"--output", "csv"}, "instrument,bid\nEUR_USD,1.1\nUSD_JPY,110.1\n", ""},
+		{"file format first", []string{"--output", "pretty", "--file-format", "tsv"}, "instrument\tbid\nEUR_USD\t1.1\nUSD_JPY\t110.1\n", ""},
+		{"template", []string{"--template", "{{.instrument}}={{.bid}}"}, "EUR_USD=1.1\nUSD_JPY=110.1\n", ""},
+		{"array", []string{"--output", "array"}, "[{\"instrument\":\"EUR_USD\",\"bid\":\"1.1\"}\n,{\"instrument\":\"USD_JPY\",\"bid\":\"110.1\"}\n]\n", ""},
+		{"template and another format", []string{"--template", "{{.bid}}", "--output", "csv"}, "", "--template cannot be combined with --output csv"},
+		{"template format without a template", []string{"--output", "template"}, "", "the template format requires --template"},
+		{"unknown", []string{"--file-format", "yaml"}, "", `unknown format "yaml"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir() + "/out"
+			c := newTestContext(t, outputFlags(), append([]string{"--output-file", path}, test.args...)...)
+			session := &Session{Context: context.Background(), Output: &Output{}}
+			err := session.OpenOutput(c)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, line := range []string{`{"instrument":"EUR_USD","bid":"1.1"}`, `{"instrument":"USD_JPY","bid":"110.1"}`} {
+				if err := session.Output.Emit(line); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := session.Close(); err != nil {
+				t.Fatal(err)
+			}
+			bytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bytes) != test.want {
+				t.Errorf("got %q, want %q", bytes, test.want)
+			}
+		})
+	}
+}
+
+func TestOpenOutputPerSinkFormats(t *testing.T) {
+	lines := []string{`{"instrument":"EUR_USD","bid":"1.1"}`, `{"instrument":"USD_JPY","bid":"110.1"}`}
+	tests := []struct {
+		name   string
+		args   []string
+		file   string
+		stdout string
+	}{
+		{
+			"pretty stdout and ndjson file",
+			[]string{"--stdout-format", "pretty", "--file-format", "ndjson"},
+			lines[0] + "\n" + lines[1] + "\n",
+			"{\n  \"instrument\": \"EUR_USD\",\n  \"bid\": \"1.1\"\n}\n{\n  \"instrument\": \"USD_JPY\",\n  \"bid\": \"110.1\"\n}\n",
+		},
+		{
+			"csv stdout and tsv file",
+			[]string{"--stdout-format", "csv", "--file-format", "tsv"},
+			"instrument\tbid\nEUR_USD\t1.1\nUSD_JPY\t110.1\n",
+			"instrument,bid\nEUR_USD,1.1\nUSD_JPY,110.1\n",
+		},
+		{
+			"stdout format only",
+			[]string{"--stdout-format", "tsv"},
+			lines[0] + "\n" + lines[1] + "\n",
+			"instrument\tbid\nEUR_USD\t1.1\nUSD_JPY\t110.1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out")
+			reader, writer, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout := os.Stdout
+			os.Stdout = writer
+			defer func() { os.Stdout = stdout }()
+			captured := make(chan []byte)
+			go func() {
+				bytes, _ := ioutil.ReadAll(reader)
+				captured <- bytes
+			}()
+
+			c := newTestContext(t, outputFlags(), append([]string{"--output-file", path}, test.args...)...)
+			session := &Session{Context: context.Background(), Output: &Output{}}
+			if err := session.OpenOutput(c); err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range lines {
+				if err := session.Output.Emit(line); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := session.Close(); err != nil {
+				t.Fatal(err)
+			}
+			writer.Close()
+
+			if got := string(<-captured); got != test.stdout {
+				t.Errorf("stdout got %q, want %q", got, test.stdout)
+			}
+			bytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bytes) != test.file {
+				t.Errorf("file got %q, want %q", bytes, test.file)
+			}
+		})
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	valid := `{"type":"PRICE","closeoutBid":"1.2"}`
+	// --numeric-prices rewrites a truncated line up to where it breaks off.
+	broken := `{"type":"PRICE","closeoutBid":"1.2"`
+	transformed := `{"type":"PRICE","closeoutBid":1.2`
+	tests := []struct {
+		name     string
+		validate bool
+		lines    []string
+		want     []string
+		err      bool
+	}{
+		{"valid", true, []string{valid, valid}, []string{`{"type":"PRICE","closeoutBid":1.2}`, `{"type":"PRICE","closeoutBid":1.2}`}, false},
+		{"stops at the first broken line", true, []string{valid, broken, valid}, []string{`{"type":"PRICE","closeoutBid":1.2}`}, true},
+		{"not validated", false, []string{broken}, []string{transformed}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			emitter := &Output{Writer: output, Validate: test.validate, Transforms: Transforms{NumericPrices: true}}
+
+			var err error
+			for _, line := range test.lines {
+				if err = emitter.Emit(line); err != nil {
+					break
+				}
+			}
+			var invalid *InvalidOutputError
+			if test.err {
+				if !errors.As(err, &invalid) || invalid.Line != transformed {
+					t.Errorf("got error %v, want an InvalidOutputError", err)
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+			if got := outputLines(output); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOpenOutputRunId(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		name string
+		args []string
+		want func(runId string) bool
+		err  string
+	}{
+		{"off by default", nil, func(runId string) bool { return runId == "" }, ""},
+		{"given", []string{"--run-id", "nightly"}, func(runId string) bool { return runId == "nightly" }, ""},
+		{"generated", []string{"--tag-run"}, uuid.MatchString, ""},
+		{"both", []string{"--run-id", "nightly", "--tag-run"}, nil, "--run-id cannot be combined with --tag-run"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestContext(t, outputFlags(), test.args...)
+			session := &Session{Context: context.Background(), Output: &Output{Writer: &bytes.Buffer{}}}
+			err := session.OpenOutput(c)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			if runId := session.Output.RunId; !test.want(runId) {
+				t.Errorf("got run id %q", runId)
+			}
+		})
+	}
+}
+
+// countingSyncer counts the fsyncs of a FileWriter, failing them with err.
+type countingSyncer struct {
+	syncs int64
+	err   error
+}
+
+func (self *countingSyncer) Sync() error {
+	atomic.AddInt64(&self.syncs, 1)
+	return self.err
+}
+
+func (self *countingSyncer) count() int64 {
+	return atomic.LoadInt64(&self.syncs)
+}
+
+// withSyncer replaces the Syncer of writer, under its mutex since the sync
+// goroutine may already be running.
+func withSyncer(writer *FileWriter, syncer Syncer) {
+	writer.mutex.Lock()
+	writer.Syncer = syncer
+	writer.mutex.Unlock()
+}
+
+func TestFileWriterSyncInterval(t *testing.T) {
+	writer, err := NewFileWriter(t.TempDir()+"/out.ndjson", "gzip", 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer := &countingSyncer{}
+	withSyncer(writer, syncer)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for syncer.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d syncs in 5s with an interval of 5ms", syncer.count())
+		}
+		if _, err := writer.Write([]byte("{}\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close syncs once more, and the syncing stops with it.
+	before := syncer.count()
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closed := syncer.count()
+	if closed <= before {
+		t.Errorf("Close did not sync")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if after := syncer.count(); after != closed {
+		t.Errorf("synced %d more times after Close", after-closed)
+	}
+}
+
+func TestFileWriterWithoutSyncInterval(t *testing.T) {
+	writer, err := NewFileWriter(t.TempDir()+"/out.ndjson", "none", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer := &countingSyncer{}
+	withSyncer(writer, syncer)
+	if _, err := writer.Write([]byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := syncer.count(); n != 0 {
+		t.Errorf("synced %d times, want it left to the OS", n)
+	}
+}
+
+func TestFileWriterSyncFailure(t *testing.T) {
+	writer, err := NewFileWriter(t.TempDir()+"/out.ndjson", "none", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("disk gone")
+	syncer := &countingSyncer{err: failure}
+	withSyncer(writer, syncer)
+	defer writer.Close()
+
+	// A failed periodic sync is returned by the next Write.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := writer.Write([]byte("{}\n"))
+		if err == failure {
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("got %v, want %v", err, failure)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// tricklingWriter writes a byte at a time, yielding in between, so that
+// concurrent writes which are not serialized interleave within a line.
+type tricklingWriter struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (self *tricklingWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		self.mutex.Lock()
+		self.buffer.WriteByte(b)
+		self.mutex.Unlock()
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func TestLockedWriterConcurrentEmitters(t *testing.T) {
+	const emitters, messages = 8, 200
+	sink := &tricklingWriter{}
+	output := &Output{Writer: &LockedWriter{Writer: sink}, Seq: &Sequence{}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < emitters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every emitter shares the output, like the instruments of a
+			// multi-instrument stream or the jobs of a batch.
+			tagged := *output
+			tagged.Tag = fmt.Sprintf("job-%d", i)
+			for n := 0; n < messages; n++ {
+				line := fmt.Sprintf(`{"type":"PRICE","instrument":"EUR_USD","closeoutBid":"1.%05d"}`, n)
+				if err := tagged.Emit(line); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(sink.buffer.String(), "\n"), "\n")
+	if len(lines) != emitters*messages {
+		t.Fatalf("got %d lines, want %d", len(lines), emitters*messages)
+	}
+	seqs := map[int64]bool{}
+	for _, line := range lines {
+		var message struct {
+			Job string `json:"_job"`
+			Seq int64  `json:"_seq"`
+		}
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			t.Fatalf("line %q is not intact: %s", line, err)
+		}
+		if message.Job == "" || seqs[message.Seq] {
+			t.Errorf("line %q lost its job or repeats its _seq", line)
+		}
+		seqs[message.Seq] = true
+	}
+}
+
+// acceptLines accepts connections on listener and sends every line read
+// from them, in the order of the connections.
+func acceptLines(listener net.Listener) <-chan string {
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			conn.Close()
+		}
+	}()
+	return lines
+}
+
+// receiveLine waits for the next line of acceptLines.
+func receiveLine(t *testing.T, lines <-chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener received nothing")
+		return ""
+	}
+}
+
+func TestSocketWriter(t *testing.T) {
+	networks := []string{"tcp"}
+	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
+		networks = append(networks, "unix")
+	}
+	for _, network := range networks {
+		t.Run(network, func(t *testing.T) {
+			var listener net.Listener
+			var address string
+			var err error
+			if network == "tcp" {
+				listener, err = net.Listen("tcp", "127.0.0.1:0")
+				address = "tcp://" + listener.Addr().String()
+			} else {
+				path := filepath.Join(t.TempDir(), "output.sock")
+				listener, err = net.Listen("unix", path)
+				address = "unix://" + path
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			lines := acceptLines(listener)
+
+			c := newTestContext(t, outputFlags(), "--output-socket", address)
+			session := &Session{Context: context.Background(), Output: &Output{}}
+			if err := session.OpenOutput(c); err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			if err := session.Output.Emit(`{"n":1}`); err != nil {
+				t.Fatal(err)
+			}
+			if got := receiveLine(t, lines); got != `{"n":1}` {
+				t.Errorf("got %q", got)
+			}
+
+			// A broken connection is dialed again on the next write.
+			socket := session.Output.Writer.(*SocketWriter)
+			socket.conn.Close()
+			if err := session.Output.Emit(`{"n":2}`); err != nil {
+				t.Fatal(err)
+			}
+			if got := receiveLine(t, lines); got != `{"n":2}` {
+				t.Errorf("got %q after redialing", got)
+			}
+		})
+	}
+}
+
+func TestSyslogWriter(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("syslog is only available on Unix")
+	}
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"defaults", nil, `<14>`},
+		{"facility and severity", []string{"--syslog-facility", "local3", "--syslog-severity", "err"}, `<155>`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			args := append([]string{"--syslog", "udp://" + conn.LocalAddr().String(), "--syslog-tag", "test-tag"}, test.args...)
+			c := newTestContext(t, outputFlags(), args...)
+			session := &Session{Context: context.Background(), Output: &Output{}}
+			if err := session.OpenOutput(c); err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			if err := session.Output.Emit(`{"n":1}`); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 2048)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message := string(buf[:n])
+			if !strings.HasPrefix(message, test.want) {
+				t.Errorf("got %q, want priority %s", message, test.want)
+			}
+			if !strings.Contains(message, " test-tag[") || !strings.HasSuffix(strings.TrimSuffix(message, "\n"), `: {"n":1}`) {
+				t.Errorf("got %q", message)
+			}
+		})
+	}
+}
+
+func TestNewSyslogWriterInvalid(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("syslog is only available on Unix")
+	}
+	tests := []struct {
+		name     string
+		address  string
+		facility string
+		severity string
+	}{
+		{"facility", "udp://127.0.0.1:514", "nope", "info"},
+		{"severity", "udp://127.0.0.1:514", "user", "nope"},
+		{"scheme", "unix:///dev/log", "user", "info"},
+		{"no host", "udp://", "user", "info"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewSyslogWriter(test.address, test.facility, test.severity, "oanda-cli"); err == nil {
+				t.Error("was accepted")
+			}
+		})
+	}
+}
+
+func TestNewSocketWriterInvalid(t *testing.T) {
+	for _, address := range []string{"udp://127.0.0.1:1", "127.0.0.1:1", "tcp://127.0.0.1:1"} {
+		if _, err := NewSocketWriter(address); err == nil {
+			t.Errorf("%s was accepted", address)
+		}
+	}
+}
+
+func TestTemplateOverCandles(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		err      bool
+	}{
+		{"fields", `{{.time}} {{.mid.c}} {{.volume}}`, "2021-03-01T00:01:00Z 1.1 5\n", false},
+		{"helpers", `{{unix .time}} {{fixed 3 .mid.h}} {{time "15:04" .time}}`, "1614556860 1.200 00:01\n", false},
+		{"invalid", `{{.time`, "", true},
+		{"unknown helper", `{{round .mid.c}}`, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out")
+			c := newTestContext(t, outputFlags(), "--output-file", path, "--template", test.template)
+			session := &Session{Context: context.Background(), Output: &Output{}}
+			err := session.OpenOutput(c)
+			if test.err {
+				if err == nil {
+					session.Close()
+					t.Fatal("an invalid template was accepted before streaming")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writer := CandleWriter{Output: session.Output}
+			if err := writer.Write(minuteCandle(1, 5, true)); err != nil {
+				t.Fatal(err)
+			}
+			if err := session.Close(); err != nil {
+				t.Fatal(err)
+			}
+			bytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bytes) != test.want {
+				t.Errorf("got %q, want %q", bytes, test.want)
+			}
+		})
+	}
+}
+
+func TestFileWriterCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		compress string
+		gzipped  bool
+		err      bool
+	}{
+		{"by extension", "out.ndjson.gz", "", true, false},
+		{"plain by extension", "out.ndjson", "", false, false},
+		{"forced", "out.ndjson", "gzip", true, false},
+		{"disabled", "out.ndjson.gz", "none", false, false},
+		{"unknown", "out.ndjson", "zstd", false, true},
+	}
+	lines := `{"n":1}` + "\n" + `{"n":2}` + "\n"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			writer, err := NewFileWriter(path, test.compress, 0)
+			if test.err {
+				if err == nil {
+					writer.Close()
+					t.Fatal("an unknown compression was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(writer, lines); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var reader io.Reader = file
+			if test.gzipped {
+				if reader, err = gzip.NewReader(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bytes, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bytes) != lines {
+				t.Errorf("read back %q, want %q", bytes, lines)
+			}
+		})
+	}
+}
+
+func TestCountOnly(t *testing.T) {
+	session, output := newTestSession(t, fixedStream(
+		`{"type":"PRICE","instrument":"EUR_USD"}`,
+		`{"type":"HEARTBEAT","time":"2021-03-01T00:00:00Z"}`,
+		`{"type":"PRICE","instrument":"USD_JPY"}`,
+		`{"type":"PRICE","instrument":"EUR_USD"}`,
+	))
+	session.Output.Counts = NewMessageCounts()
+	if err := getStream(session, &PricingOptions{}); err != io.EOF {
+		t.Fatalf("the stream ended with %v", err)
+	}
+	if output.Len() != 0 {
+		t.Fatalf("wrote %q before the end", output)
+	}
+
+	// Candles, which have no type, are counted as such.
+	writer := CandleWriter{Output: session.Output, Instrument: "EUR_USD"}
+	if err := writer.Write(minuteCandle(0, 1, true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := outputLines(output)
+	if len(lines) != 1 {
+		t.Fatalf("got %v, want only the counts", lines)
+	}
+	var counts MessageCounts
+	if err := json.Unmarshal([]byte(lines[0]), &counts); err != nil {
+		t.Fatal(err)
+	}
+	want := MessageCounts{
+		Total:        4,
+		ByType:       map[string]int{"PRICE": 3, "CANDLE": 1},
+		ByInstrument: map[string]int{"EUR_USD": 3, "USD_JPY": 1},
+	}
+	if counts.Total != want.Total || !reflect.DeepEqual(counts.ByType, want.ByType) || !reflect.DeepEqual(counts.ByInstrument, want.ByInstrument) {
+		t.Errorf("got %s", lines[0])
+	}
+}
+
+func TestSplitWriterRouting(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewSplitWriter(dir, "none", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		`{"type":"PRICE","instrument":"EUR_USD","n":1}`,
+		`{"type":"PRICE","instrument":"USD_JPY","n":2}`,
+		`{"type":"HEARTBEAT"}`,
+		`{"type":"PRICE","instrument":"EUR_USD","n":3}`,
+		`{"instrument":"../escape"}`,
+		`not json`,
+	}
+	for i, line := range lines {
+		if _, err := writer.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		// Files are created as their instrument first appears.
+		if i == 0 {
+			if _, err := os.Stat(filepath.Join(dir, "USD_JPY.ndjson")); !os.IsNotExist(err) {
+				t.Errorf("USD_JPY.ndjson exists before a USD_JPY line: %v", err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"EUR_USD.ndjson": lines[0] + "\n" + lines[3] + "\n",
+		"USD_JPY.ndjson": lines[1] + "\n",
+		"_other.ndjson":  lines[2] + "\n" + lines[4] + "\n" + lines[5] + "\n",
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(want) {
+		t.Errorf("got %d files, want %d", len(files), len(want))
+	}
+	for file, content := range want {
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bytes) != content {
+			t.Errorf("%s: got %q, want %q", file, bytes, content)
+		}
+	}
+}
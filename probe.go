@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ProbeResult summarizes the round-trip times of a probe run in milliseconds.
+type ProbeResult struct {
+	Count    int      `json:"count"`
+	Failures int      `json:"failures"`
+	Min      *float64 `json:"min_ms"`
+	Avg      *float64 `json:"avg_ms"`
+	Max      *float64 `json:"max_ms"`
+}
+
+func probeAction(c *cli.Context) error {
+	count := c.Int("count")
+	interval := c.Duration("interval")
+
+	session, err := NewSession(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	result, err := probe(session, count, interval)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	err = session.Output.Println(string(bytes))
+
+	return err
+}
+
+// probe times count account summary requests, waiting interval between them.
+// It stops with the error of the session's context once that is done.
+func probe(session *Session, count int, interval time.Duration) (*ProbeResult, error) {
+	ctx := session.Context
+	account := session.Credentials.Default
+
+	baseUrl := account.ApiUrl()
+	url := fmt.Sprintf("%s/v3/accounts/%s/summary", baseUrl, account.AccountId)
+
+	result := ProbeResult{Count: count}
+	var total time.Duration
+	var min time.Duration
+	var max time.Duration
+
+	for i := 0; i < count; i++ {
+		if i != 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+
+		start := time.Now()
+		_, _, err := session.Get(url)
+		elapsed := time.Since(start)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			result.Failures++
+			continue
+		}
+
+		succeeded := i - result.Failures
+		if succeeded == 0 || elapsed < min {
+			min = elapsed
+		}
+		if elapsed > max {
+			max = elapsed
+		}
+		total += elapsed
+	}
+
+	succeeded := count - result.Failures
+	if succeeded != 0 {
+		result.Min = GetMillisecondsPointer(min)
+		result.Avg = GetMillisecondsPointer(total / time.Duration(succeeded))
+		result.Max = GetMillisecondsPointer(max)
+	}
+
+	return &result, nil
+}
+
+func GetMillisecondsPointer(duration time.Duration) *float64 {
+	ms := float64(duration) / float64(time.Millisecond)
+	return &ms
+}
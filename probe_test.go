@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	var requests int32
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every second request fails.
+		if atomic.AddInt32(&requests, 1)%2 == 0 {
+			http.Error(w, `{"errorMessage":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"account":{}}`))
+	}))
+
+	result, err := probe(session, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Count != 4 || result.Failures != 2 {
+		t.Errorf("got %d probes with %d failures, want 4 with 2", result.Count, result.Failures)
+	}
+	if result.Min == nil || result.Avg == nil || result.Max == nil || *result.Min > *result.Avg || *result.Avg > *result.Max {
+		t.Errorf("inconsistent timings %+v", result)
+	}
+}
+
+func TestProbeStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"account":{}}`))
+		cancel()
+	}))
+	session.Context = ctx
+
+	start := time.Now()
+	_, err := probe(session, 3, time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("probe waited %s after being cancelled", elapsed)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+// recentTransactionIds is how many emitted ids --dedup-across-reconnect remembers.
+const recentTransactionIds = 1024
+
+// RecentIds remembers the last Size ids added.
+type RecentIds struct {
+	Size  int
+	order []string
+	ids   map[string]bool
+}
+
+func NewRecentIds(size int) *RecentIds {
+	return &RecentIds{Size: size, ids: map[string]bool{}}
+}
+
+// Add records id and reports whether it is new.
+func (self *RecentIds) Add(id string) bool {
+	if self.ids[id] {
+		return false
+	}
+
+	self.ids[id] = true
+	self.order = append(self.order, id)
+	if len(self.order) > self.Size {
+		delete(self.ids, self.order[0])
+		self.order = self.order[1:]
+	}
+	return true
+}
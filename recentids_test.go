@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecentIds(t *testing.T) {
+	ids := NewRecentIds(3)
+	tests := []struct {
+		id  string
+		new bool
+	}{
+		{"1", true}, {"2", true}, {"1", false}, {"3", true},
+		// 1 is forgotten once a fourth id is added.
+		{"4", true}, {"1", true}, {"4", false}, {"3", false}, {"2", true}, {"3", true},
+	}
+	for i, test := range tests {
+		if got := ids.Add(test.id); got != test.new {
+			t.Errorf("add %d of %s: got new %v, want %v", i, test.id, got, test.new)
+		}
+	}
+}
+
+func TestDedupAcrossReconnect(t *testing.T) {
+	transaction := func(id int) string {
+		return fmt.Sprintf(`{"id":"%d","type":"ORDER_FILL"}`, id)
+	}
+	// The resumed stream delivers again the transactions around the drop.
+	connections := [][]int{{1, 2, 3}, {2, 3, 4, 5}, {5, 6}}
+	for _, dedup := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dedup %v", dedup), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var count int32
+			session, output := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&count, 1)
+				if int(n) > len(connections) {
+					cancel()
+					return
+				}
+				for _, id := range connections[n-1] {
+					fmt.Fprintln(w, transaction(id))
+				}
+			}))
+			session.Context = ctx
+
+			options := TransactionsOptions{
+				StreamOptions:        StreamOptions{ReconnectOnAnyError: true, MaxRetries: 5, MaxBackoff: time.Millisecond},
+				DedupAcrossReconnect: dedup,
+			}
+			if err := getTransactionStream(session, &options); err != nil {
+				t.Fatal(err)
+			}
+
+			want := []string{}
+			if dedup {
+				for id := 1; id <= 6; id++ {
+					want = append(want, transaction(id))
+				}
+			} else {
+				for _, ids := range connections {
+					for _, id := range ids {
+						want = append(want, transaction(id))
+					}
+				}
+			}
+			if got := outputLines(output); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
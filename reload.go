@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// ReadInstrumentsFile reads instruments listed one per line or comma
+// separated. Blank lines and # comments are skipped.
+func ReadInstrumentsFile(path string) ([]string, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	instruments := []string{}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		for _, instrument := range strings.Split(line, ",") {
+			if instrument = strings.TrimSpace(instrument); instrument != "" {
+				instruments = append(instruments, instrument)
+			}
+		}
+	}
+	if len(instruments) == 0 {
+		return nil, fmt.Errorf("%s lists no instruments", path)
+	}
+	return instruments, nil
+}
+
+// getStreamWithReload runs the pricing stream and, on SIGHUP, re-reads the
+// instruments file and reopens the stream with the static instruments plus
+// the file's. A file which cannot be read keeps the current stream.
+func getStreamWithReload(session *Session, options PricingOptions, static []string, path string) error {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		ctx, cancel := context.WithCancel(session.Context)
+		streamSession := *session
+		streamSession.Context = ctx
+		current := options
+
+		done := make(chan error, 1)
+		go func() {
+			done <- getStream(&streamSession, &current)
+		}()
+
+		reloaded := false
+		for !reloaded {
+			select {
+			case err := <-done:
+				cancel()
+				return err
+			case <-hangups:
+				instruments, err := ReadInstrumentsFile(path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "reload failed, keeping the current instruments: %s\n", err)
+					continue
+				}
+				options.Instruments = strings.Join(append(append([]string{}, static...), instruments...), ",")
+				reloaded = true
+			}
+		}
+
+		cancel()
+		<-done
+		fmt.Fprintf(os.Stderr, "reloaded %s, streaming %s\n", path, options.Instruments)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadInstrumentsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []string
+	}{
+		{"one per line", "EUR_USD\nUSD_JPY\n", []string{"EUR_USD", "USD_JPY"}},
+		{"comma separated", "EUR_USD, USD_JPY", []string{"EUR_USD", "USD_JPY"}},
+		{"comments and blanks", "# majors\nEUR_USD # euro\n\n  \nUSD_JPY\n", []string{"EUR_USD", "USD_JPY"}},
+		{"empty", "# nothing\n\n", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "instruments.txt")
+			if err := ioutil.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadInstrumentsFile(path)
+			if test.want == nil {
+				if err == nil || !strings.Contains(err.Error(), "lists no instruments") {
+					t.Errorf("got %v, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamReloadOnHangup(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("SIGHUP is only delivered on Unix")
+	}
+	path := filepath.Join(t.TempDir(), "instruments.txt")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hangup := func() {
+		process, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := process.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every connection reports its instruments and stays open.
+	connections := make(chan string, 10)
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections <- r.URL.Query().Get("instruments")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session.Context = ctx
+
+	connected := func() string {
+		select {
+		case instruments := <-connections:
+			return instruments
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream was not opened")
+			return ""
+		}
+	}
+
+	write("USD_JPY\n")
+	done := make(chan error, 1)
+	logged := captureStderr(t, func() {
+		go func() {
+			done <- getStreamWithReload(session, PricingOptions{Instruments: "EUR_USD,USD_JPY"}, []string{"EUR_USD"}, path)
+		}()
+
+		// SIGHUP is only handled once the first stream is open.
+		steps := []struct {
+			contents string
+			want     string
+		}{
+			{"", "EUR_USD,USD_JPY"},
+			{"USD_JPY\nGBP_USD\n", "EUR_USD,USD_JPY,GBP_USD"},
+			{"AUD_USD", "EUR_USD,AUD_USD"},
+		}
+		for i, step := range steps {
+			if i > 0 {
+				write(step.contents)
+				hangup()
+			}
+			if got := connected(); got != step.want {
+				t.Errorf("step %d: streaming %q, want %q", i, got, step.want)
+			}
+		}
+
+		// A broken file keeps the current stream.
+		write("# nothing\n")
+		hangup()
+		select {
+		case instruments := <-connections:
+			t.Errorf("reopened with %q", instruments)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("got %v", err)
+		}
+	})
+	for _, want := range []string{"reloaded " + path + ", streaming EUR_USD,AUD_USD", "reload failed, keeping the current instruments"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("stderr lacks %q:\n%s", want, logged)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// FieldRename moves the value at the dotted path From to the dotted path To.
+type FieldRename struct {
+	From string
+	To   string
+}
+
+// FieldRenames are the --rename mappings, applied in order.
+type FieldRenames []FieldRename
+
+// ParseRenames parses "time=timestamp,mid.c=close". Two renames may not
+// target the same field, nor one target lie inside another.
+func ParseRenames(spec string) (FieldRenames, error) {
+	renames := FieldRenames{}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(entry, "=")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid rename %q, expected from=to", entry)
+		}
+		rename := FieldRename{From: strings.TrimSpace(parts[0]), To: strings.TrimSpace(parts[1])}
+
+		for _, other := range renames {
+			if other.To == rename.To || strings.HasPrefix(other.To, rename.To+".") || strings.HasPrefix(rename.To, other.To+".") {
+				return nil, fmt.Errorf("renames %s=%s and %s=%s conflict", other.From, other.To, rename.From, rename.To)
+			}
+		}
+		renames = append(renames, rename)
+	}
+	return renames, nil
+}
+
+// Apply renames the fields of a JSON object line. Missing fields are
+// skipped, and lines which are not JSON objects are returned as is.
+func (self FieldRenames) Apply(line string) (string, error) {
+	if !strings.HasPrefix(line, "{") {
+		return line, nil
+	}
+
+	message, err := decodeMessage(line)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rename := range self {
+		value, ok := removePath(message, rename.From)
+		if ok {
+			setPath(message, rename.To, value)
+		}
+	}
+
+	return encodeMessage(message)
+}
+
+// decodeMessage decodes a JSON object line, keeping numbers exactly as they
+// were sent.
+func decodeMessage(line string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var message map[string]interface{}
+	if err := decoder.Decode(&message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// encodeMessage encodes a message decoded by decodeMessage back into a line.
+func encodeMessage(message map[string]interface{}) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(message); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
+
+// removePath deletes the field at a dotted path of nested objects and returns its value.
+func removePath(message map[string]interface{}, path string) (interface{}, bool) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		child, ok := message[segment].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		message = child
+	}
+
+	last := segments[len(segments)-1]
+	value, ok := message[last]
+	if ok {
+		delete(message, last)
+	}
+	return value, ok
+}
+
+// setPath sets the field at a dotted path, creating missing objects on the way.
+func setPath(message map[string]interface{}, path string, value interface{}) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		child, ok := message[segment].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			message[segment] = child
+		}
+		message = child
+	}
+	message[segments[len(segments)-1]] = value
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRenames(t *testing.T) {
+	tests := []struct {
+		spec string
+		want FieldRenames
+	}{
+		{"time=timestamp", FieldRenames{{From: "time", To: "timestamp"}}},
+		{"time = timestamp, mid.c=close", FieldRenames{{From: "time", To: "timestamp"}, {From: "mid.c", To: "close"}}},
+		{"mid.c=close,mid.o=open", FieldRenames{{From: "mid.c", To: "close"}, {From: "mid.o", To: "open"}}},
+		{"time", nil},
+		{"time=", nil},
+		{"=timestamp", nil},
+		{"a=b=c", nil},
+		{"time=t,volume=t", nil},
+		{"time=t,volume=t.v", nil},
+		{"time=t.v,volume=t", nil},
+	}
+	for _, test := range tests {
+		got, err := ParseRenames(test.spec)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestFieldRenamesApply(t *testing.T) {
+	tests := []struct {
+		spec string
+		line string
+		want string
+	}{
+		{"time=timestamp", `{"time":"2021-03-01T00:00:00Z","volume":12}`, `{"timestamp":"2021-03-01T00:00:00Z","volume":12}`},
+		{"mid.c=close", `{"mid":{"c":"1.2075","o":"1.2070"}}`, `{"close":"1.2075","mid":{"o":"1.2070"}}`},
+		{"volume=stats.volume", `{"volume":12}`, `{"stats":{"volume":12}}`},
+		// Numbers are kept exactly as sent.
+		{"volume=v", `{"volume":12.50}`, `{"v":12.50}`},
+		{"missing=m", `{"volume":12}`, `{"volume":12}`},
+		{"time=t", `EUR_USD 1.2075`, `EUR_USD 1.2075`},
+	}
+	for _, test := range tests {
+		renames, err := ParseRenames(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := renames.Apply(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%q on %s: got %s, want %s", test.spec, test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// samplingLogInterval is how often SamplingWriter reports what it dropped.
+const samplingLogInterval = 10 * time.Second
+
+// SamplingWriter decouples the stream reader from a slow sink
+// (--sample-on-backpressure). Lines are queued for a background goroutine;
+// once more than HighWater lines are pending, each new line is kept with a
+// probability of 1/Keep only, so that the reader keeps pace while the output
+// stays a uniform sample of the stream. Below the mark every line is kept.
+type SamplingWriter struct {
+	Writer    io.Writer
+	HighWater int
+	Keep      int
+	queue     chan []byte
+	done      chan struct{}
+	mutex     sync.Mutex
+	closed    bool
+	err       error
+	written   int
+	dropped   int
+	logged    time.Time
+}
+
+// NewSamplingWriter queues up to size lines for writer.
+func NewSamplingWriter(writer io.Writer, size int, highWater int, keep int) (*SamplingWriter, error) {
+	if size <= 0 || highWater <= 0 || highWater > size {
+		return nil, fmt.Errorf("invalid output buffer %d with high-water mark %d", size, highWater)
+	}
+	if keep < 1 {
+		return nil, fmt.Errorf("invalid sample rate 1 in %d", keep)
+	}
+
+	self := &SamplingWriter{
+		Writer:    writer,
+		HighWater: highWater,
+		Keep:      keep,
+		queue:     make(chan []byte, size),
+		done:      make(chan struct{}),
+		logged:    time.Now(),
+	}
+	go self.run()
+	return self, nil
+}
+
+func (self *SamplingWriter) run() {
+	defer close(self.done)
+	for line := range self.queue {
+		if _, err := self.Writer.Write(line); err != nil {
+			self.mutex.Lock()
+			self.err = err
+			self.mutex.Unlock()
+		}
+	}
+}
+
+// Write queues a copy of p, or drops it under backpressure. A failure of the
+// sink is returned by the next Write, and os.ErrClosed once closed.
+func (self *SamplingWriter) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return 0, os.ErrClosed
+	}
+	if self.err != nil {
+		return 0, self.err
+	}
+
+	if len(self.queue) >= self.HighWater && rand.Intn(self.Keep) != 0 {
+		self.dropped++
+	} else {
+		// Even a sampled line is dropped when the queue is full, rather
+		// than blocking the reader.
+		select {
+		case self.queue <- append([]byte(nil), p...):
+			self.written++
+		default:
+			self.dropped++
+		}
+	}
+
+	if time.Since(self.logged) >= samplingLogInterval {
+		if self.dropped != 0 {
+			rate := float64(self.dropped) / float64(self.dropped+self.written) * 100
+			fmt.Fprintf(os.Stderr, "backpressure: dropped %d of %d lines (%.1f%%) in the last %s\n", self.dropped, self.dropped+self.written, rate, samplingLogInterval)
+		}
+		self.written, self.dropped = 0, 0
+		self.logged = time.Now()
+	}
+	return len(p), nil
+}
+
+// Close writes out the queued lines, then flushes and releases the sink.
+func (self *SamplingWriter) Close() error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return os.ErrClosed
+	}
+	self.closed = true
+	close(self.queue)
+	self.mutex.Unlock()
+	<-self.done
+
+	if self.err != nil {
+		return self.err
+	}
+	if flusher, ok := self.Writer.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	if closer, ok := self.Writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
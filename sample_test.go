@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSamplingWriterKeepsEveryLineBelowHighWater(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer, err := NewSamplingWriter(output, 16, 16, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"a\n", "b\n", "c\n"} {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := output.String(); got != "a\nb\nc\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSamplingWriterAfterClose(t *testing.T) {
+	writer, err := NewSamplingWriter(&bytes.Buffer{}, 4, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("late\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close returned %v, want %v", err, os.ErrClosed)
+	}
+	if err := writer.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("second Close returned %v, want %v", err, os.ErrClosed)
+	}
+}
+
+// stalledWriter is a consumer which hangs in its first Write until released.
+type stalledWriter struct {
+	bytes.Buffer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (self *stalledWriter) Write(p []byte) (int, error) {
+	if self.started != nil {
+		close(self.started)
+		self.started = nil
+		<-self.release
+	}
+	return self.Buffer.Write(p)
+}
+
+func TestSamplingWriterSlowConsumer(t *testing.T) {
+	tests := []struct {
+		name string
+		keep int
+		// kept is how many of the 100 lines get through: the one being
+		// written, and then up to the high-water mark of 4, or with 1 in 1
+		// sampled, up to the buffer size of 8.
+		kept int
+	}{
+		{"sampled", 1 << 30, 1 + 4},
+		{"every line sampled", 1, 1 + 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &stalledWriter{started: make(chan struct{}), release: make(chan struct{})}
+			started := output.started
+			writer, err := NewSamplingWriter(output, 8, 4, test.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The reader never blocks on the stalled consumer.
+			if _, err := writer.Write([]byte("0\n")); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+			for i := 1; i < 100; i++ {
+				if _, err := writer.Write([]byte(fmt.Sprintf("%d\n", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(output.release)
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			want := ""
+			for i := 0; i < test.kept; i++ {
+				want += fmt.Sprintf("%d\n", i)
+			}
+			if got := output.String(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestNewSamplingWriterInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		highWater int
+		keep      int
+	}{
+		{"no buffer", 0, 0, 2},
+		{"no high-water mark", 8, 0, 2},
+		{"high-water mark above the buffer", 8, 9, 2},
+		{"no sample rate", 8, 4, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewSamplingWriter(&bytes.Buffer{}, test.size, test.highWater, test.keep); err == nil {
+				t.Error("was accepted")
+			}
+		})
+	}
+}
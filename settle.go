@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// settleTimeout bounds the re-fetch of settleIncomplete, which runs after the
+// session context is done.
+const settleTimeout = 5 * time.Second
+
+// settleIncomplete makes sure that an incomplete candle is not the last one
+// written when a stream stops (--drop-incomplete-on-exit). The candle is
+// fetched once more and its completed version written if OANDA has it by now;
+// otherwise a {"type":"RETRACT","time":...} marker tells consumers to discard it.
+func settleIncomplete(session *Session, options *CandlesOptions, writer *CandleWriter) error {
+	last := writer.last
+	if last == nil || last.Complete {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancel()
+	settling := *session
+	settling.Context = ctx
+
+	candles, err := getCandlesForStream(&settling, options, last.Time)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not re-fetch the incomplete candle: %s\n", err)
+	} else {
+		for _, candle := range *candles {
+			if candle.Time.Equal(last.Time) && candle.Complete {
+				return writer.Write(candle)
+			}
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(map[string]interface{}{"type": "RETRACT", "time": last.Time})
+	if err != nil {
+		return err
+	}
+	line := string(bytes)
+	if writer.Granularity != "" {
+		line = injectField(line, "granularity", writer.Granularity)
+	}
+	if writer.Instrument != "" {
+		line = injectField(line, "instrument", writer.Instrument)
+	}
+	return writer.Output.Emit(line)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettleIncomplete(t *testing.T) {
+	at := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	candleAt := func(volume int, complete bool) Candlestick {
+		candle := testCandle("1.2", "1.0", "1.1", volume, complete)
+		candle.Time = at
+		return *candle
+	}
+	tests := []struct {
+		name    string
+		filter  string
+		written []Candlestick
+		fetched Candlestick
+		want    string
+	}{
+		{"completed since", "", []Candlestick{candleAt(5, false)}, candleAt(7, true), `"complete":true`},
+		{"still incomplete", "", []Candlestick{candleAt(5, false)}, candleAt(6, false), `"type":"RETRACT"`},
+		{"last written is complete", "", []Candlestick{candleAt(5, true)}, candleAt(5, true), ""},
+		{"incomplete filtered out", "volume > 10", []Candlestick{candleAt(20, true), candleAt(5, false)}, candleAt(6, false), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetches := 0
+			session, output := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches++
+				json.NewEncoder(w).Encode(CandlesResponseBody{Candles: &[]Candlestick{test.fetched}, Granularity: "M1", Instrument: "EUR_USD"})
+			}))
+			if test.filter != "" {
+				filter, err := ParseFilterExpr(test.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				session.Output.Filter = filter
+			}
+			options := &CandlesOptions{Instrument: "EUR_USD", Granularity: "M1"}
+			writer := &CandleWriter{Output: session.Output, Instrument: "EUR_USD", Granularity: "M1"}
+			for _, candle := range test.written {
+				if err := writer.Write(candle); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := output.String()
+
+			if err := settleIncomplete(session, options, writer); err != nil {
+				t.Fatal(err)
+			}
+			settled := strings.TrimPrefix(output.String(), before)
+			if test.want == "" {
+				if settled != "" || fetches != 0 {
+					t.Errorf("settled %q with %d fetches, want nothing", settled, fetches)
+				}
+				return
+			}
+			if !strings.Contains(settled, test.want) || !strings.Contains(settled, `"instrument":"EUR_USD"`) || strings.Count(settled, "\n") != 1 {
+				t.Errorf("settled %q, want one line with %s", settled, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FormattedWriter writes the lines of Output in an output format (--output),
+// which can differ between sinks written at once (--stdout-format,
+// --file-format). A line is formatted and written under one lock, so that a
+// format keeping state, e.g. a CSV header, sees the lines in the order written.
+type FormattedWriter struct {
+	Writer    io.Writer
+	Formatter Formatter
+	mutex     sync.Mutex
+}
+
+func NewFormattedWriter(writer io.Writer, format string, options FormatOptions) (*FormattedWriter, error) {
+	formatter, err := NewFormatter(format, options)
+	if err != nil {
+		return nil, err
+	}
+	return &FormattedWriter{Writer: writer, Formatter: formatter}, nil
+}
+
+// Write expects exactly one line per call, as Output writes them.
+func (self *FormattedWriter) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	line, err := self.Formatter.Format(strings.TrimSuffix(string(p), "\n"))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(self.Writer, line+"\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (self *FormattedWriter) Flush() error {
+	return flushWriter(self.Writer)
+}
+
+// Close ends the format, if it has an ending, and closes the sink.
+func (self *FormattedWriter) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if ender, ok := self.Formatter.(Ender); ok {
+		if _, err := io.WriteString(self.Writer, ender.End()+"\n"); err != nil {
+			closeWriter(self.Writer)
+			return err
+		}
+	}
+	return closeWriter(self.Writer)
+}
+
+// TeeWriter writes every line to all of Writers, stopping at the first failure.
+type TeeWriter struct {
+	Writers []io.Writer
+}
+
+func (self *TeeWriter) Write(p []byte) (int, error) {
+	for _, writer := range self.Writers {
+		if _, err := writer.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (self *TeeWriter) Flush() error {
+	for _, writer := range self.Writers {
+		if err := flushWriter(writer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every writer, reporting the first error.
+func (self *TeeWriter) Close() error {
+	var first error
+	for _, writer := range self.Writers {
+		if err := closeWriter(writer); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// teeStdout adds stdout, in the given format, to the sink of the output.
+func (self *Output) teeStdout(format string, options FormatOptions) error {
+	stdout, err := NewFormattedWriter(&LockedWriter{Writer: os.Stdout}, format, options)
+	if err != nil {
+		return err
+	}
+	self.Writer = &TeeWriter{Writers: []io.Writer{self.Writer, stdout}}
+	return nil
+}
+
+// flushWriter flushes writer, if it buffers.
+func flushWriter(writer io.Writer) error {
+	if flusher, ok := writer.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// closeWriter releases writer, if it needs releasing.
+func closeWriter(writer io.Writer) error {
+	if closer, ok := writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// GetDefaultStatePath is where --since-last-run keeps the cursor of a candle series.
+func GetDefaultStatePath(instrument string, granularity string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/.config/oanda/state/candles_%s_%s.json", home, instrument, granularity), nil
+}
+
+// ReadCandleState loads the last candle written by a previous run. It returns
+// nil without error when there is no previous run.
+func ReadCandleState(path string) (*Candlestick, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var candle Candlestick
+	if err := json.Unmarshal(bytes, &candle); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &candle, nil
+}
+
+// WriteCandleState persists the last candle seen, replacing the file
+// atomically so an interrupted run never leaves a truncated cursor behind.
+func WriteCandleState(path string, candle *Candlestick) error {
+	bytes, err := json.Marshal(candle)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
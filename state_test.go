@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCandleState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "candles_EUR_USD_M1.json")
+	if candle, err := ReadCandleState(path); err != nil || candle != nil {
+		t.Fatalf("got %v, %v before the first run, want no state", candle, err)
+	}
+
+	written := minuteCandle(3, 7, true)
+	if err := WriteCandleState(path, &written); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadCandleState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.Time.Equal(written.Time) || read.Volume != 7 || !read.Complete {
+		t.Errorf("read %+v, want %+v", read, written)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"time":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCandleState(path); err == nil {
+		t.Error("a truncated state was read")
+	}
+}
+
+func TestSinceLastRun(t *testing.T) {
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	options := CandlesOptions{From: &from, StateFile: filepath.Join(t.TempDir(), "state.json")}
+
+	// The first run starts at --from and keeps the last candle it saw.
+	lines, polls := pollCandles(t, options, []Candlestick{minuteCandle(0, 1, true), minuteCandle(1, 1, true), minuteCandle(2, 1, false)})
+	if got := polls[0].query.Get("from"); got != from.Format(time.RFC3339) {
+		t.Errorf("the first run started from %s, want --from", got)
+	}
+	if len(lines) != 3 {
+		t.Errorf("the first run wrote %d candles, want 3", len(lines))
+	}
+
+	// The next run continues from it, whatever --from, and skips what was
+	// already written.
+	lines, polls = pollCandles(t, options, []Candlestick{minuteCandle(2, 4, true), minuteCandle(3, 1, false)})
+	if got, want := polls[0].query.Get("from"), minuteCandle(2, 0, false).Time.Format(time.RFC3339); got != want {
+		t.Errorf("the next run started from %s, want %s", got, want)
+	}
+	if len(lines) != 2 {
+		t.Errorf("the next run wrote %v, want the completed and the new candle", lines)
+	}
+
+	state, err := ReadCandleState(options.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Time.Equal(minuteCandle(3, 0, false).Time) {
+		t.Errorf("the state is at %s, want the last candle", state.Time)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultMaxRetries = 5
+	// defaultReconnectMaxBackoff caps the doubling wait between reconnect attempts.
+	defaultReconnectMaxBackoff = 30 * time.Second
+	// defaultMaxLineBytes is far above any real message, so that only a
+	// corrupted stream hits it.
+	defaultMaxLineBytes = 1 << 20
+)
+
+var (
+	errHeartbeatTimeout = errors.New("heartbeat timeout")
+	errOversizeLine     = errors.New("stream line exceeds --max-line-bytes")
+)
+
+// StreamOptions are the connection level options shared by the pricing and
+// transactions streams.
+type StreamOptions struct {
+	HeartbeatTimeout    time.Duration `yaml:"heartbeat_timeout"`
+	ReconnectOnAnyError bool          `yaml:"reconnect_on_any_error"`
+	// ReconnectStatuses are the statuses of the stream request which are
+	// retried even without ReconnectOnAnyError.
+	ReconnectStatuses []int         `yaml:"reconnect_on_status"`
+	MaxRetries        int           `yaml:"max_retries"`
+	MaxBackoff        time.Duration `yaml:"reconnect_max_backoff"`
+	// MaxLineBytes limits the length of a single line, 0 for no limit.
+	// OnOversize is what to do with a longer one: skip (default) or abort.
+	MaxLineBytes int    `yaml:"max_line_bytes"`
+	OnOversize   string `yaml:"on_oversize"`
+	// ReloadCredentials reads the credentials file again before every
+	// reconnect, so that a rotated token is picked up.
+	ReloadCredentials bool `yaml:"reload_credentials"`
+	// ReconnectMarkers writes a RECONNECT line before every reconnect, so
+	// that consumers know the data may have a gap there.
+	ReconnectMarkers bool `yaml:"reconnect_markers"`
+}
+
+// defaultStreamOptions are the options of a batch job which does not set them.
+func defaultStreamOptions(heartbeatTimeout time.Duration) StreamOptions {
+	return StreamOptions{
+		HeartbeatTimeout: heartbeatTimeout,
+		MaxRetries:       defaultMaxRetries,
+		MaxBackoff:       defaultReconnectMaxBackoff,
+		MaxLineBytes:     defaultMaxLineBytes,
+	}
+}
+
+// streamFlags are the flags controlling how a stream is read and recovers from errors.
+func streamFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "reconnect-on-any-error",
+			Usage: "Reconnect on any stream error (read, parse, heartbeat timeout, EOF), except authentication failures",
+		},
+		&cli.StringFlag{
+			Name:  "reconnect-on-status",
+			Usage: "Reconnect when the stream request answers with one of these statuses (CSV), e.g. the gateway errors 502,503,504 of a deployment at OANDA; 401 and 403 excepted",
+		},
+		&cli.BoolFlag{
+			Name:  "quiet",
+			Usage: "Do not write the banner with env, account, instruments and endpoint to stderr before streaming",
+		},
+		&cli.BoolFlag{
+			Name:  "reconnect-markers",
+			Usage: "Write a {\"type\":\"RECONNECT\",\"attempt\":N} line before every reconnect, where the data may have a gap",
+		},
+		&cli.BoolFlag{
+			Name:  "reload-credentials",
+			Usage: "Read the credentials file again before every reconnect, to pick up a rotated token",
+		},
+		&cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "Give up after this many consecutive failed reconnects",
+			Value: defaultMaxRetries,
+		},
+		&cli.DurationFlag{
+			Name:  "reconnect-max-backoff",
+			Usage: "Cap of the randomized, doubling wait between reconnects",
+			Value: defaultReconnectMaxBackoff,
+		},
+		&cli.IntFlag{
+			Name:  "max-line-bytes",
+			Usage: "Treat a stream line longer than this as corrupt, 0 for no limit",
+			Value: defaultMaxLineBytes,
+		},
+		&cli.StringFlag{
+			Name:  "health-addr",
+			Usage: "Serve /healthz and /readyz on this address, e.g. :8080",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "Serve Prometheus metrics on /metrics at this address, e.g. :9090",
+		},
+		&cli.StringFlag{
+			Name:  "on-oversize",
+			Usage: "What to do with a line longer than --max-line-bytes: skip or abort",
+			Value: "skip",
+		},
+	}
+}
+
+// ParseReconnectStatuses parses --reconnect-on-status. Authentication
+// failures cannot be retried.
+func ParseReconnectStatuses(spec string) ([]int, error) {
+	statuses := []int{}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		status, err := strconv.Atoi(field)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid status %q", field)
+		}
+		if status == 401 || status == 403 {
+			return nil, fmt.Errorf("status %d cannot be reconnected on, the credentials are rejected", status)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// isReconnectStatus reports whether err is a stream request answered with
+// one of statuses.
+func isReconnectStatus(err error, statuses []int) bool {
+	var statusErr *StreamStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	for _, status := range statuses {
+		if statusErr.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamStatusError is returned when a stream endpoint answers with a non-200 status.
+type StreamStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (self *StreamStatusError) Error() string {
+	return self.Body
+}
+
+// isFatalStreamError reports errors which reconnecting cannot fix: rejected
+// credentials, host names which do not resolve, certificates which do not
+// verify, and failures to write or validate the output.
+func isFatalStreamError(err error) bool {
+	var statusErr *StreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == 401 || statusErr.StatusCode == 403
+	}
+	if errors.Is(err, errOversizeLine) || errors.Is(err, errPrintedCurl) {
+		return true
+	}
+	if class := classifyNetworkError(err); class == networkErrorDNS || class == networkErrorTLS {
+		return true
+	}
+	var invalidErr *InvalidOutputError
+	if errors.As(err, &invalidErr) {
+		return true
+	}
+	var outputErr *OutputError
+	return errors.As(err, &outputErr)
+}
+
+const (
+	// networkErrorDNS is a name which does not resolve, most likely a
+	// misconfiguration which retrying will not fix.
+	networkErrorDNS = "dns"
+	// networkErrorDNSTemporary is a resolver failure which may clear up.
+	networkErrorDNSTemporary = "dns-temporary"
+	// networkErrorRefused usually means the other side is restarting.
+	networkErrorRefused = "connection-refused"
+	networkErrorTimeout = "timeout"
+	// networkErrorTLS is a certificate which does not verify, or a server
+	// which does not speak TLS, neither of which goes away by retrying.
+	networkErrorTLS = "tls"
+	// networkErrorReset and networkErrorEOF are a connection dropped by the
+	// other side or on the way, the usual end of a long-lived stream.
+	networkErrorReset = "connection-reset"
+	networkErrorEOF   = "eof"
+)
+
+// classifyNetworkError names the kind of network failure behind err, or
+// returns "" when err is not a network failure.
+func classifyNetworkError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout || dnsErr.IsTemporary {
+			return networkErrorDNSTemporary
+		}
+		return networkErrorDNS
+	}
+	if isConnectionRefused(err) {
+		return networkErrorRefused
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return networkErrorTimeout
+	}
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certificateInvalidErr) || errors.As(err, &hostnameErr) || errors.As(err, &recordHeaderErr) {
+		return networkErrorTLS
+	}
+	if isConnectionReset(err) {
+		return networkErrorReset
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return networkErrorEOF
+	}
+	return ""
+}
+
+// lineHandler processes one line of a stream and reports whether it was a heartbeat.
+type lineHandler func(line []byte) (heartbeat bool, err error)
+
+// streamLines connects to a streaming endpoint and feeds every line to
+// handle. It returns nil once the session context is done, and otherwise
+// the error which ended the stream, after reconnecting when configured to.
+func streamLines(session *Session, url string, options *StreamOptions, handle lineHandler) error {
+	if options.OnOversize != "" && options.OnOversize != "skip" && options.OnOversize != "abort" {
+		return fmt.Errorf("unknown on-oversize %q, expected skip or abort", options.OnOversize)
+	}
+
+	retries := 0
+	for {
+		received, err := streamOnce(session, url, options, handle)
+		if session.Context.Err() != nil {
+			return nil
+		}
+		if received {
+			retries = 0
+		}
+
+		retryable := options.ReconnectOnAnyError || isReconnectStatus(err, options.ReconnectStatuses)
+		if !retryable || isFatalStreamError(err) || retries >= options.MaxRetries {
+			return err
+		}
+
+		retries++
+		if session.Metrics != nil {
+			session.Metrics.Reconnect()
+		}
+		backoff := reconnectBackoff(retries, options.MaxBackoff)
+		kind := "stream error"
+		if class := classifyNetworkError(err); class != "" {
+			kind = fmt.Sprintf("stream error (%s)", class)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s, reconnecting in %s (%d/%d)\n", kind, err, backoff, retries, options.MaxRetries)
+
+		select {
+		case <-session.Context.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		if options.ReloadCredentials {
+			if err := session.ReloadCredentials(); err != nil {
+				fmt.Fprintf(os.Stderr, "reloading credentials failed, keeping the current ones: %s\n", err)
+			}
+		}
+		// Like heartbeats, markers are neither filtered nor counted.
+		if options.ReconnectMarkers {
+			if err := session.Output.Println(fmt.Sprintf(`{"type":"RECONNECT","attempt":%d}`, retries)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reconnectBackoff picks a random wait up to a ceiling which doubles from one
+// second for each consecutive attempt until it reaches max ("full jitter"),
+// so that many processes recovering at once do not reconnect in step.
+func reconnectBackoff(attempt int, max time.Duration) time.Duration {
+	if max <= 0 {
+		max = defaultReconnectMaxBackoff
+	}
+	ceiling := time.Second
+	for i := 1; i < attempt && ceiling < max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > max {
+		ceiling = max
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// streamOnce runs a single connection. received reports whether any line
+// arrived, so that a stream which worked for a while starts its retries afresh.
+func streamOnce(session *Session, url string, options *StreamOptions, handle lineHandler) (received bool, err error) {
+	ctx, cancel := context.WithCancel(session.Context)
+	defer cancel()
+
+	req, err := session.NewRequest(ctx, url)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := session.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		fmt.Fprintln(os.Stderr, res.Status)
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return false, err
+		}
+		return false, &StreamStatusError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+
+	if session.Health != nil {
+		session.Health.Connected()
+		defer session.Health.Disconnected()
+	}
+
+	heartbeatChannel := make(chan struct{}, 1)
+	timedOut := make(chan struct{})
+
+	if options.HeartbeatTimeout != 0 {
+		go func() {
+			for {
+				select {
+				case <-heartbeatChannel:
+				case <-ctx.Done():
+					return
+				case <-time.After(options.HeartbeatTimeout):
+					close(timedOut)
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	reader := bufio.NewReader(res.Body)
+	for {
+		line, oversize, err := readLine(reader, options.MaxLineBytes)
+		if err != nil {
+			select {
+			case <-timedOut:
+				return received, errHeartbeatTimeout
+			default:
+				return received, err
+			}
+		}
+		received = true
+		if session.Health != nil {
+			session.Health.Received()
+		}
+
+		if oversize {
+			if options.OnOversize == "abort" {
+				return received, errOversizeLine
+			}
+			fmt.Fprintf(os.Stderr, "skipped a stream line longer than %d bytes\n", options.MaxLineBytes)
+			continue
+		}
+
+		heartbeat, err := handle(line)
+		if session.Metrics != nil {
+			session.Metrics.Line(session.Shard, line, heartbeat)
+		}
+		if err != nil {
+			return received, err
+		}
+		if heartbeat && options.HeartbeatTimeout != 0 {
+			notifyHeartbeat(heartbeatChannel)
+		}
+	}
+}
+
+// readLine reads a whole line, however many reads of the buffer it takes. A
+// line longer than max bytes, when max is positive, is consumed without being
+// kept and reported as oversize.
+func readLine(reader *bufio.Reader, max int) (line []byte, oversize bool, err error) {
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		if !oversize {
+			if max > 0 && len(line)+len(chunk) > max {
+				oversize = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if !isPrefix {
+			return line, oversize, nil
+		}
+	}
+}
+
+// notifyHeartbeat resets the heartbeat watchdog without ever blocking the read
+// loop: the channel is buffered and one pending notification is enough.
+func notifyHeartbeat(heartbeatChannel chan<- struct{}) {
+	select {
+	case heartbeatChannel <- struct{}{}:
+	default:
+	}
+}
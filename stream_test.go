@@ -0,0 +1,905 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// droppingStream serves one price per connection and then drops it, until
+// the last connection, which stays open.
+func droppingStream(connections int32) http.Handler {
+	var count int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&count, 1)
+		fmt.Fprintf(w, "{\"type\":\"PRICE\",\"n\":%d}\n", n)
+		w.(http.Flusher).Flush()
+		if n >= connections {
+			<-r.Context().Done()
+		}
+	})
+}
+
+// fixedStream serves lines and then ends the stream.
+func fixedStream(lines ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// outputLines splits what a test session wrote into its lines.
+func outputLines(output fmt.Stringer) []string {
+	text := strings.TrimSpace(output.String())
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(text, "\n")
+}
+
+// pricingLines streams lines through getStream with options and returns the
+// lines it wrote.
+func pricingLines(t *testing.T, options PricingOptions, lines ...string) []string {
+	session, output := newTestSession(t, fixedStream(lines...))
+	if err := getStream(session, &options); err != io.EOF {
+		t.Fatalf("the stream ended with %v", err)
+	}
+	return outputLines(output)
+}
+
+// transactionLines streams lines through getTransactionStream with options
+// and returns the lines it wrote.
+func transactionLines(t *testing.T, options TransactionsOptions, lines ...string) []string {
+	session, output := newTestSession(t, fixedStream(lines...))
+	if err := getTransactionStream(session, &options); err != io.EOF {
+		t.Fatalf("the stream ended with %v", err)
+	}
+	return outputLines(output)
+}
+
+// readStream reads the stream until want lines were emitted.
+func readStream(t *testing.T, session *Session, options *StreamOptions, want int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session.Context = ctx
+
+	emitted := 0
+	err := streamLines(session, "http://stream/v3/accounts/1/pricing/stream", options, func(line []byte) (bool, error) {
+		if err := session.Output.Emit(string(line)); err != nil {
+			return false, err
+		}
+		if emitted++; emitted == want {
+			cancel()
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emitted != want {
+		t.Fatalf("read %d lines, want %d", emitted, want)
+	}
+}
+
+func TestStreamReconnectMarkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		markers bool
+		want    []string
+	}{
+		{"with markers", true, []string{"PRICE", "RECONNECT", "PRICE", "RECONNECT", "PRICE"}},
+		{"without markers", false, []string{"PRICE", "PRICE", "PRICE"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, output := newTestSession(t, droppingStream(3))
+			options := &StreamOptions{ReconnectOnAnyError: true, MaxRetries: 5, MaxBackoff: time.Millisecond, ReconnectMarkers: test.markers}
+			readStream(t, session, options, 3)
+
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			types := []string{}
+			for _, line := range lines {
+				var message struct {
+					Type    string `json:"type"`
+					Attempt int    `json:"attempt"`
+				}
+				if err := json.Unmarshal([]byte(line), &message); err != nil {
+					t.Fatal(err)
+				}
+				types = append(types, message.Type)
+				if message.Type == "RECONNECT" {
+					// Every reconnect got through, so each is the first attempt.
+					if message.Attempt != 1 {
+						t.Errorf("marker %s, want attempt 1", line)
+					}
+				}
+			}
+			if strings.Join(types, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got %v, want %v", types, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamSequenceAcrossReconnect(t *testing.T) {
+	session, output := newTestSession(t, droppingStream(3))
+	session.Output.Seq = &Sequence{}
+	options := &StreamOptions{ReconnectOnAnyError: true, MaxRetries: 5, MaxBackoff: time.Millisecond, ReconnectMarkers: true}
+	readStream(t, session, options, 3)
+
+	last := int64(0)
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var message struct {
+			Type string `json:"type"`
+			Seq  int64  `json:"_seq"`
+		}
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Type == "RECONNECT" {
+			if message.Seq != 0 {
+				t.Errorf("marker %s is numbered", line)
+			}
+			continue
+		}
+		if message.Seq != last+1 {
+			t.Errorf("line %s follows _seq %d", line, last)
+		}
+		last = message.Seq
+	}
+	if last != 3 {
+		t.Errorf("last _seq %d, want 3", last)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		max     time.Duration
+		ceiling time.Duration
+	}{
+		{1, 30 * time.Second, time.Second},
+		{2, 30 * time.Second, 2 * time.Second},
+		{4, 30 * time.Second, 8 * time.Second},
+		{6, 30 * time.Second, 30 * time.Second},
+		{50, 30 * time.Second, 30 * time.Second},
+		{3, 3 * time.Second, 3 * time.Second},
+		{10, 0, defaultReconnectMaxBackoff},
+	}
+	for _, test := range tests {
+		longest := time.Duration(0)
+		for i := 0; i < 200; i++ {
+			backoff := reconnectBackoff(test.attempt, test.max)
+			if backoff < 0 || backoff > test.ceiling {
+				t.Fatalf("attempt %d with max %s: backoff %s outside [0, %s]", test.attempt, test.max, backoff, test.ceiling)
+			}
+			if backoff > longest {
+				longest = backoff
+			}
+		}
+		// The wait is spread over the whole range, not fixed at its start.
+		if longest < test.ceiling/4 {
+			t.Errorf("attempt %d with max %s: longest of 200 backoffs is %s", test.attempt, test.max, longest)
+		}
+	}
+}
+
+func TestStreamGivesUpAfterMaxRetries(t *testing.T) {
+	var requests int32
+	session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}))
+	session.Context = context.Background()
+
+	options := &StreamOptions{ReconnectOnAnyError: true, MaxRetries: 2, MaxBackoff: time.Millisecond}
+	err := streamLines(session, "http://stream/v3/accounts/1/pricing/stream", options, func(line []byte) (bool, error) {
+		return false, nil
+	})
+	var statusErr *StreamStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got error %v, want the 500 status", err)
+	}
+	if requests != 3 {
+		t.Errorf("made %d requests, want the first and 2 retries", requests)
+	}
+}
+
+func TestParseReconnectStatuses(t *testing.T) {
+	tests := []struct {
+		spec  string
+		want  []int
+		valid bool
+	}{
+		{"502,503,504", []int{502, 503, 504}, true},
+		{" 500 , 429 ", []int{500, 429}, true},
+		{"", []int{}, true},
+		{"503,", []int{503}, true},
+		{"abc", nil, false},
+		{"99", nil, false},
+		{"600", nil, false},
+		{"503,401", nil, false},
+		{"403", nil, false},
+	}
+	for _, test := range tests {
+		got, err := ParseReconnectStatuses(test.spec)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.spec)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: got %v, %v, want %v", test.spec, got, err, test.want)
+		}
+	}
+}
+
+func TestReconnectOnStatusDefault(t *testing.T) {
+	c := newTestContext(t, streamFlags())
+	statuses, err := ParseReconnectStatuses(c.String("reconnect-on-status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("reconnecting on %v by default, want no status", statuses)
+	}
+	if options := defaultStreamOptions(0); len(options.ReconnectStatuses) != 0 {
+		t.Errorf("batch jobs reconnect on %v by default, want no status", options.ReconnectStatuses)
+	}
+}
+
+func TestStreamReconnectOnStatus(t *testing.T) {
+	gateway := []int{502, 503, 504}
+	tests := []struct {
+		name     string
+		statuses []int
+		status   int
+		requests int32
+		fatal    bool
+	}{
+		// Two 503s, then the stream works.
+		{"listed status", gateway, http.StatusServiceUnavailable, 3, false},
+		// Not listed, and not reconnecting on any error.
+		{"other status", gateway, http.StatusInternalServerError, 1, true},
+		// Without --reconnect-on-status, a stream fails fast as it used to.
+		{"no statuses", nil, http.StatusServiceUnavailable, 1, true},
+		// Rejected credentials are never retried.
+		{"unauthorized", gateway, http.StatusUnauthorized, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			session, output := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= 2 {
+					http.Error(w, "unavailable", test.status)
+					return
+				}
+				fmt.Fprintln(w, `{"type":"PRICE"}`)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			session.Context = ctx
+
+			options := &StreamOptions{ReconnectStatuses: test.statuses, MaxRetries: 5, MaxBackoff: time.Millisecond}
+			err := streamLines(session, "http://stream/v3/accounts/1/pricing/stream", options, func(line []byte) (bool, error) {
+				cancel()
+				return false, session.Output.Emit(string(line))
+			})
+			if test.fatal != (err != nil) {
+				t.Errorf("got error %v", err)
+			}
+			if requests != test.requests {
+				t.Errorf("made %d requests, want %d", requests, test.requests)
+			}
+			if !test.fatal && output.String() != "{\"type\":\"PRICE\"}\n" {
+				t.Errorf("got output %q", output.String())
+			}
+		})
+	}
+}
+
+// heartbeatFlood writes heartbeats as fast as it can for flood, or until the
+// client goes away, and then holds the connection open in silence.
+func heartbeatFlood(flood time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		end := time.Now().Add(flood)
+		for time.Now().Before(end) && r.Context().Err() == nil {
+			if _, err := fmt.Fprintln(w, `{"type":"HEARTBEAT","time":"2021-03-01T00:00:00Z"}`); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	})
+}
+
+func TestStreamHeartbeatFlood(t *testing.T) {
+	tests := []struct {
+		name    string
+		flood   time.Duration
+		timeout time.Duration
+	}{
+		// Heartbeats keep the stream alive until they stop.
+		{"timeout after the flood", 200 * time.Millisecond, 50 * time.Millisecond},
+		// The timeout fires in the middle of the flood, racing the
+		// notifications of the read loop.
+		{"timeout during the flood", time.Minute, time.Microsecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, _ := newTestSession(t, heartbeatFlood(test.flood))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			session.Context = ctx
+
+			var heartbeats int64
+			start := time.Now()
+			received, err := streamOnce(session, "http://stream/v3/accounts/1/pricing/stream", &StreamOptions{HeartbeatTimeout: test.timeout}, func(line []byte) (bool, error) {
+				atomic.AddInt64(&heartbeats, 1)
+				return true, nil
+			})
+			if err != errHeartbeatTimeout {
+				t.Fatalf("got %v after %d heartbeats, want %v", err, heartbeats, errHeartbeatTimeout)
+			}
+			if test.flood < time.Minute {
+				if !received || time.Since(start) < test.flood {
+					t.Errorf("timed out after %s and %d heartbeats, during the flood", time.Since(start), heartbeats)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyHeartbeatNeverBlocks(t *testing.T) {
+	heartbeatChannel := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Nobody reads: the watchdog has timed out and returned.
+		for i := 0; i < 10000; i++ {
+			notifyHeartbeat(heartbeatChannel)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifyHeartbeat blocked")
+	}
+	if len(heartbeatChannel) != 1 {
+		t.Errorf("%d notifications pending, want 1", len(heartbeatChannel))
+	}
+}
+
+// The errors of TestClassifyNetworkError are real ones, of a failed exchange
+// with a local listener or server, where the platform can produce them.
+
+func refusedError(t *testing.T) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, err = net.Dial("tcp", address)
+	return err
+}
+
+func timeoutError(t *testing.T) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
+
+func resetError(t *testing.T) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// Closing without lingering sends a reset instead of a FIN.
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+	// Depending on the timing, the reset fails the dial or the read.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
+
+func tlsError(t *testing.T) error {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	// The test server's certificate is not signed by a known authority.
+	_, err := http.Get(server.URL)
+	return err
+}
+
+func eofError(t *testing.T) error {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+	_, err := http.Get(server.URL)
+	return err
+}
+
+func TestClassifyNetworkError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   func(t *testing.T) error
+		class string
+		fatal bool
+	}{
+		{"dns", func(*testing.T) error {
+			return &url.Error{Op: "Get", URL: "https://stream-fxpractice.oanda.com", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "stream-fxpractice.oanda.com", IsNotFound: true}}}
+		}, networkErrorDNS, true},
+		{"temporary dns", func(*testing.T) error {
+			return &net.DNSError{Err: "server misbehaving", Name: "stream-fxpractice.oanda.com", IsTemporary: true}
+		}, networkErrorDNSTemporary, false},
+		{"refused", refusedError, networkErrorRefused, false},
+		{"tls", tlsError, networkErrorTLS, true},
+		{"timeout", timeoutError, networkErrorTimeout, false},
+		{"reset", resetError, networkErrorReset, false},
+		{"eof", eofError, networkErrorEOF, false},
+		{"unexpected eof", func(*testing.T) error {
+			return fmt.Errorf("reading the stream: %w", io.ErrUnexpectedEOF)
+		}, networkErrorEOF, false},
+		{"not a network error", func(*testing.T) error {
+			return errors.New("invalid character")
+		}, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.err(t)
+			if err == nil {
+				t.Fatal("no error to classify")
+			}
+			if class := classifyNetworkError(err); class != test.class {
+				t.Errorf("%v: got class %q, want %q", err, class, test.class)
+			}
+			if fatal := isFatalStreamError(err); fatal != test.fatal {
+				t.Errorf("%v: fatal is %v, want %v", err, fatal, test.fatal)
+			}
+		})
+	}
+}
+
+func TestHeartbeatTimeoutFlag(t *testing.T) {
+	flags := []cli.Flag{
+		&cli.DurationFlag{Name: "heartbeat-timeout", Value: 20 * time.Second},
+		&cli.BoolFlag{Name: "no-heartbeat-timeout"},
+	}
+	tests := []struct {
+		name string
+		args []string
+		want time.Duration
+		err  bool
+	}{
+		{"default", nil, 20 * time.Second, false},
+		{"given", []string{"--heartbeat-timeout", "5s"}, 5 * time.Second, false},
+		{"zero", []string{"--heartbeat-timeout", "0"}, 0, false},
+		{"disabled", []string{"--no-heartbeat-timeout"}, 0, false},
+		{"disabled and zero", []string{"--no-heartbeat-timeout", "--heartbeat-timeout", "0"}, 0, false},
+		{"disabled and given", []string{"--no-heartbeat-timeout", "--heartbeat-timeout", "5s"}, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := heartbeatTimeoutFlag(newTestContext(t, flags, test.args...))
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want an error: %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHeartbeatTimeoutDisabled(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    error
+	}{
+		{20 * time.Millisecond, errHeartbeatTimeout},
+		{0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.timeout.String(), func(t *testing.T) {
+			// The stream sends a price and then nothing.
+			session, _ := newTestSession(t, droppingStream(1))
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			session.Context = ctx
+
+			err := streamLines(session, "http://stream/v3/accounts/1/pricing/stream", &StreamOptions{HeartbeatTimeout: test.timeout}, func(line []byte) (bool, error) {
+				return false, nil
+			})
+			if err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamOversizeLine(t *testing.T) {
+	// Longer than the reader's buffer, so that it arrives in several reads.
+	long := `{"type":"PRICE","pad":"` + strings.Repeat("x", 10000) + `"}`
+	tests := []struct {
+		name    string
+		options StreamOptions
+		want    []string
+		err     error
+		warning string
+	}{
+		{"skip", StreamOptions{MaxLineBytes: 100, OnOversize: "skip"}, []string{"a", "b"}, io.EOF, "skipped a stream line longer than 100 bytes"},
+		{"skip by default", StreamOptions{MaxLineBytes: 100}, []string{"a", "b"}, io.EOF, "skipped a stream line longer than 100 bytes"},
+		{"abort", StreamOptions{MaxLineBytes: 100, OnOversize: "abort"}, []string{"a"}, errOversizeLine, ""},
+		{"no limit", StreamOptions{}, []string{"a", long, "b"}, io.EOF, ""},
+		{"at the limit", StreamOptions{MaxLineBytes: len(long), OnOversize: "abort"}, []string{"a", long, "b"}, io.EOF, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, _ := newTestSession(t, fixedStream("a", long, "b"))
+			var got []string
+			var err error
+			warning := captureStderr(t, func() {
+				err = streamLines(session, "http://stream/v3/accounts/1/pricing/stream", &test.options, func(line []byte) (bool, error) {
+					got = append(got, string(line))
+					return false, nil
+				})
+			})
+			if err != test.err {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %d lines %.40q, want %d", len(got), got, len(test.want))
+			}
+			if !strings.Contains(warning, test.warning) {
+				t.Errorf("got warning %q, want %q", warning, test.warning)
+			}
+		})
+	}
+}
+
+func TestStreamUnknownOnOversize(t *testing.T) {
+	session, _ := newTestSession(t, fixedStream("a"))
+	err := streamLines(session, "http://stream/v3/accounts/1/pricing/stream", &StreamOptions{OnOversize: "truncate"}, func(line []byte) (bool, error) {
+		return false, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), `unknown on-oversize "truncate"`) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestPricingProfiles(t *testing.T) {
+	for _, key := range []string{"OANDA_TOKEN", "OANDA_ACCOUNT_ID", "OANDA_ENV"} {
+		if previous, set := os.LookupEnv(key); set {
+			os.Unsetenv(key)
+			defer os.Setenv(key, previous)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	credentials := "default:\n  account_id: 101-001-0000000-001\n  token: a\nsub:\n  account_id: 101-001-0000000-002\n  token: b\n"
+	if err := ioutil.WriteFile(path, []byte(credentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each account streams one price naming it, with its own token.
+	session, output := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		account := strings.Split(r.URL.Path, "/")[3]
+		fmt.Fprintf(w, `{"type":"PRICE","account":%q,"auth":%q}`+"\n", account, r.Header.Get("Authorization"))
+	}))
+	session.ConfigPath = path
+	session.Profile = defaultProfile
+
+	tests := []struct {
+		profile string
+		want    string
+	}{
+		{defaultProfile, `{"_job":"default","type":"PRICE","account":"101-001-0000000-001","auth":"Bearer a"}`},
+		{"sub", `{"_job":"sub","type":"PRICE","account":"101-001-0000000-002","auth":"Bearer b"}`},
+	}
+	tasks := []func(context.Context) error{}
+	for _, test := range tests {
+		profileSession, err := session.ForProfile(path, test.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		profileSession = profileSession.Tagged(test.profile)
+		tasks = append(tasks, func(ctx context.Context) error {
+			if err := getStream(profileSession.WithContext(ctx), &PricingOptions{}); err != io.EOF {
+				return err
+			}
+			return nil
+		})
+	}
+	if err := runConcurrently(context.Background(), tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	got := outputLines(output)
+	sort.Strings(got)
+	for i, test := range tests {
+		t.Run(test.profile, func(t *testing.T) {
+			if i >= len(got) || got[i] != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransactionInstrumentFilter(t *testing.T) {
+	eurFill := `{"id":"1","type":"ORDER_FILL","instrument":"EUR_USD","units":"100"}`
+	jpyFill := `{"id":"2","type":"ORDER_FILL","instrument":"USD_JPY","units":"100"}`
+	gbpOrder := `{"id":"3","type":"MARKET_ORDER","instrument":"GBP_USD","units":"-10"}`
+	financing := `{"id":"4","type":"DAILY_FINANCING","financing":"-0.1"}`
+	lines := []string{eurFill, jpyFill, gbpOrder, financing}
+	tests := []struct {
+		name    string
+		options TransactionsOptions
+		want    []string
+	}{
+		{"unfiltered", TransactionsOptions{}, lines},
+		{"one instrument", TransactionsOptions{Instrument: "EUR_USD"}, []string{eurFill}},
+		{"several instruments", TransactionsOptions{Instrument: "EUR_USD,GBP_USD"}, []string{eurFill, gbpOrder}},
+		{"with account level", TransactionsOptions{Instrument: "USD_JPY", IncludeAccountLevel: true}, []string{jpyFill, financing}},
+		{"no match", TransactionsOptions{Instrument: "AUD_USD"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := transactionLines(t, test.options, lines...); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPricingTradeable(t *testing.T) {
+	open := `{"type":"PRICE","instrument":"EUR_USD","tradeable":true}`
+	closed := `{"type":"PRICE","instrument":"USD_JPY","tradeable":false}`
+	// Older messages only carry the status.
+	halted := `{"type":"PRICE","instrument":"GBP_USD","status":"non-tradeable"}`
+	unknown := `{"type":"PRICE","instrument":"AUD_USD"}`
+	lines := []string{open, closed, halted, unknown}
+	tests := []struct {
+		name    string
+		options PricingOptions
+		want    []string
+	}{
+		{"all", PricingOptions{}, lines},
+		{"only tradeable", PricingOptions{OnlyTradeable: true}, []string{open, unknown}},
+		{
+			"with tradeable", PricingOptions{WithTradeable: true},
+			[]string{open, closed, `{"tradeable":false,"type":"PRICE","instrument":"GBP_USD","status":"non-tradeable"}`, unknown},
+		},
+		{"both", PricingOptions{OnlyTradeable: true, WithTradeable: true}, []string{open, unknown}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pricingLines(t, test.options, lines...); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsTradeable(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name      string
+		price     PriceOrHeartbeat
+		tradeable bool
+		known     bool
+	}{
+		{"flag", PriceOrHeartbeat{Tradeable: &yes}, true, true},
+		{"flag over status", PriceOrHeartbeat{Tradeable: &no, Status: "tradeable"}, false, true},
+		{"status", PriceOrHeartbeat{Status: "tradeable"}, true, true},
+		{"other status", PriceOrHeartbeat{Status: "non-tradeable"}, false, true},
+		{"neither", PriceOrHeartbeat{}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tradeable, known := test.price.IsTradeable()
+			if tradeable != test.tradeable || known != test.known {
+				t.Errorf("got %v, %v, want %v, %v", tradeable, known, test.tradeable, test.known)
+			}
+		})
+	}
+}
+
+func TestStreamReloadCredentials(t *testing.T) {
+	for _, key := range []string{"OANDA_TOKEN", "OANDA_ACCOUNT_ID", "OANDA_ENV"} {
+		if previous, set := os.LookupEnv(key); set {
+			os.Unsetenv(key)
+			defer os.Setenv(key, previous)
+		}
+	}
+	tests := []struct {
+		reload bool
+		tokens []string
+	}{
+		{true, []string{"Bearer old", "Bearer new"}},
+		{false, []string{"Bearer old", "Bearer old"}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("reload %v", test.reload), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.yaml")
+			rotate := func(token string) {
+				credentials := "default:\n  account_id: 101-001-0000000-001\n  token: " + token + "\n"
+				if err := ioutil.WriteFile(path, []byte(credentials), 0600); err != nil {
+					t.Error(err)
+				}
+			}
+			rotate("old")
+
+			// The token is rotated during the first connection, which then
+			// drops. The old token is refused from then on.
+			var mutex sync.Mutex
+			tokens := []string{}
+			session, _ := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				tokens = append(tokens, r.Header.Get("Authorization"))
+				first := len(tokens) == 1
+				mutex.Unlock()
+				if first {
+					rotate("new")
+				} else if r.Header.Get("Authorization") != "Bearer new" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprintln(w, `{"type":"PRICE"}`)
+			}))
+			session.Credentials.Default.Token = "old"
+			session.ConfigPath = path
+			session.Profile = defaultProfile
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			session.Context = ctx
+
+			received := 0
+			var err error
+			captureStderr(t, func() {
+				options := &StreamOptions{ReconnectOnAnyError: true, MaxRetries: 1, ReloadCredentials: test.reload}
+				err = streamLines(session, "http://stream/v3/accounts/1/pricing/stream", options, func(line []byte) (bool, error) {
+					if received++; received == 2 {
+						cancel()
+					}
+					return false, nil
+				})
+			})
+			if test.reload && (err != nil || received != 2) {
+				t.Errorf("got %v after %d lines, want both lines", err, received)
+			}
+			if !test.reload && err == nil {
+				t.Error("the old token was accepted")
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !reflect.DeepEqual(tokens, test.tokens) {
+				t.Errorf("connected with %v, want %v", tokens, test.tokens)
+			}
+		})
+	}
+}
+
+func TestTransactionSnapshot(t *testing.T) {
+	snapshot := `{"state":{"NAV":"1000.0","trades":[]},"lastTransactionID":"6"}`
+	transaction := `{"id":"7","type":"ORDER_FILL","instrument":"EUR_USD","units":"1"}`
+	heartbeat := `{"type":"HEARTBEAT","lastTransactionID":"7","time":"2021-03-01T00:00:00Z"}`
+	lines := []string{snapshot, heartbeat, transaction}
+	tests := []struct {
+		name    string
+		options TransactionsOptions
+		want    []string
+	}{
+		{"as is", TransactionsOptions{}, []string{snapshot, transaction}},
+		{"skipped", TransactionsOptions{SkipSnapshot: true}, []string{transaction}},
+		{"tagged", TransactionsOptions{TagSnapshot: true}, []string{`{"_snapshot":true,"state":{"NAV":"1000.0","trades":[]},"lastTransactionID":"6"}`, transaction}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := transactionLines(t, test.options, lines...); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPricingStatusChangesOnly(t *testing.T) {
+	price := func(instrument string, tradeable bool, bid string) string {
+		return fmt.Sprintf(`{"type":"PRICE","instrument":%q,"tradeable":%t,"closeoutBid":%q}`, instrument, tradeable, bid)
+	}
+	lines := []string{
+		price("EUR_USD", true, "1.1"),
+		price("USD_JPY", true, "110.1"),
+		price("EUR_USD", true, "1.2"),
+		price("EUR_USD", true, "1.3"),
+		`{"type":"HEARTBEAT","time":"2021-03-01T00:00:00Z"}`,
+		price("EUR_USD", false, "1.3"),
+		price("USD_JPY", true, "110.2"),
+		price("EUR_USD", false, "1.3"),
+		// A price without a status cannot change it.
+		`{"type":"PRICE","instrument":"EUR_USD","closeoutBid":"1.4"}`,
+		price("EUR_USD", true, "1.5"),
+		price("EUR_USD", true, "1.6"),
+	}
+	tests := []struct {
+		name    string
+		options PricingOptions
+		want    []string
+	}{
+		{"changes only", PricingOptions{StatusChangesOnly: true}, []string{lines[0], lines[1], lines[5], lines[9]}},
+		{"every tick", PricingOptions{}, []string{lines[0], lines[1], lines[2], lines[3], lines[5], lines[6], lines[7], lines[8], lines[9], lines[10]}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pricingLines(t, test.options, lines...); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got  %v\nwant %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransactionFields(t *testing.T) {
+	fill := `{"id":"6","type":"ORDER_FILL","instrument":"EUR_USD","units":"100","price":"1.20715","pl":"0.0000","reason":"MARKET_ORDER"}`
+	financing := `{"id":"7","type":"DAILY_FINANCING","financing":"-0.1"}`
+	var got []string
+	warnings := captureStderr(t, func() {
+		got = transactionLines(t, TransactionsOptions{Fields: "id,type,units,pl"}, fill, financing, financing)
+	})
+	want := []string{`{"id":"6","pl":"0.0000","type":"ORDER_FILL","units":"100"}`, `{"id":"7","type":"DAILY_FINANCING"}`, `{"id":"7","type":"DAILY_FINANCING"}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// A missing field warns once, and does not stop the stream.
+	for _, field := range []string{"units", "pl"} {
+		warning := "warning: field " + field + " is missing from a DAILY_FINANCING transaction"
+		if n := strings.Count(warnings, warning); n != 1 {
+			t.Errorf("warned %d times %q:\n%s", n, warning, warnings)
+		}
+	}
+}
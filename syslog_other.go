@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// NewSyslogWriter fails, syslog is only available on Unix.
+func NewSyslogWriter(address string, facility string, severity string, tag string) (io.WriteCloser, error) {
+	return nil, errors.New("--syslog is not supported on this platform")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CandleTicker decouples emitting a forming candle from polling it
+// (--emit-tick): completed candles are written as they arrive, while the
+// latest forming candle is written again on every tick of a wall-clock
+// aligned schedule, e.g. each second on the second.
+type CandleTicker struct {
+	Interval time.Duration
+	Writer   *CandleWriter
+	// Clock is the time source of the schedule, the system clock if nil.
+	Clock   Clock
+	forming *Candlestick
+	err     error
+	mutex   sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Clock tells the time and waits for it, so that a schedule can be tested
+// with a clock the test advances.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// NewCandleTicker starts ticking on the system clock until ctx is done or
+// Stop is called.
+func NewCandleTicker(ctx context.Context, interval time.Duration, writer *CandleWriter) *CandleTicker {
+	self := &CandleTicker{Interval: interval, Writer: writer}
+	self.Start(ctx)
+	return self
+}
+
+// Start starts ticking until ctx is done or Stop is called.
+func (self *CandleTicker) Start(ctx context.Context) {
+	if self.Clock == nil {
+		self.Clock = systemClock{}
+	}
+	ctx, self.cancel = context.WithCancel(ctx)
+	self.done = make(chan struct{})
+	go self.run(ctx)
+}
+
+func (self *CandleTicker) run(ctx context.Context) {
+	defer close(self.done)
+	for {
+		// Truncating the current time aligns the ticks to the clock rather
+		// than to when the ticker started.
+		now := self.Clock.Now()
+		next := now.Truncate(self.Interval).Add(self.Interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-self.Clock.After(next.Sub(now)):
+		}
+
+		self.mutex.Lock()
+		if self.forming != nil && self.err == nil {
+			self.err = self.Writer.Write(*self.forming)
+		}
+		self.mutex.Unlock()
+	}
+}
+
+// Write takes the place of CandleWriter.Write for the poll loop. It returns
+// the error of a failed tick, if any.
+func (self *CandleTicker) Write(candle Candlestick) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.err != nil {
+		return self.err
+	}
+	if !candle.Complete {
+		self.forming = &candle
+		return nil
+	}
+	if self.forming != nil && !self.forming.Time.After(candle.Time) {
+		self.forming = nil
+	}
+	return self.Writer.Write(candle)
+}
+
+// Stop ends the ticking and waits for a tick in progress, so that the writer
+// can be used directly again.
+func (self *CandleTicker) Stop() {
+	self.cancel()
+	<-self.done
+}
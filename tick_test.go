@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock which only moves when advanced. Every After call is
+// announced on waits, so that a test knows when the ticker is waiting.
+type fakeClock struct {
+	now    time.Time
+	timers []fakeTimer
+	waits  chan time.Duration
+	mutex  sync.Mutex
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waits: make(chan time.Duration, 16)}
+}
+
+func (self *fakeClock) Now() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.now
+}
+
+func (self *fakeClock) After(d time.Duration) <-chan time.Time {
+	self.mutex.Lock()
+	c := make(chan time.Time, 1)
+	self.timers = append(self.timers, fakeTimer{at: self.now.Add(d), c: c})
+	self.mutex.Unlock()
+	self.waits <- d
+	return c
+}
+
+// Advance moves the clock on by d, firing the timers which are due.
+func (self *fakeClock) Advance(d time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.now = self.now.Add(d)
+	pending := []fakeTimer{}
+	for _, timer := range self.timers {
+		if timer.at.After(self.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- self.now
+		}
+	}
+	self.timers = pending
+}
+
+// wait returns the duration of the ticker's next wait for the clock.
+func (self *fakeClock) wait(t *testing.T) time.Duration {
+	select {
+	case d := <-self.waits:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ticker did not wait for the clock")
+		return 0
+	}
+}
+
+// tickedCandles decodes the candles written so far.
+func tickedCandles(t *testing.T, output *LockedWriter) []Candlestick {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	candles := []Candlestick{}
+	for _, line := range strings.Split(strings.TrimSpace(output.Writer.(*bytes.Buffer).String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var candle Candlestick
+		if err := json.Unmarshal([]byte(line), &candle); err != nil {
+			t.Fatal(err)
+		}
+		candles = append(candles, candle)
+	}
+	return candles
+}
+
+func TestCandleTickerAlignsToTheClock(t *testing.T) {
+	start := time.Date(2021, 3, 1, 12, 0, 0, 300*int(time.Millisecond), time.UTC)
+	clock := newFakeClock(start)
+	output := &LockedWriter{Writer: &bytes.Buffer{}}
+	ticker := &CandleTicker{Interval: time.Second, Writer: &CandleWriter{Output: &Output{Writer: output}}, Clock: clock}
+	ticker.Start(context.Background())
+	defer ticker.Stop()
+
+	// The first tick is on the next second, not a second after the start.
+	if d := clock.wait(t); d != 700*time.Millisecond {
+		t.Fatalf("first wait is %s, want 700ms", d)
+	}
+
+	forming := testCandle("1.2", "1.0", "1.1", 5, false)
+	forming.Time = start.Truncate(time.Minute)
+	if err := ticker.Write(*forming); err != nil {
+		t.Fatal(err)
+	}
+	if got := tickedCandles(t, output); len(got) != 0 {
+		t.Fatalf("a forming candle was written before the tick: %v", got)
+	}
+
+	// Just short of the boundary nothing is written.
+	clock.Advance(699 * time.Millisecond)
+	if got := tickedCandles(t, output); len(got) != 0 {
+		t.Fatalf("written %d candles before the boundary", len(got))
+	}
+
+	// Crossing it writes the forming candle, and the next wait is a whole
+	// interval, to the following second.
+	clock.Advance(time.Millisecond)
+	if d := clock.wait(t); d != time.Second {
+		t.Errorf("next wait is %s, want 1s", d)
+	}
+	got := tickedCandles(t, output)
+	if len(got) != 1 || got[0].Complete || got[0].Volume != 5 {
+		t.Fatalf("got %v, want the forming candle once", got)
+	}
+
+	// Once completed, the candle is written as it arrives and no longer ticked.
+	complete := *forming
+	complete.Complete = true
+	if err := ticker.Write(complete); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	clock.wait(t)
+	got = tickedCandles(t, output)
+	if len(got) != 2 || !got[1].Complete {
+		t.Errorf("got %v, want the forming then the completed candle", got)
+	}
+}
+
+func TestCandleTickerStop(t *testing.T) {
+	clock := newFakeClock(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	output := &LockedWriter{Writer: &bytes.Buffer{}}
+	ticker := &CandleTicker{Interval: time.Second, Writer: &CandleWriter{Output: &Output{Writer: output}}, Clock: clock}
+	ticker.Start(context.Background())
+	clock.wait(t)
+
+	forming := testCandle("1.2", "1.0", "1.1", 5, false)
+	if err := ticker.Write(*forming); err != nil {
+		t.Fatal(err)
+	}
+	// Stop returns without a tick, and none comes after it.
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	if got := tickedCandles(t, output); len(got) != 0 {
+		t.Errorf("got %v after Stop", got)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Transforms are the rewrites applied to a message before it is rendered:
+// first Strip, then NumericPrices, then Renames.
+type Transforms struct {
+	// Strip removes fields, named as sent (--strip-fields).
+	Strip FieldPaths
+	// NumericPrices writes the prices OANDA sends as strings as JSON numbers.
+	NumericPrices bool
+	Renames       FieldRenames
+}
+
+func (self *Transforms) Apply(line string) (string, error) {
+	if len(self.Strip) != 0 {
+		var err error
+		line, err = self.Strip.Remove(line)
+		if err != nil {
+			return "", err
+		}
+	}
+	if self.NumericPrices {
+		line = numericPrices(line)
+	}
+	if len(self.Renames) == 0 {
+		return line, nil
+	}
+	return self.Renames.Apply(line)
+}
+
+// priceNumberPattern is a price as OANDA sends it, a number in a string.
+var priceNumberPattern = regexp.MustCompile(`^-?[0-9]+(?:\.[0-9]+)?$`)
+
+// isPriceField reports whether the field at path, the names of the enclosing
+// objects with "[]" for array elements and the field's own name last, is a
+// price of a price, candle or transaction. Fields of the same name anywhere
+// else are left alone.
+func isPriceField(path []string) bool {
+	name := path[len(path)-1]
+	parent, grandparent := "", ""
+	if len(path) >= 2 {
+		parent = path[len(path)-2]
+	}
+	if len(path) >= 3 {
+		grandparent = path[len(path)-3]
+	}
+
+	switch name {
+	case "closeoutBid", "closeoutAsk":
+		return true
+	case "o", "h", "l", "c":
+		return parent == "mid" || parent == "bid" || parent == "ask"
+	case "price":
+		switch {
+		case len(path) == 1:
+			return true
+		case parent == "tradeOpened" || parent == "tradeReduced":
+			return true
+		case parent == "[]":
+			return grandparent == "bids" || grandparent == "asks" || grandparent == "tradesClosed"
+		}
+	}
+	return false
+}
+
+// jsonFrame is an object or array being rewritten by numericPrices.
+type jsonFrame struct {
+	name   string
+	object bool
+	// count is the number of values written so far, key is the name of the
+	// value to come and expectKey whether a name is to come next.
+	count     int
+	key       string
+	expectKey bool
+}
+
+// numericPrices unquotes the price fields, found by their place in the
+// message, while every other field, and the order of all of them, stays as
+// sent. A line which is not JSON is returned as it is.
+func numericPrices(line string) string {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+
+	var out strings.Builder
+	frames := []*jsonFrame{}
+	writeString := func(value string) {
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(value)
+		out.WriteString(strings.TrimSuffix(buffer.String(), "\n"))
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return line
+		}
+
+		var top *jsonFrame
+		if len(frames) != 0 {
+			top = frames[len(frames)-1]
+		}
+
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			out.WriteRune(rune(delim))
+			frames = frames[:len(frames)-1]
+			if len(frames) != 0 {
+				parent := frames[len(frames)-1]
+				parent.count++
+				parent.expectKey = parent.object
+			}
+			continue
+		}
+
+		if top != nil && top.object && top.expectKey {
+			if top.count > 0 {
+				out.WriteByte(',')
+			}
+			top.key, _ = token.(string)
+			writeString(top.key)
+			out.WriteByte(':')
+			top.expectKey = false
+			continue
+		}
+		if top != nil && !top.object && top.count > 0 {
+			out.WriteByte(',')
+		}
+
+		name := "[]"
+		if top == nil {
+			name = ""
+		} else if top.object {
+			name = top.key
+		}
+
+		switch value := token.(type) {
+		case json.Delim:
+			out.WriteRune(rune(value))
+			frames = append(frames, &jsonFrame{name: name, object: value == '{', expectKey: value == '{'})
+			continue
+		case string:
+			path := []string{}
+			for _, frame := range frames[1:] {
+				path = append(path, frame.name)
+			}
+			if top != nil && top.object && isPriceField(append(path, name)) && priceNumberPattern.MatchString(value) {
+				out.WriteString(value)
+			} else {
+				writeString(value)
+			}
+		case json.Number:
+			out.WriteString(value.String())
+		case bool:
+			out.WriteString(strconv.FormatBool(value))
+		case nil:
+			out.WriteString("null")
+		}
+		if top != nil {
+			top.count++
+			top.expectKey = top.object
+		}
+	}
+
+	return out.String()
+}
+
+// TransformSpec is the --transforms file, giving the transforms of the
+// messages of each instrument:
+//
+//	instruments:
+//	  EUR_USD:
+//	    numeric_prices: true
+//	  USD_JPY:
+//	    rename: time=timestamp,mid.c=close
+type TransformSpec struct {
+	Instruments map[string]TransformConfig `yaml:"instruments"`
+}
+
+type TransformConfig struct {
+	NumericPrices bool   `yaml:"numeric_prices"`
+	Rename        string `yaml:"rename"`
+}
+
+// GetInstrumentTransforms reads a --transforms file.
+func GetInstrumentTransforms(path string) (map[string]*Transforms, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := TransformSpec{}
+	if err := unmarshalConfig(bytes, &spec); err != nil {
+		return nil, err
+	}
+
+	transforms := map[string]*Transforms{}
+	for instrument, config := range spec.Instruments {
+		transform := Transforms{NumericPrices: config.NumericPrices}
+		if config.Rename != "" {
+			renames, err := ParseRenames(config.Rename)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, instrument, err)
+			}
+			transform.Renames = renames
+		}
+		transforms[instrument] = &transform
+	}
+	return transforms, nil
+}
+
+// messageInstrument is the instrument field of a JSON message, if any.
+func messageInstrument(line string) string {
+	var message struct {
+		Instrument string `json:"instrument"`
+	}
+	if err := json.Unmarshal([]byte(line), &message); err != nil {
+		return ""
+	}
+	return message.Instrument
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNumericPrices(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			"price",
+			`{"type":"PRICE","time":"2021-03-01T00:00:00.000000000Z","bids":[{"price":"1.20701","liquidity":10000000}],"asks":[{"price":"1.20715","liquidity":10000000}],"closeoutBid":"1.20701","closeoutAsk":"1.20715","status":"tradeable","tradeable":true,"instrument":"EUR_USD"}`,
+			`{"type":"PRICE","time":"2021-03-01T00:00:00.000000000Z","bids":[{"price":1.20701,"liquidity":10000000}],"asks":[{"price":1.20715,"liquidity":10000000}],"closeoutBid":1.20701,"closeoutAsk":1.20715,"status":"tradeable","tradeable":true,"instrument":"EUR_USD"}`,
+		},
+		{
+			"candle",
+			`{"complete":true,"volume":12,"time":"2021-03-01T00:00:00Z","mid":{"o":"1.2070","h":"1.2080","l":"1.2060","c":"1.2075"},"bid":null,"ask":null}`,
+			`{"complete":true,"volume":12,"time":"2021-03-01T00:00:00Z","mid":{"o":1.2070,"h":1.2080,"l":1.2060,"c":1.2075},"bid":null,"ask":null}`,
+		},
+		{
+			"candle batch",
+			`[{"mid":{"o":"1.1","c":"1.2"}},{"ask":{"h":"1.3"}}]`,
+			`[{"mid":{"o":1.1,"c":1.2}},{"ask":{"h":1.3}}]`,
+		},
+		{
+			"order fill",
+			`{"type":"ORDER_FILL","id":"6","units":"100","price":"1.20715","tradeOpened":{"tradeID":"6","units":"100","price":"1.20715"},"tradesClosed":[{"tradeID":"5","units":"-100","price":"1.20701"}],"pl":"0.1234","fullPrice":{"bids":[{"price":"1.20701"}],"closeoutBid":"1.20701"}}`,
+			`{"type":"ORDER_FILL","id":"6","units":"100","price":1.20715,"tradeOpened":{"tradeID":"6","units":"100","price":1.20715},"tradesClosed":[{"tradeID":"5","units":"-100","price":1.20701}],"pl":"0.1234","fullPrice":{"bids":[{"price":1.20701}],"closeoutBid":1.20701}}`,
+		},
+		{
+			"unrelated fields of price names",
+			`{"o":"1","h":"2","meta":{"l":"3","c":"4","price":"5"},"list":[{"price":"6"}]}`,
+			`{"o":"1","h":"2","meta":{"l":"3","c":"4","price":"5"},"list":[{"price":"6"}]}`,
+		},
+		{
+			"price which is not a number",
+			`{"price":"n/a","mid":{"o":""}}`,
+			`{"price":"n/a","mid":{"o":""}}`,
+		},
+		{
+			"not JSON",
+			`EUR_USD 1.20701`,
+			`EUR_USD 1.20701`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := numericPrices(test.line); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInstrumentTransforms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transforms.yaml")
+	spec := "instruments:\n  EUR_USD:\n    numeric_prices: true\n  USD_JPY:\n    rename: closeoutBid=bid\n"
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestContext(t, outputFlags(), "--transforms", path, "--rename", "type=kind")
+	output := &bytes.Buffer{}
+	session := &Session{Context: context.Background(), Output: &Output{Writer: output}}
+	if err := session.OpenOutput(c); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"numeric prices", `{"type":"PRICE","instrument":"EUR_USD","closeoutBid":"1.2"}`, `{"kind":"PRICE","instrument":"EUR_USD","closeoutBid":1.2}`},
+		{"renamed", `{"type":"PRICE","instrument":"USD_JPY","closeoutBid":"110.5"}`, `{"kind":"PRICE","instrument":"USD_JPY","bid":"110.5"}`},
+		{"no transforms", `{"type":"PRICE","instrument":"GBP_USD","closeoutBid":"1.4"}`, `{"kind":"PRICE","instrument":"GBP_USD","closeoutBid":"1.4"}`},
+		{"no instrument", `{"type":"HEARTBEAT"}`, `{"kind":"HEARTBEAT"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output.Reset()
+			if err := session.Output.Emit(test.line); err != nil {
+				t.Fatal(err)
+			}
+			// --rename writes the fields in order of their names.
+			var got, want map[string]interface{}
+			if err := json.Unmarshal(output.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			json.Unmarshal([]byte(test.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s, want %s", output, test.want)
+			}
+		})
+	}
+}
+
+func TestGetInstrumentTransformsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transforms.yaml")
+	if err := ioutil.WriteFile(path, []byte("instruments:\n  EUR_USD:\n    rename: time\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetInstrumentTransforms(path); err == nil || !strings.Contains(err.Error(), "EUR_USD") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// clearScreen moves the cursor home and clears a terminal.
+const clearScreen = "\033[H\033[2J"
+
+// watch runs snapshot once, or with a non-zero interval every interval until
+// the session context is done. On a terminal, the screen is cleared before
+// each refresh; otherwise every refresh simply adds its lines.
+func watch(session *Session, interval time.Duration, snapshot func() error) error {
+	if interval == 0 {
+		return snapshot()
+	}
+
+	writer := session.Output.Writer
+	if formatted, ok := writer.(*FormattedWriter); ok {
+		writer = formatted.Writer
+	}
+	stdout, _ := writer.(*LockedWriter)
+	clear := stdout != nil && stdout.Writer == os.Stdout && isTerminal(os.Stdout)
+	for {
+		if clear {
+			fmt.Fprint(os.Stdout, clearScreen)
+		}
+		if err := snapshot(); err != nil {
+			if session.Context.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		select {
+		case <-session.Context.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
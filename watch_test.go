@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		cycles   int
+	}{
+		{"once", 0, 1},
+		{"two cycles", time.Millisecond, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			requests := 0
+			session, output := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Write([]byte(`{"account":{"id":"101-001-0000000-001","currency":"USD","marginRate":"0.05","NAV":"100","positionValue":"0","marginUsed":"0"}}`))
+			}))
+			session.Context = ctx
+
+			err := watch(session, test.interval, func() error {
+				summary, err := getAccountSummary(session)
+				if err != nil {
+					return err
+				}
+				bytes, err := json.Marshal(summary)
+				if err != nil {
+					return err
+				}
+				if err := session.Output.Println(string(bytes)); err != nil {
+					return err
+				}
+				if requests == test.cycles {
+					cancel()
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Without a terminal every refresh only adds its line.
+			lines := outputLines(output)
+			if requests != test.cycles || len(lines) != test.cycles {
+				t.Errorf("got %d requests and lines %v, want %d refreshes", requests, lines, test.cycles)
+			}
+			for _, line := range lines {
+				if line[0] != '{' {
+					t.Errorf("line %q is not only the snapshot", line)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchErrors(t *testing.T) {
+	failure := errors.New("snapshot failed")
+	session := &Session{Context: context.Background(), Output: &Output{}}
+	if err := watch(session, time.Millisecond, func() error { return failure }); err != failure {
+		t.Errorf("got %v, want the snapshot's error", err)
+	}
+
+	// A snapshot cut short by the end of the session ends the watch cleanly.
+	ctx, cancel := context.WithCancel(context.Background())
+	session.Context = ctx
+	err := watch(session, time.Millisecond, func() error {
+		cancel()
+		return context.Canceled
+	})
+	if err != nil {
+		t.Errorf("got %v after the session ended", err)
+	}
+}